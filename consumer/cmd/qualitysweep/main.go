@@ -0,0 +1,109 @@
+// Command qualitysweep compresses every image in a directory at a range of JPEG
+// qualities and reports the output size, SSIM and PSNR for each one, so that the
+// consumer's compression settings can be tuned from data.
+//
+//	go run ./cmd/qualitysweep -dir ./samples -q 30,40,50,60,70,80,90 -out report.csv
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "directory of sample images")
+	qualityList := flag.String("q", "30,40,50,60,70,80,90", "comma-separated JPEG qualities to sweep")
+	out := flag.String("out", "", "write the per-image CSV report to this file instead of stdout")
+	flag.Parse()
+
+	qualities, err := parseQualities(*qualityList)
+	if err != nil {
+		logrus.Fatalf("Invalid qualities: %v", err)
+	}
+
+	results, err := imageutils.SweepDirectory(*dir, qualities)
+	if err != nil {
+		logrus.Fatalf("Failed to sweep %s: %v", *dir, err)
+	}
+	if len(results) == 0 {
+		logrus.Fatalf("No images found in %s", *dir)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			logrus.Fatalf("Failed to create %s: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeCSV(w, results); err != nil {
+		logrus.Fatalf("Failed to write report: %v", err)
+	}
+	writeSummary(os.Stderr, qualities, results)
+}
+
+func parseQualities(s string) ([]int, error) {
+	qualities := []int{}
+	for _, part := range strings.Split(s, ",") {
+		q, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if q < 1 || q > 100 {
+			return nil, fmt.Errorf("quality %d out of range 1-100", q)
+		}
+		qualities = append(qualities, q)
+	}
+	return qualities, nil
+}
+
+func writeCSV(w io.Writer, results []imageutils.SweepResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"file", "quality", "size_bytes", "ssim", "psnr"})
+	for _, r := range results {
+		cw.Write([]string{
+			r.File,
+			strconv.Itoa(r.Quality),
+			strconv.Itoa(r.Size),
+			strconv.FormatFloat(r.SSIM, 'f', 4, 64),
+			strconv.FormatFloat(r.PSNR, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeSummary prints the mean size and scores across all images for each quality
+func writeSummary(w io.Writer, qualities []int, results []imageutils.SweepResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "quality\tmean size (KB)\tmean SSIM\tmean PSNR (dB)\t")
+	for _, q := range qualities {
+		var size, ssim, psnr float64
+		n := 0
+		for _, r := range results {
+			if r.Quality != q {
+				continue
+			}
+			size += float64(r.Size)
+			ssim += r.SSIM
+			psnr += r.PSNR
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%.1f\t%.4f\t%.2f\t\n", q, size/float64(n)/1024, ssim/float64(n), psnr/float64(n))
+	}
+	tw.Flush()
+}
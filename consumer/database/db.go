@@ -82,9 +82,7 @@ func GetProductImages(product_id int, db *sql.DB) ([]string, error) {
 		return nil, err
 	}
 
-	// Split the comma-separated values and return them as a slice of strings
-	images := strings.Split(product_images, ",")
-	return images, nil
+	return DecodeProductImages(product_images), nil
 }
 
 func UpdateProductImages(db *sql.DB, productID int, compressedImagesPaths []string) error {
@@ -121,3 +119,104 @@ func UpdateProductImages(db *sql.DB, productID int, compressedImagesPaths []stri
 	logrus.Infof("Successfully updated product_id: %d", productID)
 	return nil
 }
+
+// CompressedImage holds the compression details recorded for a single output image
+type CompressedImage struct {
+	SourceURL   string
+	ContentHash string
+	Rendition   string
+	Backend     string
+	Key         string
+	Quality     int
+	SSIM        float64
+	PSNR        float64
+	Size        int
+
+	OriginalKey         string
+	OriginalContentType string
+	OriginalChecksum    string
+	OriginalSize        int
+}
+
+// InsertCompressedImages records the quality and scores chosen for each compressed output of a product
+func InsertCompressedImages(db *sql.DB, productID int, images []CompressedImage) error {
+	if len(images) == 0 {
+		return nil
+	}
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	stmt, err := db.Prepare("INSERT INTO CompressedImages (product_id, source_url, content_hash, rendition, storage_backend, storage_key, quality, ssim, psnr, size_bytes, original_key, original_content_type, original_checksum, original_size, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		logrus.Errorf("error preparing insert statement: %v", err)
+		return err
+	}
+	defer stmt.Close()
+
+	for _, img := range images {
+		_, err = stmt.Exec(productID, img.SourceURL, img.ContentHash, img.Rendition, img.Backend, img.Key, img.Quality, img.SSIM, img.PSNR, img.Size, img.OriginalKey, img.OriginalContentType, img.OriginalChecksum, img.OriginalSize, currentTime)
+		if err != nil {
+			logrus.Errorf("error executing insert statement: %v", err)
+			return err
+		}
+	}
+	logrus.Infof("Recorded %d compressed images for product_id: %d", len(images), productID)
+	return nil
+}
+
+// ArchivedOriginal describes the raw source image kept in storage for a product image
+type ArchivedOriginal struct {
+	Key         string
+	ContentType string
+	Checksum    string
+	Size        int
+}
+
+// GetArchivedOriginals returns the most recently recorded archived original of each
+// source URL of a product, keyed by URL
+func GetArchivedOriginals(db *sql.DB, productID int) (map[string]ArchivedOriginal, error) {
+	rows, err := db.Query("SELECT source_url, original_key, original_content_type, original_checksum, original_size FROM CompressedImages WHERE product_id = ? AND original_key <> '' ORDER BY id", productID)
+	if err != nil {
+		logrus.Errorf("Error querying archived originals: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	originals := map[string]ArchivedOriginal{}
+	for rows.Next() {
+		var url string
+		var orig ArchivedOriginal
+		if err := rows.Scan(&url, &orig.Key, &orig.ContentType, &orig.Checksum, &orig.Size); err != nil {
+			return nil, err
+		}
+		// Later rows win, so each URL maps to its latest original
+		originals[url] = orig
+	}
+	return originals, rows.Err()
+}
+
+// Processing statuses of a product's images
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// SetProductStatus records whether the images of a product were processed
+func SetProductStatus(db *sql.DB, productID int, status string) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE Products SET processing_status = ?, updated_at = ? WHERE product_id = ?", status, currentTime, productID)
+	if err != nil {
+		logrus.Errorf("error updating processing status of product_id %d: %v", productID, err)
+	}
+	return err
+}
+
+// CompleteReprocessItem marks a product of a reprocessing job as done, recording
+// the error message when it failed
+func CompleteReprocessItem(db *sql.DB, jobID string, productID int, errMsg string) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE ReprocessItems SET completed_at = ?, error = ? WHERE job_id = ? AND product_id = ?", currentTime, errMsg, jobID, productID)
+	if err != nil {
+		logrus.Errorf("error completing reprocess item %s/%d: %v", jobID, productID, err)
+	}
+	return err
+}
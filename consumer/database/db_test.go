@@ -120,3 +120,159 @@ func TestUpdateProductImages(t *testing.T) {
 		t.Fatal("Expected error updating nonexistent product, but got nil")
 	}
 }
+
+func newCompressedImagesDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE CompressedImages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER,
+			source_url TEXT,
+			content_hash TEXT,
+			rendition TEXT,
+			storage_backend TEXT,
+			storage_key TEXT,
+			quality INTEGER,
+			ssim REAL,
+			psnr REAL,
+			size_bytes INTEGER,
+			original_key TEXT DEFAULT '',
+			original_content_type TEXT DEFAULT '',
+			original_checksum TEXT DEFAULT '',
+			original_size INTEGER DEFAULT 0,
+			created_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Error creating CompressedImages table: %v", err)
+	}
+	return testDB
+}
+
+func TestInsertCompressedImages(t *testing.T) {
+	testDB := newCompressedImagesDB(t)
+
+	images := []CompressedImage{
+		{SourceURL: "http://example.com/a.jpg", ContentHash: "aaaa", Rendition: "w1024", Backend: "local", Key: "1/aaaa_w1024.jpg", Quality: 72, SSIM: 0.97, PSNR: 38.5, Size: 1200},
+		{SourceURL: "http://example.com/b.jpg", ContentHash: "bbbb", Rendition: "w1024", Backend: "local", Key: "1/bbbb_w1024.jpg", Quality: 55, SSIM: 0.95, PSNR: 34.1, Size: 900},
+	}
+	err := InsertCompressedImages(testDB, 1, images)
+	if err != nil {
+		t.Fatalf("Error inserting compressed images: %v", err)
+	}
+
+	var count int
+	err = testDB.QueryRow("SELECT COUNT(*) FROM CompressedImages WHERE product_id = 1").Scan(&count)
+	if err != nil {
+		t.Fatalf("Error counting compressed images: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 compressed images, but got %d", count)
+	}
+
+	var quality int
+	var ssim, psnr float64
+	err = testDB.QueryRow("SELECT quality, ssim, psnr FROM CompressedImages WHERE content_hash = ?", "bbbb").Scan(&quality, &ssim, &psnr)
+	if err != nil {
+		t.Fatalf("Error getting compressed image: %v", err)
+	}
+	if quality != 55 || ssim != 0.95 || psnr != 34.1 {
+		t.Errorf("Expected quality 55, ssim 0.95 and psnr 34.1, but got %d, %f and %f", quality, ssim, psnr)
+	}
+}
+
+func TestGetArchivedOriginals(t *testing.T) {
+	testDB := newCompressedImagesDB(t)
+
+	first := []CompressedImage{
+		{SourceURL: "http://example.com/a.jpg", ContentHash: "aaaa", Key: "1/aaaa_w1024.jpg", OriginalKey: "1/originals/aaaa.jpg", OriginalContentType: "image/jpeg", OriginalChecksum: "a1", OriginalSize: 5000},
+		{SourceURL: "http://example.com/b.jpg", ContentHash: "bbbb", Key: "1/bbbb_w1024.jpg"},
+	}
+	if err := InsertCompressedImages(testDB, 1, first); err != nil {
+		t.Fatalf("Error inserting compressed images: %v", err)
+	}
+	// A later run archived a changed a.jpg
+	second := []CompressedImage{
+		{SourceURL: "http://example.com/a.jpg", ContentHash: "cccc", Key: "1/cccc_w1024.jpg", OriginalKey: "1/originals/cccc.png", OriginalContentType: "image/png", OriginalChecksum: "c1", OriginalSize: 7000},
+	}
+	if err := InsertCompressedImages(testDB, 1, second); err != nil {
+		t.Fatalf("Error inserting compressed images: %v", err)
+	}
+	if err := InsertCompressedImages(testDB, 2, first[:1]); err != nil {
+		t.Fatalf("Error inserting compressed images: %v", err)
+	}
+
+	originals, err := GetArchivedOriginals(testDB, 1)
+	if err != nil {
+		t.Fatalf("Error getting archived originals: %v", err)
+	}
+	if len(originals) != 1 {
+		t.Fatalf("Expected 1 archived original, but got %d", len(originals))
+	}
+	want := ArchivedOriginal{Key: "1/originals/cccc.png", ContentType: "image/png", Checksum: "c1", Size: 7000}
+	if got := originals["http://example.com/a.jpg"]; got != want {
+		t.Errorf("Expected %+v, but got %+v", want, got)
+	}
+}
+
+func TestProcessingStatus(t *testing.T) {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	defer testDB.Close()
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (product_id INTEGER PRIMARY KEY, processing_status TEXT, updated_at TIMESTAMP);
+		CREATE TABLE ReprocessItems (job_id TEXT, product_id INTEGER, enqueued_at TIMESTAMP, completed_at TIMESTAMP NULL, error TEXT);
+		INSERT INTO Products (product_id, processing_status) VALUES (1, 'pending');
+		INSERT INTO ReprocessItems (job_id, product_id) VALUES ('job', 1);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+
+	if err := SetProductStatus(testDB, 1, StatusFailed); err != nil {
+		t.Fatalf("Error setting status: %v", err)
+	}
+	var status string
+	testDB.QueryRow("SELECT processing_status FROM Products WHERE product_id = 1").Scan(&status)
+	if status != StatusFailed {
+		t.Errorf("Expected status %s, but got %s", StatusFailed, status)
+	}
+
+	if err := CompleteReprocessItem(testDB, "job", 1, "download failed"); err != nil {
+		t.Fatalf("Error completing item: %v", err)
+	}
+	var completedAt sql.NullString
+	var errMsg string
+	testDB.QueryRow("SELECT completed_at, error FROM ReprocessItems WHERE job_id = 'job'").Scan(&completedAt, &errMsg)
+	if !completedAt.Valid || errMsg != "download failed" {
+		t.Errorf("Expected the item to be completed with an error, but got %v and %q", completedAt, errMsg)
+	}
+}
+
+func TestProductImagesEncoding(t *testing.T) {
+	// A URL with a comma stays one source
+	images := []string{"http://a/1.jpg,local:1/originals/x.jpg", "local:uploads/1/a.png"}
+	encoded := EncodeProductImages(images)
+	if decoded := DecodeProductImages(encoded); !reflect.DeepEqual(decoded, images) {
+		t.Errorf("Expected %v after a round trip, but got %v", images, decoded)
+	}
+	if encoded := EncodeProductImages(nil); encoded != "[]" {
+		t.Errorf("Expected no images to be stored as [], but got %q", encoded)
+	}
+
+	// Products stored before the column held JSON are still read
+	if decoded := DecodeProductImages("a.jpg,b.jpg"); !reflect.DeepEqual(decoded, []string{"a.jpg", "b.jpg"}) {
+		t.Errorf("Expected the comma-separated list to be split, but got %v", decoded)
+	}
+	if decoded := DecodeProductImages(""); len(decoded) != 0 {
+		t.Errorf("Expected no images, but got %v", decoded)
+	}
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RebuildCompressedProductImages rewrites the compressed_product_images of a product
+// from its recorded outputs, in the order of its product_images. Each image lists
+// the latest output of every rendition, so processing some images of a product
+// keeps the outputs of the others.
+func RebuildCompressedProductImages(db *sql.DB, productID int) error {
+	var images sql.NullString
+	if err := db.QueryRow("SELECT product_images FROM Products WHERE product_id = ?", productID).Scan(&images); err != nil {
+		logrus.Errorf("Error getting images of product_id %d: %v", productID, err)
+		return err
+	}
+	rows, err := db.Query("SELECT source_url, rendition, storage_backend, storage_key FROM CompressedImages WHERE product_id = ? ORDER BY id", productID)
+	if err != nil {
+		logrus.Errorf("Error querying compressed images of product_id %d: %v", productID, err)
+		return err
+	}
+	defer rows.Close()
+	outputs := map[string]*renditionRefs{}
+	for rows.Next() {
+		var source, rendition, backend, key string
+		if err := rows.Scan(&source, &rendition, &backend, &key); err != nil {
+			return err
+		}
+		if outputs[source] == nil {
+			outputs[source] = &renditionRefs{refs: map[string]string{}}
+		}
+		outputs[source].set(rendition, backend+":"+key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	compressed := []string{}
+	for _, source := range DecodeProductImages(images.String) {
+		if r := outputs[source]; r != nil {
+			for _, rendition := range r.order {
+				compressed = append(compressed, r.refs[rendition])
+			}
+		}
+	}
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err = db.Exec("UPDATE Products SET compressed_product_images = ?, updated_at = ? WHERE product_id = ?", strings.Join(compressed, ","), currentTime, productID)
+	if err != nil {
+		logrus.Errorf("Error updating compressed images of product_id %d: %v", productID, err)
+	}
+	return err
+}
+
+// renditionRefs holds the latest output of each rendition of an image, in the
+// order the renditions were first produced
+type renditionRefs struct {
+	order []string
+	refs  map[string]string
+}
+
+func (r *renditionRefs) set(rendition, ref string) {
+	if _, ok := r.refs[rendition]; !ok {
+		r.order = append(r.order, rendition)
+	}
+	r.refs[rendition] = ref
+}
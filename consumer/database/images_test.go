@@ -0,0 +1,42 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestRebuildCompressedProductImages(t *testing.T) {
+	testDB := newCompressedImagesDB(t)
+	_, err := testDB.Exec(`
+		CREATE TABLE Products (
+			product_id INTEGER PRIMARY KEY,
+			product_images TEXT,
+			compressed_product_images TEXT,
+			updated_at TEXT
+		);
+		INSERT INTO Products VALUES (1, '["http://a/2.jpg","local:uploads/1/new.png","http://a/1.jpg"]', '', NULL);
+		INSERT INTO CompressedImages (product_id, source_url, rendition, storage_backend, storage_key) VALUES
+			(1, 'http://a/1.jpg', 'w1024', 'local', '1/one_w1024.jpg'),
+			(1, 'http://a/1.jpg', 'w256', 'local', '1/one_w256.jpg'),
+			(1, 'http://a/2.jpg', 'w1024', 'local', '1/two_w1024.jpg'),
+			(1, 'http://a/removed.jpg', 'w1024', 'local', '1/removed_w1024.jpg'),
+			(1, 'http://a/1.jpg', 'w1024', 'local', '1/one_v2_w1024.jpg'),
+			(2, 'http://a/1.jpg', 'w1024', 'local', '2/other_w1024.jpg');
+	`)
+	if err != nil {
+		t.Fatalf("Error creating Products table: %v", err)
+	}
+
+	if err := RebuildCompressedProductImages(testDB, 1); err != nil {
+		t.Fatalf("Error rebuilding compressed images: %v", err)
+	}
+	var compressed string
+	if err := testDB.QueryRow("SELECT compressed_product_images FROM Products WHERE product_id = 1").Scan(&compressed); err != nil {
+		t.Fatalf("Error querying product: %v", err)
+	}
+	// Outputs follow the image order, use the latest output of each rendition and
+	// skip images without outputs or no longer on the product
+	expected := "local:1/two_w1024.jpg,local:1/one_v2_w1024.jpg,local:1/one_w256.jpg"
+	if compressed != expected {
+		t.Errorf("Expected compressed_product_images %q, but got %q", expected, compressed)
+	}
+}
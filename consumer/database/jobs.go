@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of a processed job
+const (
+	JobProcessing = "processing"
+	JobDone       = "done"
+	JobFailed     = "failed"
+)
+
+// JobCompleted reports whether the job with the given idempotency key finished successfully
+func JobCompleted(db *sql.DB, key string) (bool, error) {
+	var status string
+	err := db.QueryRow("SELECT status FROM ProcessedJobs WHERE job_key = ?", key).Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		logrus.Errorf("error checking job %s: %v", key, err)
+		return false, err
+	}
+	return status == JobDone, nil
+}
+
+// RecordJob stores the status of a job, creating its record on first use
+func RecordJob(db *sql.DB, key string, productID int, status string, errMsg string) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE ProcessedJobs SET status = ?, error = ?, updated_at = ? WHERE job_key = ?", status, errMsg, currentTime, key)
+	if err != nil {
+		logrus.Errorf("error recording job %s: %v", key, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	_, err = db.Exec("INSERT INTO ProcessedJobs (job_key, product_id, status, error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", key, productID, status, errMsg, currentTime, currentTime)
+	if err != nil {
+		logrus.Errorf("error recording job %s: %v", key, err)
+	}
+	return err
+}
+
+// AcquireProductLock takes a lease on a product so that only one consumer processes
+// it at a time. It returns false while another owner holds an unexpired lease.
+func AcquireProductLock(db *sql.DB, productID int, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// Leases left behind by a crashed consumer expire
+	_, err := db.Exec("DELETE FROM ProductLocks WHERE product_id = ? AND expires_at < ?", productID, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("error clearing expired lock of product_id %d: %v", productID, err)
+		return false, err
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM ProductLocks WHERE product_id = ?", productID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	// The primary key makes the insert fail if another owner got in first
+	_, err = db.Exec("INSERT INTO ProductLocks (product_id, owner, expires_at) VALUES (?, ?, ?)", productID, owner, now.Add(ttl).Format("2006-01-02 15:04:05"))
+	if err != nil {
+		if isDuplicateKey(err) {
+			logrus.Infof("Lock of product_id %d taken concurrently", productID)
+			return false, nil
+		}
+		logrus.Errorf("error locking product_id %d: %v", productID, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// RenewProductLock extends a lease held by owner to ttl from now. It returns false
+// when owner no longer holds the lease, e.g. because it expired and was taken over.
+func RenewProductLock(db *sql.DB, productID int, owner string, ttl time.Duration) (bool, error) {
+	res, err := db.Exec("UPDATE ProductLocks SET expires_at = ? WHERE product_id = ? AND owner = ?", time.Now().Add(ttl).Format("2006-01-02 15:04:05"), productID, owner)
+	if err != nil {
+		logrus.Errorf("error renewing lock of product_id %d: %v", productID, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// isDuplicateKey reports whether err is a primary or unique key violation, from
+// MySQL or from SQLite in tests
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// ReleaseProductLock gives up a lease taken by owner
+func ReleaseProductLock(db *sql.DB, productID int, owner string) error {
+	_, err := db.Exec("DELETE FROM ProductLocks WHERE product_id = ? AND owner = ?", productID, owner)
+	if err != nil {
+		logrus.Errorf("error releasing lock of product_id %d: %v", productID, err)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func newJobsDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE ProcessedJobs (job_key TEXT PRIMARY KEY, product_id INTEGER, status TEXT, error TEXT, created_at TIMESTAMP, updated_at TIMESTAMP);
+		CREATE TABLE ProductLocks (product_id INTEGER PRIMARY KEY, owner TEXT, expires_at TIMESTAMP);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func TestRecordJob(t *testing.T) {
+	testDB := newJobsDB(t)
+
+	done, err := JobCompleted(testDB, "product:1")
+	if err != nil || done {
+		t.Fatalf("Expected an unknown job not to be completed, got %v, %v", done, err)
+	}
+	if err := RecordJob(testDB, "product:1", 1, JobProcessing, ""); err != nil {
+		t.Fatalf("Error recording job: %v", err)
+	}
+	if done, _ := JobCompleted(testDB, "product:1"); done {
+		t.Error("Expected a job in progress not to be completed")
+	}
+	if err := RecordJob(testDB, "product:1", 1, JobFailed, "boom"); err != nil {
+		t.Fatalf("Error recording job: %v", err)
+	}
+	if done, _ := JobCompleted(testDB, "product:1"); done {
+		t.Error("Expected a failed job not to be completed")
+	}
+	if err := RecordJob(testDB, "product:1", 1, JobDone, ""); err != nil {
+		t.Fatalf("Error recording job: %v", err)
+	}
+	if done, _ := JobCompleted(testDB, "product:1"); !done {
+		t.Error("Expected the job to be completed")
+	}
+
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM ProcessedJobs").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 job record, but got %d", count)
+	}
+}
+
+func TestProductLock(t *testing.T) {
+	testDB := newJobsDB(t)
+
+	locked, err := AcquireProductLock(testDB, 1, "a", time.Minute)
+	if err != nil || !locked {
+		t.Fatalf("Expected to acquire the lock, got %v, %v", locked, err)
+	}
+	if locked, _ := AcquireProductLock(testDB, 1, "b", time.Minute); locked {
+		t.Error("Expected the lock to be held by a")
+	}
+	if locked, _ := AcquireProductLock(testDB, 2, "b", time.Minute); !locked {
+		t.Error("Expected other products not to be locked")
+	}
+
+	// Only the owner can release the lock
+	ReleaseProductLock(testDB, 1, "b")
+	if locked, _ := AcquireProductLock(testDB, 1, "b", time.Minute); locked {
+		t.Error("Expected the lock to still be held by a")
+	}
+	ReleaseProductLock(testDB, 1, "a")
+	if locked, _ := AcquireProductLock(testDB, 1, "b", time.Minute); !locked {
+		t.Error("Expected to acquire the released lock")
+	}
+
+	// An expired lease can be taken over
+	testDB.Exec("UPDATE ProductLocks SET expires_at = '2000-01-01 00:00:00' WHERE product_id = 1")
+	if locked, _ := AcquireProductLock(testDB, 1, "c", time.Minute); !locked {
+		t.Error("Expected to take over the expired lock")
+	}
+}
+
+func TestRenewProductLock(t *testing.T) {
+	testDB := newJobsDB(t)
+
+	if locked, _ := AcquireProductLock(testDB, 1, "a", time.Minute); !locked {
+		t.Fatal("Expected to acquire the lock")
+	}
+	// A renewed lease outlives its original expiry
+	testDB.Exec("UPDATE ProductLocks SET expires_at = '2000-01-01 00:00:00' WHERE product_id = 1")
+	if renewed, err := RenewProductLock(testDB, 1, "a", time.Minute); err != nil || !renewed {
+		t.Fatalf("Expected the owner to renew the lock, got %v, %v", renewed, err)
+	}
+	if locked, _ := AcquireProductLock(testDB, 1, "b", time.Minute); locked {
+		t.Error("Expected the renewed lock to still be held by a")
+	}
+	if renewed, _ := RenewProductLock(testDB, 1, "b", time.Minute); renewed {
+		t.Error("Expected only the owner to renew the lock")
+	}
+
+	// An owner whose lease was taken over is told so
+	testDB.Exec("UPDATE ProductLocks SET expires_at = '2000-01-01 00:00:00' WHERE product_id = 1")
+	if locked, _ := AcquireProductLock(testDB, 1, "b", time.Minute); !locked {
+		t.Fatal("Expected to take over the expired lock")
+	}
+	if renewed, _ := RenewProductLock(testDB, 1, "a", time.Minute); renewed {
+		t.Error("Expected the previous owner to have lost the lock")
+	}
+}
+
+func TestProductLockDatabaseError(t *testing.T) {
+	testDB := newJobsDB(t)
+	testDB.Exec("DROP TABLE ProductLocks")
+	testDB.Exec("CREATE TABLE ProductLocks (product_id INTEGER PRIMARY KEY, owner TEXT CHECK (owner <> 'broken'), expires_at TIMESTAMP)")
+
+	// Only a duplicate key means contention, other insert errors are returned
+	if _, err := AcquireProductLock(testDB, 1, "broken", time.Minute); err == nil {
+		t.Error("Expected the failed insert to be returned")
+	}
+}
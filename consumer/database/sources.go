@@ -0,0 +1,33 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// EncodeProductImages serialises the sources of a product's images for the
+// product_images column. They are stored as a JSON array, so a URL containing a
+// comma stays one source.
+func EncodeProductImages(images []string) string {
+	if images == nil {
+		images = []string{}
+	}
+	data, _ := json.Marshal(images)
+	return string(data)
+}
+
+// DecodeProductImages reads the product_images column. Products stored before the
+// column held JSON list their sources separated by commas.
+func DecodeProductImages(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return []string{}
+	}
+	if strings.HasPrefix(s, "[") {
+		var images []string
+		if err := json.Unmarshal([]byte(s), &images); err == nil {
+			return images
+		}
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookSubscription is an endpoint that is notified of product events
+type WebhookSubscription struct {
+	ID     int64
+	URL    string
+	Secret string
+}
+
+// WebhookDelivery is an event waiting to be sent to a subscription
+type WebhookDelivery struct {
+	ID            int64
+	Subscription  WebhookSubscription
+	Event         string
+	ProductID     int
+	Payload       []byte
+	Attempts      int
+	NextAttemptAt time.Time
+}
+
+// WebhookAttempt is the outcome of sending a delivery once
+type WebhookAttempt struct {
+	ResponseStatus int // 0 when no response was received
+	Error          string
+	Duration       time.Duration
+}
+
+// ProductEvent is the state of a product reported to webhooks and in domain events
+type ProductEvent struct {
+	ProductID        int
+	UserID           int
+	ProcessingStatus string
+	CompressedImages []string
+}
+
+// GetProductEvent returns the state of a product reported to webhooks and in domain events
+func GetProductEvent(db *sql.DB, productID int) (*ProductEvent, error) {
+	var userID sql.NullInt64
+	var status, compressed sql.NullString
+	err := db.QueryRow("SELECT user_id, processing_status, compressed_product_images FROM Products WHERE product_id = ?", productID).Scan(&userID, &status, &compressed)
+	if err != nil {
+		logrus.Errorf("Error getting product_id %d: %v", productID, err)
+		return nil, err
+	}
+	event := &ProductEvent{ProductID: productID, UserID: int(userID.Int64), ProcessingStatus: status.String, CompressedImages: []string{}}
+	if compressed.String != "" {
+		event.CompressedImages = strings.Split(compressed.String, ",")
+	}
+	return event, nil
+}
+
+// FindWebhookSubscriptions returns the active subscriptions to event for products of
+// userID, including the subscriptions to every user's products
+func FindWebhookSubscriptions(db *sql.DB, userID int, event string) ([]WebhookSubscription, error) {
+	rows, err := db.Query("SELECT id, url, secret, events FROM WebhookSubscriptions WHERE active = ? AND (user_id IS NULL OR user_id = ?) ORDER BY id", true, userID)
+	if err != nil {
+		logrus.Errorf("Error querying webhook subscriptions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		var events string
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.Secret, &events); err != nil {
+			return nil, err
+		}
+		for _, e := range strings.Split(events, ",") {
+			if e == event {
+				subs = append(subs, sub)
+				break
+			}
+		}
+	}
+	return subs, rows.Err()
+}
+
+// InsertWebhookDelivery queues an event for a subscription, to be sent right away
+func InsertWebhookDelivery(db *sql.DB, subscriptionID int64, event string, productID int, payload []byte) (int64, error) {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("INSERT INTO WebhookDeliveries (subscription_id, event, product_id, payload, status, attempts, response_status, last_error, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, 0, 0, '', ?, ?, ?)",
+		subscriptionID, event, productID, string(payload), DeliveryPending, currentTime, currentTime, currentTime)
+	if err != nil {
+		logrus.Errorf("Error inserting webhook delivery: %v", err)
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next attempt is due
+func DueWebhookDeliveries(db *sql.DB, now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`SELECT d.id, d.subscription_id, s.url, s.secret, d.event, d.product_id, d.payload, d.attempts, d.next_attempt_at
+		FROM WebhookDeliveries d JOIN WebhookSubscriptions s ON s.id = d.subscription_id
+		WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.next_attempt_at, d.id LIMIT ?`,
+		DeliveryPending, now.Format("2006-01-02 15:04:05"), limit)
+	if err != nil {
+		logrus.Errorf("Error querying due webhook deliveries: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload, nextAttempt string
+		if err := rows.Scan(&d.ID, &d.Subscription.ID, &d.Subscription.URL, &d.Subscription.Secret, &d.Event, &d.ProductID, &payload, &d.Attempts, &nextAttempt); err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		if d.NextAttemptAt, err = parseTime(nextAttempt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ClaimWebhookDelivery reserves a due delivery until lease, so that other consumers
+// do not send it at the same time. It returns false if another consumer claimed it.
+func ClaimWebhookDelivery(db *sql.DB, d WebhookDelivery, lease time.Time) (bool, error) {
+	res, err := db.Exec("UPDATE WebhookDeliveries SET next_attempt_at = ? WHERE id = ? AND status = ? AND attempts = ? AND next_attempt_at = ?",
+		lease.Format("2006-01-02 15:04:05"), d.ID, DeliveryPending, d.Attempts, d.NextAttemptAt.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("Error claiming webhook delivery %d: %v", d.ID, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// RecordWebhookAttempt logs an attempt of a delivery and moves the delivery to status,
+// to be tried again at nextAttempt while it is pending
+func RecordWebhookAttempt(db *sql.DB, deliveryID int64, attempt WebhookAttempt, status string, nextAttempt time.Time) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("INSERT INTO WebhookAttempts (delivery_id, response_status, error, duration_ms, attempted_at) VALUES (?, ?, ?, ?, ?)",
+		deliveryID, attempt.ResponseStatus, attempt.Error, attempt.Duration.Milliseconds(), currentTime)
+	if err != nil {
+		logrus.Errorf("Error logging webhook attempt of delivery %d: %v", deliveryID, err)
+		return err
+	}
+	_, err = db.Exec("UPDATE WebhookDeliveries SET status = ?, attempts = attempts + 1, response_status = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		status, attempt.ResponseStatus, attempt.Error, nextAttempt.Format("2006-01-02 15:04:05"), currentTime, deliveryID)
+	if err != nil {
+		logrus.Errorf("Error updating webhook delivery %d: %v", deliveryID, err)
+	}
+	return err
+}
+
+// parseTime reads a DATETIME column, which drivers return in different layouts
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
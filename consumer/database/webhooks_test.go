@@ -0,0 +1,116 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func newWebhooksDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (product_id INTEGER PRIMARY KEY, user_id INTEGER, processing_status TEXT, compressed_product_images TEXT);
+		CREATE TABLE WebhookSubscriptions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NULL, url TEXT, secret TEXT, events TEXT, active BOOLEAN DEFAULT TRUE, created_at DATETIME);
+		CREATE TABLE WebhookDeliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, subscription_id INTEGER, event TEXT, product_id INTEGER, payload TEXT, status TEXT, attempts INTEGER DEFAULT 0, response_status INTEGER DEFAULT 0, last_error TEXT, next_attempt_at DATETIME, created_at DATETIME, updated_at DATETIME);
+		CREATE TABLE WebhookAttempts (id INTEGER PRIMARY KEY AUTOINCREMENT, delivery_id INTEGER, response_status INTEGER, error TEXT, duration_ms INTEGER, attempted_at DATETIME);
+		INSERT INTO Products VALUES (1, 7, 'completed', 'a.jpg,b.jpg');
+		INSERT INTO WebhookSubscriptions (user_id, url, secret, events, active) VALUES
+			(NULL, 'http://all', 's1', 'product.images.completed,product.images.failed', 1),
+			(7, 'http://user7', 's2', 'product.images.completed', 1),
+			(8, 'http://user8', 's3', 'product.images.completed', 1),
+			(7, 'http://inactive', 's4', 'product.images.completed', 0),
+			(7, 'http://failed-only', 's5', 'product.images.failed', 1);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func TestGetProductEvent(t *testing.T) {
+	testDB := newWebhooksDB(t)
+
+	event, err := GetProductEvent(testDB, 1)
+	if err != nil {
+		t.Fatalf("Error getting product event: %v", err)
+	}
+	if event.UserID != 7 || event.ProcessingStatus != "completed" || len(event.CompressedImages) != 2 {
+		t.Errorf("Unexpected product event: %+v", event)
+	}
+	if _, err := GetProductEvent(testDB, 2); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing product, got %v", err)
+	}
+}
+
+func TestFindWebhookSubscriptions(t *testing.T) {
+	testDB := newWebhooksDB(t)
+
+	subs, err := FindWebhookSubscriptions(testDB, 7, "product.images.completed")
+	if err != nil {
+		t.Fatalf("Error finding subscriptions: %v", err)
+	}
+	if len(subs) != 2 || subs[0].URL != "http://all" || subs[1].URL != "http://user7" {
+		t.Errorf("Expected the global and user 7 subscriptions, got %+v", subs)
+	}
+	subs, _ = FindWebhookSubscriptions(testDB, 7, "product.images.failed")
+	if len(subs) != 2 || subs[1].URL != "http://failed-only" {
+		t.Errorf("Expected the failed subscriptions, got %+v", subs)
+	}
+}
+
+func TestWebhookDeliveryLifecycle(t *testing.T) {
+	testDB := newWebhooksDB(t)
+
+	id, err := InsertWebhookDelivery(testDB, 2, "product.images.completed", 1, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("Error inserting delivery: %v", err)
+	}
+	due, err := DueWebhookDeliveries(testDB, time.Now().Add(time.Second), 10)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("Expected 1 due delivery, got %v, %v", due, err)
+	}
+	d := due[0]
+	if d.ID != id || d.Subscription.URL != "http://user7" || d.Subscription.Secret != "s2" || string(d.Payload) != `{"a":1}` {
+		t.Errorf("Unexpected delivery: %+v", d)
+	}
+
+	claimed, err := ClaimWebhookDelivery(testDB, d, time.Now().Add(time.Minute))
+	if err != nil || !claimed {
+		t.Fatalf("Expected to claim the delivery, got %v, %v", claimed, err)
+	}
+	if claimed, _ := ClaimWebhookDelivery(testDB, d, time.Now().Add(time.Minute)); claimed {
+		t.Error("Expected a claimed delivery not to be claimed twice")
+	}
+	if due, _ := DueWebhookDeliveries(testDB, time.Now().Add(time.Second), 10); len(due) != 0 {
+		t.Errorf("Expected a claimed delivery not to be due, got %d", len(due))
+	}
+
+	attempt := WebhookAttempt{ResponseStatus: 500, Error: "status 500", Duration: 20 * time.Millisecond}
+	if err := RecordWebhookAttempt(testDB, id, attempt, DeliveryPending, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Error recording attempt: %v", err)
+	}
+	due, _ = DueWebhookDeliveries(testDB, time.Now().Add(time.Second), 10)
+	if len(due) != 1 || due[0].Attempts != 1 {
+		t.Fatalf("Expected the delivery to be due again after 1 attempt, got %+v", due)
+	}
+
+	if err := RecordWebhookAttempt(testDB, id, WebhookAttempt{ResponseStatus: 200}, DeliveryDelivered, time.Now()); err != nil {
+		t.Fatalf("Error recording attempt: %v", err)
+	}
+	var status string
+	var attempts, logged int
+	testDB.QueryRow("SELECT status, attempts FROM WebhookDeliveries WHERE id = ?", id).Scan(&status, &attempts)
+	testDB.QueryRow("SELECT COUNT(*) FROM WebhookAttempts WHERE delivery_id = ?", id).Scan(&logged)
+	if status != DeliveryDelivered || attempts != 2 || logged != 2 {
+		t.Errorf("Expected a delivered delivery with 2 logged attempts, got %s, %d, %d", status, attempts, logged)
+	}
+	if due, _ := DueWebhookDeliveries(testDB, time.Now().Add(time.Hour), 10); len(due) != 0 {
+		t.Errorf("Expected a delivered delivery not to be due, got %d", len(due))
+	}
+}
@@ -0,0 +1,144 @@
+package imageserver
+
+import (
+	"bytes"
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// DiskCache keeps derived images on disk, evicting the least recently used ones
+// once the total size goes over a cap. It is safe for concurrent use.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// NewDiskCache creates a cache in dir holding at most maxBytes, picking up files
+// left by a previous run in order of modification time
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if _, err := storage.CleanupTempFiles(dir, 15*time.Minute); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := []os.FileInfo{}
+	for _, f := range files {
+		if f.IsDir() || f.Name()[0] == '.' {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, info := range infos {
+		c.add(info.Name(), info.Size())
+	}
+	c.evict()
+	logrus.Infof("Derived image cache in %s holds %d files (%d bytes)", dir, len(c.entries), c.size)
+	return c, nil
+}
+
+// Get returns the cached data for name
+func (c *DiskCache) Get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[name]
+	if ok {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		logrus.Warnf("Dropping unreadable cache entry %s: %v", name, err)
+		c.mu.Lock()
+		c.remove(name)
+		c.mu.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores data under name and evicts old entries to stay under the cap
+func (c *DiskCache) Put(name string, data []byte) error {
+	if int64(len(data)) > c.maxBytes {
+		return nil
+	}
+	if err := storage.WriteFileAtomic(filepath.Join(c.dir, name), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(name)
+	c.add(name, int64(len(data)))
+	c.evict()
+	return nil
+}
+
+// Size returns the total size of the cached files
+func (c *DiskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *DiskCache) add(name string, size int64) {
+	c.entries[name] = c.order.PushFront(&cacheEntry{name: name, size: size})
+	c.size += size
+}
+
+// remove forgets name without deleting its file
+func (c *DiskCache) remove(name string) {
+	if el, ok := c.entries[name]; ok {
+		c.size -= el.Value.(*cacheEntry).size
+		c.order.Remove(el)
+		delete(c.entries, name)
+	}
+}
+
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.order.Len() > 0 {
+		entry := c.order.Back().Value.(*cacheEntry)
+		c.remove(entry.name)
+		if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to evict cache entry %s: %v", entry.name, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package imageserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// ImagesPrefix is the path stored renditions are served under, e.g. /images/12/<hash>_w1024.jpg
+const ImagesPrefix = "/images/"
+
+// Options configures the on-demand transform endpoint of a Server
+type Options struct {
+	SigningSecret []byte                    // HMAC key for transform URLs, the endpoint is disabled when empty
+	Cache         *DiskCache                // cache of rendered transforms, nil disables caching
+	Limits        imageutils.DownloadLimits // bounds the stored images that are decoded, default imageutils.DefaultDownloadLimits
+	MaxDimension  int                       // largest width or height that can be requested, default 4096
+}
+
+// Server serves stored renditions from a storage backend
+type Server struct {
+	store  storage.Storage
+	opts   Options
+	flight flightGroup
+}
+
+// New creates a Server reading from store
+func New(store storage.Storage, opts Options) *Server {
+	if opts.Limits.MaxBytes == 0 {
+		opts.Limits.MaxBytes = imageutils.DefaultDownloadLimits.MaxBytes
+	}
+	if opts.Limits.MaxMegapixels == 0 {
+		opts.Limits.MaxMegapixels = imageutils.DefaultDownloadLimits.MaxMegapixels
+	}
+	if opts.MaxDimension == 0 {
+		opts.MaxDimension = 4096
+	}
+	return &Server{store: store, opts: opts}
+}
+
+// Handler returns the HTTP routes of the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ImagesPrefix, s.serveImage)
+	mux.HandleFunc(TransformPrefix, s.serveTransform)
+	return mux
+}
+
+// renditionKey matches the keys of compressed outputs, <product_id>/<content hash>_<rendition>.<ext>.
+// Archived originals and uploads live under other prefixes and are never served.
+var renditionKey = regexp.MustCompile(`^[0-9]+/[0-9a-f]{32}_[a-z0-9-]+\.(jpg|png|gif|webp)$`)
+
+// serveImage serves a stored rendition with a strong ETag, immutable caching,
+// conditional requests and byte ranges. The object is only read when its body is sent.
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := storage.CleanKey(strings.TrimPrefix(r.URL.Path, ImagesPrefix))
+	if err != nil || !renditionKey.MatchString(key) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	info, err := s.store.Stat(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logrus.Errorf("Error reading %s from storage: %v", key, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", ObjectETag(info))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent handles If-None-Match, If-Range, Range and HEAD, and answers
+	// revalidations before anything is read from the object
+	object := &objectReader{ctx: r.Context(), store: s.store, key: key, size: info.Size}
+	defer object.Close()
+	http.ServeContent(w, r, path.Base(key), info.ModTime, object)
+}
+
+// ObjectETag returns a strong entity tag for a stored object without reading it.
+// Keys are content hashes, and the backend's ETag, or the size and modification
+// time of a local file, change whenever the object is rewritten.
+func ObjectETag(info *storage.ObjectInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d", info.Key, info.ETag, info.Size, info.ModTime.UnixNano())))
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
+}
+
+// objectReader is an io.ReadSeeker over a stored object of a known size. It only
+// opens the object on the first read, and seeks in backends that cannot by
+// skipping ahead, so byte ranges are served without buffering the object.
+type objectReader struct {
+	ctx    context.Context
+	store  storage.Storage
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, _, err := o.store.Get(o.ctx, o.key)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+		if seeker, ok := body.(io.Seeker); ok {
+			_, err = seeker.Seek(o.offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, body, o.offset)
+		}
+		if err != nil {
+			o.Close()
+			return 0, err
+		}
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("imageserver: negative position")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *objectReader) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// ETag returns a strong entity tag for data
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
+}
@@ -0,0 +1,161 @@
+package imageserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKey is a rendition key as written by the consumer
+const testKey = "12/0123456789abcdef0123456789abcdef_w1024.jpg"
+
+func newTestServer(t *testing.T) (*httptest.Server, []byte) {
+	server, _, data := newStreamingServer(t)
+	return server, data
+}
+
+// streamingStore counts the objects opened, and hides that local files can seek
+// to stand in for backends streaming over the network
+type streamingStore struct {
+	storage.Storage
+	gets int
+}
+
+func (c *streamingStore) Get(ctx context.Context, key string) (io.ReadCloser, *storage.ObjectInfo, error) {
+	c.gets++
+	body, info, err := c.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(body), info, nil
+}
+
+func newStreamingServer(t *testing.T) (*httptest.Server, *streamingStore, []byte) {
+	local, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	store := &streamingStore{Storage: local}
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	for _, key := range []string{testKey, "12/originals/0123456789abcdef0123456789abcdef.jpg", "uploads/partial/abc/0"} {
+		assert.NoError(t, store.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), "image/jpeg"))
+	}
+	server := httptest.NewServer(New(store, Options{}).Handler())
+	t.Cleanup(server.Close)
+	return server, store, data
+}
+
+func objectETag(t *testing.T, server *httptest.Server) string {
+	resp := get(t, server.URL+ImagesPrefix+testKey, map[string]string{"Range": "bytes=0-0"})
+	return resp.Header.Get("ETag")
+}
+
+func get(t *testing.T, url string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestServeImage(t *testing.T) {
+	server, data := newTestServer(t)
+	url := server.URL + ImagesPrefix + testKey
+
+	resp := get(t, url, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=31536000, immutable", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotContains(t, etag, "W/", "ETag should be strong")
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, data, body)
+
+	// A matching If-None-Match gets a 304 without a body
+	resp = get(t, url, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Empty(t, body)
+
+	// Byte ranges are honoured
+	resp = get(t, url, map[string]string{"Range": "bytes=10-19"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 10-19/1000", resp.Header.Get("Content-Range"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, data[10:20], body)
+
+	// A stale If-Range validator falls back to the full object
+	resp = get(t, url, map[string]string{"Range": "bytes=10-19", "If-Range": `"stale"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = get(t, url, map[string]string{"Range": "bytes=5000-6000"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+}
+
+func TestServeImageErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp := get(t, server.URL+"/images/12/missing.jpg", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = get(t, server.URL+"/images/12/%2e%2e/%2e%2e/etc/passwd", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err := http.Post(server.URL+ImagesPrefix+testKey, "image/jpeg", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Head(server.URL + ImagesPrefix + testKey)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1000", resp.Header.Get("Content-Length"))
+}
+
+func TestServeImageOnlyServesRenditions(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	// Archived originals and upload chunks are in the same store but are not renditions
+	resp := get(t, server.URL+"/images/12/originals/0123456789abcdef0123456789abcdef.jpg", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = get(t, server.URL+"/images/uploads/partial/abc/0", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServeImageReadsOnlyWhatIsSent(t *testing.T) {
+	server, store, data := newStreamingServer(t)
+	url := server.URL + ImagesPrefix + testKey
+	etag := objectETag(t, server)
+	store.gets = 0
+
+	// Revalidations are answered from the object's metadata
+	resp := get(t, url, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	resp, err := http.Head(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 0, store.gets)
+
+	// Ranges are served from a backend that cannot seek
+	resp = get(t, url, map[string]string{"Range": "bytes=990-"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, data[990:], body)
+	assert.Equal(t, 1, store.gets)
+
+	// The ETag changes when the object is rewritten
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, store.Put(context.Background(), testKey, bytes.NewReader(data[:500]), 500, "image/jpeg"))
+	assert.NotEqual(t, etag, objectETag(t, server))
+}
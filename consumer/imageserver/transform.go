@@ -0,0 +1,205 @@
+package imageserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// TransformPrefix is the path on-demand renditions are served under, e.g. /img/12/<hash>_w1024.jpg?w=300&sig=...
+const TransformPrefix = "/img/"
+
+// transformParams are the query parameters covered by the signature, in canonical order
+var transformParams = []string{"fit", "fmt", "h", "q", "w"}
+
+// errBadParams is returned for transform parameters that are missing or out of range
+var errBadParams = errors.New("invalid transform parameters")
+
+// canonicalTransform is the string signed for a transform of key
+func canonicalTransform(key string, params url.Values) string {
+	parts := []string{}
+	for _, name := range transformParams {
+		if v := params.Get(name); v != "" {
+			parts = append(parts, name+"="+url.QueryEscape(v))
+		}
+	}
+	return key + "?" + strings.Join(parts, "&")
+}
+
+// Sign returns the signature for transforming key with params
+func Sign(secret []byte, key string, params url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalTransform(key, params)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURL returns the path and query of a signed transform URL for key
+func SignedURL(secret []byte, key string, params url.Values) string {
+	q := url.Values{}
+	for _, name := range transformParams {
+		if v := params.Get(name); v != "" {
+			q.Set(name, v)
+		}
+	}
+	q.Set("sig", Sign(secret, key, params))
+	return TransformPrefix + key + "?" + q.Encode()
+}
+
+// transformRequest is a validated set of transform parameters
+type transformRequest struct {
+	imageutils.TransformOptions
+	Quality int
+	Format  string
+}
+
+func (s *Server) parseTransform(params url.Values) (*transformRequest, error) {
+	req := &transformRequest{Quality: 75, Format: "jpeg"}
+	req.Fit = imageutils.FitContain
+	for _, p := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"w", &req.Width, s.opts.MaxDimension},
+		{"h", &req.Height, s.opts.MaxDimension},
+		{"q", &req.Quality, 100},
+	} {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > p.max {
+			return nil, fmt.Errorf("%w: %s must be between 1 and %d", errBadParams, p.name, p.max)
+		}
+		*p.dst = n
+	}
+	if req.Width == 0 && req.Height == 0 {
+		return nil, fmt.Errorf("%w: w or h is required", errBadParams)
+	}
+	if fit := params.Get("fit"); fit != "" {
+		if fit != imageutils.FitContain && fit != imageutils.FitCover && fit != imageutils.FitFill {
+			return nil, fmt.Errorf("%w: unknown fit %q", errBadParams, fit)
+		}
+		req.Fit = fit
+	}
+	if format := params.Get("fmt"); format != "" {
+		if format != "jpeg" && format != "png" {
+			return nil, fmt.Errorf("%w: unknown fmt %q", errBadParams, format)
+		}
+		req.Format = format
+	}
+	return req, nil
+}
+
+// serveTransform resizes a stored image on demand. Requests must be signed,
+// results are cached on disk and concurrent requests for the same rendition are coalesced.
+func (s *Server) serveTransform(w http.ResponseWriter, r *http.Request) {
+	if len(s.opts.SigningSecret) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := storage.CleanKey(strings.TrimPrefix(r.URL.Path, TransformPrefix))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	params := r.URL.Query()
+	expected := Sign(s.opts.SigningSecret, key, params)
+	if !hmac.Equal([]byte(expected), []byte(params.Get("sig"))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	tr, err := s.parseTransform(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sum := sha256.Sum256([]byte(canonicalTransform(key, params)))
+	cacheName := hex.EncodeToString(sum[:16]) + "." + tr.Format
+	contentType := "image/" + tr.Format
+
+	data, ok := s.cachedTransform(cacheName)
+	if !ok {
+		data, err = s.flight.Do(cacheName, func() ([]byte, error) {
+			// Not tied to this request, as other requests may be waiting on the result
+			return s.renderTransform(context.Background(), key, tr, cacheName)
+		})
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			logrus.Errorf("Error transforming %s: %v", key, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", ETag(data))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func (s *Server) cachedTransform(name string) ([]byte, bool) {
+	if s.opts.Cache == nil {
+		return nil, false
+	}
+	return s.opts.Cache.Get(name)
+}
+
+// renderTransform loads key from storage, transforms it and stores the result in the cache
+func (s *Server) renderTransform(ctx context.Context, key string, tr *transformRequest, cacheName string) ([]byte, error) {
+	body, _, err := s.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	limits := s.opts.Limits
+	src, err := io.ReadAll(io.LimitReader(body, limits.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(src)) > limits.MaxBytes {
+		return nil, imageutils.ErrImageTooLarge
+	}
+	img, err := imageutils.DecodeWithLimits(src, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := imageutils.EncodeImage(imageutils.Transform(img, tr.TransformOptions), tr.Format, tr.Quality)
+	if err != nil {
+		return nil, err
+	}
+	if s.opts.Cache != nil {
+		if err := s.opts.Cache.Put(cacheName, data); err != nil {
+			logrus.Warnf("Failed to cache transform of %s: %v", key, err)
+		}
+	}
+	logrus.Infof("Rendered %s %dx%d %s as %s (%d bytes)", key, tr.Width, tr.Height, tr.Fit, tr.Format, len(data))
+	return data, nil
+}
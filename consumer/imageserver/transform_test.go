@@ -0,0 +1,193 @@
+package imageserver
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte("test-secret")
+
+// countingStore counts Get calls and delays them so concurrent requests overlap
+type countingStore struct {
+	storage.Storage
+	gets  int32
+	delay time.Duration
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (io.ReadCloser, *storage.ObjectInfo, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(s.delay)
+	return s.Storage.Get(ctx, key)
+}
+
+func newTransformServer(t *testing.T, delay time.Duration) (*httptest.Server, *countingStore, *DiskCache) {
+	local, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, nil))
+	assert.NoError(t, local.Put(context.Background(), "12/abc_w1024.jpg", &buf, int64(buf.Len()), "image/jpeg"))
+
+	cache, err := NewDiskCache(t.TempDir(), 1<<20)
+	assert.NoError(t, err)
+	store := &countingStore{Storage: local, delay: delay}
+	server := httptest.NewServer(New(store, Options{SigningSecret: testSecret, Cache: cache}).Handler())
+	t.Cleanup(server.Close)
+	return server, store, cache
+}
+
+func decodeBody(t *testing.T, resp *http.Response) image.Image {
+	img, _, err := image.Decode(resp.Body)
+	assert.NoError(t, err)
+	return img
+}
+
+func TestServeTransform(t *testing.T) {
+	server, store, cache := newTransformServer(t, 0)
+	key := "12/abc_w1024.jpg"
+
+	tests := []struct {
+		name   string
+		params url.Values
+		width  int
+		height int
+	}{
+		{"width only", url.Values{"w": {"100"}}, 100, 50},
+		{"contain", url.Values{"w": {"100"}, "h": {"100"}}, 100, 50},
+		{"cover", url.Values{"w": {"100"}, "h": {"100"}, "fit": {"cover"}}, 100, 100},
+		{"fill", url.Values{"w": {"100"}, "h": {"100"}, "fit": {"fill"}}, 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, server.URL+SignedURL(testSecret, key, tt.params), nil)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+			img := decodeBody(t, resp)
+			assert.Equal(t, tt.width, img.Bounds().Dx())
+			assert.Equal(t, tt.height, img.Bounds().Dy())
+		})
+	}
+
+	// PNG output
+	resp := get(t, server.URL+SignedURL(testSecret, key, url.Values{"w": {"40"}, "fmt": {"png"}}), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	// A repeated request is served from the cache without reading storage
+	gets := atomic.LoadInt32(&store.gets)
+	resp = get(t, server.URL+SignedURL(testSecret, key, url.Values{"w": {"100"}}), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, gets, atomic.LoadInt32(&store.gets))
+	assert.True(t, cache.Size() > 0)
+}
+
+func TestServeTransformErrors(t *testing.T) {
+	server, _, _ := newTransformServer(t, 0)
+	key := "12/abc_w1024.jpg"
+	signed := func(params url.Values) string { return server.URL + SignedURL(testSecret, key, params) }
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+	}{
+		{"missing signature", server.URL + TransformPrefix + key + "?w=100", http.StatusForbidden},
+		{"wrong secret", server.URL + SignedURL([]byte("other"), key, url.Values{"w": {"100"}}), http.StatusForbidden},
+		{"tampered params", signed(url.Values{"w": {"100"}}) + "&h=4000", http.StatusForbidden},
+		{"no size", signed(url.Values{"q": {"50"}}), http.StatusBadRequest},
+		{"too wide", signed(url.Values{"w": {"5000"}}), http.StatusBadRequest},
+		{"bad fit", signed(url.Values{"w": {"100"}, "fit": {"zoom"}}), http.StatusBadRequest},
+		{"bad format", signed(url.Values{"w": {"100"}, "fmt": {"gif"}}), http.StatusBadRequest},
+		{"missing object", server.URL + SignedURL(testSecret, "12/missing.jpg", url.Values{"w": {"100"}}), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, tt.url, nil)
+			assert.Equal(t, tt.status, resp.StatusCode)
+		})
+	}
+
+	// The endpoint is disabled without a signing secret
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	disabled := httptest.NewServer(New(store, Options{}).Handler())
+	defer disabled.Close()
+	resp := get(t, disabled.URL+SignedURL(testSecret, key, url.Values{"w": {"100"}}), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServeTransformCoalesces(t *testing.T) {
+	server, store, _ := newTransformServer(t, 200*time.Millisecond)
+	target := server.URL + SignedURL(testSecret, "12/abc_w1024.jpg", url.Values{"w": {"120"}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(target)
+			if assert.NoError(t, err) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.gets))
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskCache(dir, 100)
+	assert.NoError(t, err)
+
+	chunk := bytes.Repeat([]byte("x"), 40)
+	assert.NoError(t, cache.Put("a", chunk))
+	assert.NoError(t, cache.Put("b", chunk))
+	// Touch a so that b is the least recently used
+	_, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.NoError(t, cache.Put("c", chunk))
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+	data, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, chunk, data)
+	assert.Equal(t, int64(80), cache.Size())
+
+	// Entries larger than the cap are not cached
+	assert.NoError(t, cache.Put("big", bytes.Repeat([]byte("x"), 200)))
+	_, ok = cache.Get("big")
+	assert.False(t, ok)
+
+	// A new cache picks up the files on disk
+	reopened, err := NewDiskCache(dir, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(80), reopened.Size())
+	_, ok = reopened.Get("c")
+	assert.True(t, ok)
+}
@@ -0,0 +1,122 @@
+package imageutils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrChecksumMismatch is returned by LoadOriginal when the archived bytes no longer match their checksum
+var ErrChecksumMismatch = errors.New("archived original does not match its checksum")
+
+// originalsDir is the folder under a product's prefix that holds archived originals
+const originalsDir = "originals"
+
+// contentTypeExtensions maps source content types to the extension of their archived file
+var contentTypeExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// ArchivedOriginal describes the raw bytes of a source image kept in storage
+type ArchivedOriginal struct {
+	Key         string
+	ContentType string
+	Checksum    string // hex SHA-256 of the whole file
+	Size        int
+}
+
+// Checksum returns the hex SHA-256 digest of data
+func Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// OriginalKey returns the storage key of the archived original with the given content hash
+func OriginalKey(productID, contentHash, contentType string) string {
+	ext, ok := contentTypeExtensions[contentType]
+	if !ok {
+		ext = ".bin"
+	}
+	return productID + "/" + originalsDir + "/" + contentHash + ext
+}
+
+// normalizeContentType strips parameters from a Content-Type header, sniffing data when it is missing
+func normalizeContentType(contentType string, data []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediaType
+}
+
+// ArchiveOriginal stores the downloaded bytes of a source image under the product's
+// originals folder. Originals are named by content hash, so an object already stored
+// with the same size is left as it is.
+func ArchiveOriginal(ctx context.Context, store storage.Storage, productID string, data []byte, contentType string) (ArchivedOriginal, error) {
+	contentType = normalizeContentType(contentType, data)
+	orig := ArchivedOriginal{
+		Key:         OriginalKey(productID, ContentHash(data), contentType),
+		ContentType: contentType,
+		Checksum:    Checksum(data),
+		Size:        len(data),
+	}
+	if info, err := store.Stat(ctx, orig.Key); err == nil && info.Size == int64(len(data)) {
+		return orig, nil
+	}
+	if err := store.Put(ctx, orig.Key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		return ArchivedOriginal{}, err
+	}
+	logrus.Infof("Archived original to %s storage as %s", store.Name(), orig.Key)
+	return orig, nil
+}
+
+// DefaultMaxUploadBytes is the size limit of uploaded images used when
+// UPLOAD_MAX_BYTES is not set
+const DefaultMaxUploadBytes = 200 << 20
+
+// MaxUploadBytesFromEnv returns the size limit of uploaded images set with
+// UPLOAD_MAX_BYTES. The producer accepts uploads up to it and the consumer reads them
+// back from storage up to it, so an accepted upload is never too large to process.
+func MaxUploadBytesFromEnv() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_BYTES"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return DefaultMaxUploadBytes
+}
+
+// LoadOriginal reads an archived original back from storage and verifies its checksum
+func LoadOriginal(ctx context.Context, store storage.Storage, orig ArchivedOriginal, limits DownloadLimits) ([]byte, error) {
+	body, _, err := store.Get(ctx, orig.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = DefaultDownloadLimits.MaxBytes
+	}
+	data, err := io.ReadAll(io.LimitReader(body, limits.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, ErrImageTooLarge
+	}
+	if orig.Checksum != "" && Checksum(data) != orig.Checksum {
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, orig.Key)
+	}
+	return data, nil
+}
@@ -0,0 +1,165 @@
+package imageutils
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveOriginal(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, generateImage(), nil))
+	data := buf.Bytes()
+
+	orig, err := ArchiveOriginal(ctx, store, "7", data, "image/jpeg; charset=binary")
+	assert.NoError(t, err)
+	assert.Equal(t, "7/originals/"+ContentHash(data)+".jpg", orig.Key)
+	assert.Equal(t, "image/jpeg", orig.ContentType)
+	assert.Equal(t, Checksum(data), orig.Checksum)
+	assert.Equal(t, len(data), orig.Size)
+
+	// A missing content type is sniffed from the data
+	sniffed, err := ArchiveOriginal(ctx, store, "7", data, "")
+	assert.NoError(t, err)
+	assert.Equal(t, orig, sniffed)
+
+	loaded, err := LoadOriginal(ctx, store, orig, DownloadLimits{})
+	assert.NoError(t, err)
+	assert.Equal(t, data, loaded)
+
+	_, err = LoadOriginal(ctx, store, orig, DownloadLimits{MaxBytes: 10})
+	assert.ErrorIs(t, err, ErrImageTooLarge)
+
+	corrupt := []byte("not the original")
+	assert.NoError(t, store.Put(ctx, orig.Key, bytes.NewReader(corrupt), int64(len(corrupt)), orig.ContentType))
+	_, err = LoadOriginal(ctx, store, orig, DownloadLimits{})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestDownloadResizeCompressSaveImagesArchive(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, generateImage(), nil))
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	url := server.URL + "/image.jpg"
+	cfg := Config{Fetcher: NewFetcher(FetcherConfig{Policy: testPolicy}), Storage: store, ArchiveOriginals: true}
+	err, images := DownloadResizeCompressSaveImages([]string{url}, cfg, "5")
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	orig, ok := images[0].Original()
+	assert.True(t, ok)
+	assert.Equal(t, OriginalKey("5", images[0].ContentHash, "image/jpeg"), orig.Key)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Reprocessing with the archived original does not download the URL again
+	cfg.Originals = map[string]ArchivedOriginal{url: orig}
+	err, again := DownloadResizeCompressSaveImages([]string{url}, cfg, "5")
+	assert.NoError(t, err)
+	assert.Len(t, again, 1)
+	assert.Equal(t, images[0].Key, again[0].Key)
+	assert.Equal(t, orig.Key, again[0].OriginalKey)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// A missing archive falls back to downloading
+	assert.NoError(t, store.Delete(context.Background(), orig.Key))
+	err, fallback := DownloadResizeCompressSaveImages([]string{url}, cfg, "5")
+	assert.NoError(t, err)
+	assert.Len(t, fallback, 1)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	_, err = store.Stat(context.Background(), orig.Key)
+	assert.NoError(t, err, "The original is archived again")
+
+	// Without archiving nothing is recorded
+	cfg = Config{Fetcher: NewFetcher(FetcherConfig{Policy: testPolicy}), Storage: store}
+	err, plain := DownloadResizeCompressSaveImages([]string{url}, cfg, "6")
+	assert.NoError(t, err)
+	_, ok = plain[0].Original()
+	assert.False(t, ok)
+}
+
+func TestDownloadResizeCompressSaveImagesUploaded(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, generateImage(), nil))
+	data := buf.Bytes()
+	assert.NoError(t, store.Put(context.Background(), "uploads/8/abc.jpg", bytes.NewReader(data), int64(len(data)), "image/jpeg"))
+
+	// Images uploaded to the producer are read from storage and kept as their own original
+	cfg := Config{Fetcher: NewFetcher(FetcherConfig{Policy: testPolicy}), Storage: store, ArchiveOriginals: true}
+	err, images := DownloadResizeCompressSaveImages([]string{"local:uploads/8/abc.jpg"}, cfg, "8")
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+	orig, ok := images[0].Original()
+	assert.True(t, ok)
+	assert.Equal(t, ArchivedOriginal{Key: "uploads/8/abc.jpg", ContentType: "image/jpeg", Checksum: Checksum(data), Size: len(data)}, orig)
+
+	// Every type the producer accepts can be decoded
+	buf.Reset()
+	assert.NoError(t, gif.Encode(&buf, generateImage(), nil))
+	assert.NoError(t, store.Put(context.Background(), "uploads/8/abc.gif", bytes.NewReader(buf.Bytes()), int64(buf.Len()), "image/gif"))
+	err, images = DownloadResizeCompressSaveImages([]string{"local:uploads/8/abc.gif"}, cfg, "8")
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+
+	// References to another backend are not read from this one
+	err, images = DownloadResizeCompressSaveImages([]string{"s3:uploads/8/abc.jpg"}, cfg, "8")
+	assert.NoError(t, err)
+	assert.Len(t, images, 0)
+
+	// Nor are uploads of another product or keys outside the uploads
+	for _, source := range []string{"local:uploads/8/abc.jpg", "local:uploads/9/../8/abc.jpg", "local:8/originals/abc.jpg"} {
+		err, images = DownloadResizeCompressSaveImages([]string{source}, cfg, "9")
+		assert.NoError(t, err)
+		assert.Len(t, images, 0, source)
+	}
+}
+
+func TestDownloadResizeCompressSaveImagesLargeUpload(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	// Noise does not compress, so the PNG is larger than the default download limit
+	img := image.NewNRGBA(image.Rect(0, 0, 2600, 2100))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var buf bytes.Buffer
+	assert.NoError(t, (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img))
+	assert.Greater(t, int64(buf.Len()), DefaultDownloadLimits.MaxBytes)
+	assert.NoError(t, store.Put(context.Background(), "uploads/8/big.png", bytes.NewReader(buf.Bytes()), int64(buf.Len()), "image/png"))
+
+	// Uploads are read up to the upload limit rather than the download limit
+	cfg := Config{Fetcher: NewFetcher(FetcherConfig{Policy: testPolicy}), Storage: store}
+	err, images := DownloadResizeCompressSaveImages([]string{"local:uploads/8/big.png"}, cfg, "8")
+	assert.NoError(t, err)
+	assert.Len(t, images, 1)
+
+	// An upload over it fails without falling back to downloading the reference
+	var progressErr error
+	cfg.MaxUploadBytes = int64(buf.Len()) - 1
+	cfg.Progress = func(url string, err error) { progressErr = err }
+	err, images = DownloadResizeCompressSaveImages([]string{"local:uploads/8/big.png"}, cfg, "8")
+	assert.NoError(t, err)
+	assert.Len(t, images, 0)
+	assert.ErrorIs(t, progressErr, ErrImageTooLarge)
+}
@@ -0,0 +1,407 @@
+package imageutils
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrImageTooLarge is returned when a download exceeds DownloadLimits.MaxBytes
+	ErrImageTooLarge = errors.New("image exceeds the maximum download size")
+	// ErrTooManyPixels is returned when an image's dimensions exceed DownloadLimits.MaxMegapixels
+	ErrTooManyPixels = errors.New("image exceeds the maximum number of pixels")
+	// ErrUnexpectedContentType is returned when a response is not one of FetcherConfig.AllowedContentTypes
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+)
+
+// StatusError is returned when a server answers with a status other than 200 or 304
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d fetching %s", e.StatusCode, e.URL)
+}
+
+// DownloadLimits bounds the resources a Fetcher will spend on a single image
+type DownloadLimits struct {
+	MaxBytes      int64         // largest response body accepted
+	MaxMegapixels float64       // largest width*height accepted, in millions of pixels
+	Timeout       time.Duration // deadline for the whole request including the body
+}
+
+// DefaultDownloadLimits are used by DownloadImage
+var DefaultDownloadLimits = DownloadLimits{
+	MaxBytes:      20 << 20,
+	MaxMegapixels: 50,
+	Timeout:       30 * time.Second,
+}
+
+// DefaultUserAgent identifies the consumer to image hosts
+const DefaultUserAgent = "image-crunch/1.0 (+https://github.com/hakrsh/image-crunch)"
+
+// FetcherConfig configures a Fetcher. Zero values are replaced by the defaults noted on each field.
+type FetcherConfig struct {
+	Limits              DownloadLimits    // defaults to DefaultDownloadLimits field by field
+	ConnectTimeout      time.Duration     // time allowed to establish a connection, default 5s
+	ReadTimeout         time.Duration     // time allowed between sending the request and reading the headers, default 15s
+	UserAgent           string            // default DefaultUserAgent
+	MaxRetries          int               // retries after the first attempt for 5xx, 429 and network errors, default 3, negative disables
+	RetryBackoff        time.Duration     // initial backoff, doubled on each retry, default 500ms
+	MaxRetryWait        time.Duration     // longest single wait, including Retry-After, before giving up, default 30s
+	AllowedContentTypes []string          // accepted Content-Type prefixes, default "image/"
+	Cache               *ResponseCache    // validators and bodies for conditional requests, nil disables
+	Policy              *urlpolicy.Policy // which URLs and addresses may be fetched, default urlpolicy.Default
+}
+
+// Fetcher downloads images over HTTP with timeouts, size limits, status and content
+// type validation, retries with backoff and conditional requests
+type Fetcher struct {
+	cfg    FetcherConfig
+	client *http.Client
+	sleep  func(time.Duration)
+}
+
+// NewFetcher creates a Fetcher, filling in defaults for any unset fields of cfg
+func NewFetcher(cfg FetcherConfig) *Fetcher {
+	if cfg.Limits.MaxBytes == 0 {
+		cfg.Limits.MaxBytes = DefaultDownloadLimits.MaxBytes
+	}
+	if cfg.Limits.MaxMegapixels == 0 {
+		cfg.Limits.MaxMegapixels = DefaultDownloadLimits.MaxMegapixels
+	}
+	if cfg.Limits.Timeout == 0 {
+		cfg.Limits.Timeout = DefaultDownloadLimits.Timeout
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = 5 * time.Second
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = 15 * time.Second
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxRetryWait == 0 {
+		cfg.MaxRetryWait = 30 * time.Second
+	}
+	if len(cfg.AllowedContentTypes) == 0 {
+		cfg.AllowedContentTypes = []string{"image/"}
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = urlpolicy.Default
+	}
+
+	// No proxy is used so that the policy sees the address actually being connected to
+	transport := &http.Transport{
+		DialContext:           cfg.Policy.Dialer(cfg.ConnectTimeout).DialContext,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &Fetcher{
+		cfg: cfg,
+		client: &http.Client{
+			Transport:     transport,
+			Timeout:       cfg.Limits.Timeout,
+			CheckRedirect: cfg.Policy.CheckRedirect,
+		},
+		sleep: time.Sleep,
+	}
+}
+
+// Limits returns the download limits the Fetcher enforces
+func (f *Fetcher) Limits() DownloadLimits {
+	return f.cfg.Limits
+}
+
+// FetchResult is the body of a successful fetch
+type FetchResult struct {
+	Data        []byte
+	ContentType string
+	NotModified bool // the body was served from the cache after a 304 response
+}
+
+// FetchImage fetches imageURL and decodes it, checking the image header against
+// the pixel limit before decoding the pixel data
+func (f *Fetcher) FetchImage(imageURL string) (image.Image, error) {
+	res, err := f.Fetch(imageURL)
+	if err != nil {
+		return nil, err
+	}
+	return f.Decode(res.Data)
+}
+
+// Decode decodes fetched image data, checking the image header against the pixel limit first
+func (f *Fetcher) Decode(data []byte) (image.Image, error) {
+	return DecodeWithLimits(data, f.cfg.Limits)
+}
+
+// Fetch downloads imageURL, retrying transient failures
+func (f *Fetcher) Fetch(imageURL string) (*FetchResult, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		res, wait, err := f.fetchOnce(imageURL)
+		if err == nil {
+			return res, nil
+		}
+		lastErr = err
+		if wait < 0 || attempt >= f.cfg.MaxRetries {
+			return nil, lastErr
+		}
+		if wait == 0 {
+			wait = f.backoff(attempt)
+		}
+		if wait > f.cfg.MaxRetryWait {
+			logrus.Warnf("Not retrying %s: server asked to wait %s", imageURL, wait)
+			return nil, lastErr
+		}
+		logrus.Warnf("Fetching %s failed (%v), retrying in %s", imageURL, err, wait)
+		f.sleep(wait)
+	}
+}
+
+// backoff returns the exponential backoff with jitter before retry number attempt+1
+func (f *Fetcher) backoff(attempt int) time.Duration {
+	d := f.cfg.RetryBackoff << uint(attempt)
+	if d <= 0 || d > f.cfg.MaxRetryWait {
+		d = f.cfg.MaxRetryWait
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// fetchOnce performs a single request. On failure it also returns how long to wait
+// before retrying: 0 for the default backoff, a positive duration requested by the
+// server, or a negative value when the error is not worth retrying.
+func (f *Fetcher) fetchOnce(imageURL string) (*FetchResult, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	if err := f.cfg.Policy.CheckURL(req.URL); err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("User-Agent", f.cfg.UserAgent)
+	req.Header.Set("Accept", "image/*")
+
+	var cached *cachedResponse
+	if f.cfg.Cache != nil {
+		cached = f.cfg.Cache.get(imageURL)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if isTransient(err) {
+			return nil, 0, err
+		}
+		return nil, -1, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return &FetchResult{Data: cached.data, ContentType: cached.contentType, NotModified: true}, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		return nil, retryAfter(resp.Header.Get("Retry-After")), &StatusError{URL: imageURL, StatusCode: resp.StatusCode}
+	case resp.StatusCode != http.StatusOK:
+		return nil, -1, &StatusError{URL: imageURL, StatusCode: resp.StatusCode}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !f.allowedContentType(contentType) {
+		return nil, -1, fmt.Errorf("%w: %q", ErrUnexpectedContentType, contentType)
+	}
+
+	limits := f.cfg.Limits
+	if limits.MaxBytes > 0 && resp.ContentLength > limits.MaxBytes {
+		return nil, -1, fmt.Errorf("%w: content length %d > %d", ErrImageTooLarge, resp.ContentLength, limits.MaxBytes)
+	}
+	body := io.Reader(resp.Body)
+	if limits.MaxBytes > 0 {
+		// Read one byte past the limit so an oversized body can be told apart from one exactly at it
+		body = io.LimitReader(resp.Body, limits.MaxBytes+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		if isTransient(err) {
+			return nil, 0, err
+		}
+		return nil, -1, err
+	}
+	if limits.MaxBytes > 0 && int64(len(data)) > limits.MaxBytes {
+		return nil, -1, fmt.Errorf("%w: body larger than %d bytes", ErrImageTooLarge, limits.MaxBytes)
+	}
+
+	if f.cfg.Cache != nil {
+		etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			f.cfg.Cache.put(imageURL, &cachedResponse{
+				etag:         etag,
+				lastModified: lastModified,
+				contentType:  contentType,
+				data:         data,
+			})
+		}
+	}
+	return &FetchResult{Data: data, ContentType: contentType}, 0, nil
+}
+
+func (f *Fetcher) allowedContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range f.cfg.AllowedContentTypes {
+		if strings.HasPrefix(contentType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient reports whether a transport error is worth retrying
+func isTransient(err error) bool {
+	if errors.Is(err, urlpolicy.ErrBlocked) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+// It returns 0 when the header is missing or invalid.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// DecodeWithLimits decodes image data after checking its header against limits.MaxMegapixels
+func DecodeWithLimits(data []byte, limits DownloadLimits) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxMegapixels > 0 {
+		pixels := float64(cfg.Width) * float64(cfg.Height)
+		if pixels > limits.MaxMegapixels*1e6 {
+			return nil, fmt.Errorf("%w: %dx%d > %.1f megapixels", ErrTooManyPixels, cfg.Width, cfg.Height, limits.MaxMegapixels)
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+type cachedResponse struct {
+	url          string
+	etag         string
+	lastModified string
+	contentType  string
+	data         []byte
+}
+
+// ResponseCache keeps the most recently fetched bodies along with their validators
+// so that repeat fetches can be made conditional. It is safe for concurrent use.
+type ResponseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+// NewResponseCache creates a cache holding at most maxBytes of response bodies
+func NewResponseCache(maxBytes int) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *ResponseCache) get(url string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedResponse)
+}
+
+func (c *ResponseCache) put(url string, r *cachedResponse) {
+	if len(r.data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.url = url
+	if el, ok := c.entries[url]; ok {
+		c.size -= len(el.Value.(*cachedResponse).data)
+		c.order.Remove(el)
+	}
+	c.entries[url] = c.order.PushFront(r)
+	c.size += len(r.data)
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		evicted := c.order.Remove(oldest).(*cachedResponse)
+		delete(c.entries, evicted.url)
+		c.size -= len(evicted.data)
+	}
+}
@@ -0,0 +1,224 @@
+package imageutils
+
+import (
+	"bytes"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPolicy allows fetching from httptest servers on the loopback interface
+var testPolicy = &urlpolicy.Policy{
+	AllowedSchemes:  []string{"http"},
+	AllowPrivateIPs: true,
+	MaxRedirects:    2,
+}
+
+// newTestFetcher returns a Fetcher that records its backoff waits instead of sleeping
+func newTestFetcher(cfg FetcherConfig) (*Fetcher, *[]time.Duration) {
+	if cfg.Policy == nil {
+		cfg.Policy = testPolicy
+	}
+	f := NewFetcher(cfg)
+	waits := []time.Duration{}
+	f.sleep = func(d time.Duration) { waits = append(waits, d) }
+	return f, &waits
+}
+
+func TestFetcherStatusAndContentType(t *testing.T) {
+	var jpg bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&jpg, generateImage(), nil))
+
+	var userAgent string
+	var notFoundHits int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok.jpg", func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(jpg.Bytes())
+	})
+	mux.HandleFunc("/missing.jpg", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&notFoundHits, 1)
+		http.Error(w, "<html>not found</html>", http.StatusNotFound)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	f, waits := newTestFetcher(FetcherConfig{UserAgent: "test-agent/1.0"})
+
+	img, err := f.FetchImage(server.URL + "/ok.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, 640, img.Bounds().Dx())
+	assert.Equal(t, "test-agent/1.0", userAgent)
+
+	// A 404 page is not decoded and not retried
+	_, err = f.FetchImage(server.URL + "/missing.jpg")
+	var statusErr *StatusError
+	if assert.ErrorAs(t, err, &statusErr) {
+		assert.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notFoundHits))
+
+	_, err = f.FetchImage(server.URL + "/page.html")
+	assert.ErrorIs(t, err, ErrUnexpectedContentType)
+	assert.Empty(t, *waits)
+}
+
+func TestFetcherRetries(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&hits, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}
+	}))
+	defer server.Close()
+
+	f, waits := newTestFetcher(FetcherConfig{RetryBackoff: 100 * time.Millisecond})
+	res, err := f.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("png"), res.Data)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	if assert.Len(t, *waits, 2) {
+		assert.LessOrEqual(t, (*waits)[0], 100*time.Millisecond, "First retry should use the backoff")
+		assert.Equal(t, 7*time.Second, (*waits)[1], "Second retry should honour Retry-After")
+	}
+}
+
+func TestFetcherGivesUp(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/later" {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	// Retries stop after MaxRetries
+	f, waits := newTestFetcher(FetcherConfig{MaxRetries: 2})
+	_, err := f.Fetch(server.URL + "/down")
+	var statusErr *StatusError
+	if assert.ErrorAs(t, err, &statusErr) {
+		assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	assert.Len(t, *waits, 2)
+
+	// A Retry-After beyond MaxRetryWait is not waited for
+	atomic.StoreInt32(&hits, 0)
+	f, waits = newTestFetcher(FetcherConfig{MaxRetryWait: time.Minute})
+	_, err = f.Fetch(server.URL + "/later")
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+	assert.Empty(t, *waits)
+}
+
+func TestFetcherConditionalRequests(t *testing.T) {
+	var full, conditional int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	f, _ := newTestFetcher(FetcherConfig{Cache: NewResponseCache(1 << 20)})
+	res, err := f.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.False(t, res.NotModified)
+
+	res, err = f.Fetch(server.URL)
+	assert.NoError(t, err)
+	assert.True(t, res.NotModified)
+	assert.Equal(t, []byte("body"), res.Data)
+	assert.Equal(t, "image/jpeg", res.ContentType)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&full))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conditional))
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := NewResponseCache(10)
+	c.put("a", &cachedResponse{etag: "a", data: make([]byte, 4)})
+	c.put("b", &cachedResponse{etag: "b", data: make([]byte, 4)})
+	c.get("a")
+	c.put("c", &cachedResponse{etag: "c", data: make([]byte, 4)})
+
+	assert.NotNil(t, c.get("a"), "Recently used entry should be kept")
+	assert.Nil(t, c.get("b"), "Least recently used entry should be evicted")
+	assert.NotNil(t, c.get("c"))
+
+	c.put("huge", &cachedResponse{data: make([]byte, 11)})
+	assert.Nil(t, c.get("huge"), "Entries larger than the cache should not be stored")
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter("soon"))
+	assert.Equal(t, 120*time.Second, retryAfter("120"))
+	d := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Hour.Seconds(), d.Seconds(), 2)
+}
+
+func TestFetcherURLPolicy(t *testing.T) {
+	var hits int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.jpg", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// The default policy refuses to connect to the loopback test server
+	f, waits := newTestFetcher(FetcherConfig{Policy: urlpolicy.Default})
+	_, err := f.Fetch(server.URL + "/image.jpg")
+	assert.ErrorIs(t, err, urlpolicy.ErrBlocked)
+	assert.Empty(t, *waits, "Blocked requests should not be retried")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hits))
+
+	_, err = f.Fetch("file:///etc/passwd")
+	assert.ErrorIs(t, err, urlpolicy.ErrBlocked)
+
+	// Redirects are checked against the policy and limited
+	f, _ = newTestFetcher(FetcherConfig{})
+	_, err = f.Fetch(server.URL + "/redirect?to=/image.jpg")
+	assert.NoError(t, err)
+	_, err = f.Fetch(server.URL + "/redirect?to=ftp://example.com/image.jpg")
+	assert.ErrorIs(t, err, urlpolicy.ErrBlocked)
+	_, err = f.Fetch(server.URL + "/loop")
+	assert.ErrorIs(t, err, urlpolicy.ErrBlocked)
+}
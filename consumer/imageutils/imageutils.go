@@ -1,30 +1,29 @@
 package imageutils
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"image"
+	_ "image/gif"
 	"image/jpeg"
-	"io"
-	"net/http"
+	_ "image/png"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/golang_backend_assignment/consumer/storage"
 	"github.com/nfnt/resize"
 	"github.com/sirupsen/logrus"
 )
 
 func DownloadImage(imageURL string) (image.Image, error) {
-	resp, err := http.Get(imageURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	img, _, err := image.Decode(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return DownloadImageWithLimits(imageURL, DefaultDownloadLimits)
+}
 
-	return img, nil
+// DownloadImageWithLimits downloads and decodes an image with a default Fetcher bounded by limits
+func DownloadImageWithLimits(imageURL string, limits DownloadLimits) (image.Image, error) {
+	return NewFetcher(FetcherConfig{Limits: limits}).FetchImage(imageURL)
 }
 
 func ResizeImage(img image.Image) (image.Image, error) {
@@ -42,19 +41,134 @@ func CompressImage(img image.Image, quality int) ([]byte, error) {
 	return []byte(buf.String()), nil
 }
 
+// CompressOptions controls how CompressImageAdaptive picks a JPEG quality.
+// When neither TargetBytes nor MinSSIM is set the fixed Quality is used.
+type CompressOptions struct {
+	Quality     int     // quality used when no target is set
+	TargetBytes int     // largest acceptable output size in bytes, 0 to disable
+	MinSSIM     float64 // smallest acceptable SSIM against the input, 0 to disable
+	MinQuality  int     // lower bound of the quality search, defaults to 10
+	MaxQuality  int     // upper bound of the quality search, defaults to 95
+}
+
+// CompressResult is a compressed image along with the quality it was encoded at
+// and its SSIM and PSNR scores against the uncompressed input
+type CompressResult struct {
+	Data    []byte
+	Quality int
+	SSIM    float64
+	PSNR    float64
+}
+
+// encodeAndScore encodes img at the given quality and scores the decoded output against img
+func encodeAndScore(img image.Image, quality int) (*CompressResult, error) {
+	data, err := CompressImage(img, quality)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ssim, err := SSIM(img, decoded)
+	if err != nil {
+		return nil, err
+	}
+	psnr, err := PSNR(img, decoded)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressResult{Data: data, Quality: quality, SSIM: ssim, PSNR: psnr}, nil
+}
+
+// CompressImageAdaptive binary-searches the JPEG quality so that the output meets
+// opts.MinSSIM with the lowest quality possible and stays within opts.TargetBytes.
+// The byte budget wins when both targets cannot be met at once.
+func CompressImageAdaptive(img image.Image, opts CompressOptions) (*CompressResult, error) {
+	if opts.TargetBytes <= 0 && opts.MinSSIM <= 0 {
+		return encodeAndScore(img, opts.Quality)
+	}
+	lo, hi := opts.MinQuality, opts.MaxQuality
+	if lo <= 0 {
+		lo = 10
+	}
+	if hi <= 0 || hi > 100 {
+		hi = 95
+	}
+	if lo > hi {
+		lo = hi
+	}
+
+	results := map[int]*CompressResult{}
+	try := func(q int) (*CompressResult, error) {
+		if r, ok := results[q]; ok {
+			return r, nil
+		}
+		r, err := encodeAndScore(img, q)
+		if err != nil {
+			return nil, err
+		}
+		results[q] = r
+		return r, nil
+	}
+
+	// Find the lowest quality that reaches the SSIM target
+	if opts.MinSSIM > 0 {
+		l, h := lo, hi
+		for l < h {
+			mid := (l + h) / 2
+			r, err := try(mid)
+			if err != nil {
+				return nil, err
+			}
+			if r.SSIM >= opts.MinSSIM {
+				h = mid
+			} else {
+				l = mid + 1
+			}
+		}
+		hi = l
+	}
+
+	best, err := try(hi)
+	if err != nil {
+		return nil, err
+	}
+	if opts.TargetBytes <= 0 || len(best.Data) <= opts.TargetBytes {
+		return best, nil
+	}
+
+	// Find the highest quality that fits in the byte budget
+	l, h := lo, hi-1
+	best = nil
+	for l <= h {
+		mid := (l + h) / 2
+		r, err := try(mid)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Data) <= opts.TargetBytes {
+			best = r
+			l = mid + 1
+		} else {
+			h = mid - 1
+		}
+	}
+	if best == nil {
+		logrus.Warnf("Could not fit image in %d bytes, using quality %d", opts.TargetBytes, lo)
+		return try(lo)
+	}
+	return best, nil
+}
+
+// SaveImage atomically writes data to dir/filename, so a crash never leaves a truncated file at that path
 func SaveImage(filename string, data []byte, dir string) (error, string) {
 	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		return err, ""
 	}
 	filepath := filepath.Join(dir, filename)
-	f, err := os.Create(filepath)
-	if err != nil {
-		return err, ""
-	}
-	defer f.Close()
-
-	_, err = io.Copy(f, strings.NewReader(string(data)))
+	err = storage.WriteFileAtomic(filepath, bytes.NewReader(data))
 	if err != nil {
 		return err, ""
 	}
@@ -64,35 +178,195 @@ func SaveImage(filename string, data []byte, dir string) (error, string) {
 	return nil, filepath
 }
 
-func DownloadResizeCompressSaveImages(urls []string, quality int, product_id string) (error, []string) {
-	paths := []string{}
+// CompressedImage describes one image written by DownloadResizeCompressSaveImages
+type CompressedImage struct {
+	SourceURL   string
+	ContentHash string // hash of the downloaded source image
+	Rendition   string
+	Backend     string // name of the storage backend holding the output
+	Key         string // storage key of the output
+	Quality     int
+	SSIM        float64
+	PSNR        float64
+	Size        int
+
+	// Archived source image, empty unless originals are archived
+	OriginalKey         string
+	OriginalContentType string
+	OriginalChecksum    string
+	OriginalSize        int
+}
+
+// Original returns the archived source image recorded for the output
+func (c CompressedImage) Original() (ArchivedOriginal, bool) {
+	if c.OriginalKey == "" {
+		return ArchivedOriginal{}, false
+	}
+	return ArchivedOriginal{Key: c.OriginalKey, ContentType: c.OriginalContentType, Checksum: c.OriginalChecksum, Size: c.OriginalSize}, true
+}
+
+// uploadedRef reports whether a product image is a reference to a file uploaded to
+// store for the product, as written by the producer, rather than a URL. References
+// to any other key are not read from storage.
+func uploadedRef(source string, store storage.Storage, product_id string) (storage.Ref, bool) {
+	ref, err := storage.ParseRef(source)
+	if err != nil || ref.Backend != store.Name() {
+		return storage.Ref{}, false
+	}
+	key, err := storage.CleanKey(ref.Key)
+	if err != nil || key != ref.Key || !strings.HasPrefix(key, storage.UploadsPrefix(product_id)) {
+		return storage.Ref{}, false
+	}
+	return ref, true
+}
+
+// Config holds the settings used by DownloadResizeCompressSaveImages
+type Config struct {
+	Compress CompressOptions
+	Fetcher  *Fetcher        // a default Fetcher is used when nil
+	Storage  storage.Storage // local storage under product_imgs is used when nil
+
+	ArchiveOriginals bool                        // keep the downloaded source bytes in storage next to the outputs
+	Originals        map[string]ArchivedOriginal // archived originals by source URL, read instead of downloading
+	MaxUploadBytes   int64                       // largest upload read from storage, DefaultMaxUploadBytes when 0
+
+	Progress func(url string, err error) // called after each image, with the reason it could not be processed
+}
+
+// Ref returns the storage reference recorded for the image in the database
+func (c CompressedImage) Ref() storage.Ref {
+	return storage.Ref{Backend: c.Backend, Key: c.Key}
+}
+
+func DownloadResizeCompressSaveImages(urls []string, cfg Config, product_id string) (error, []CompressedImage) {
+	fetcher := cfg.Fetcher
+	if fetcher == nil {
+		fetcher = NewFetcher(FetcherConfig{})
+	}
+	store := cfg.Storage
+	if store == nil {
+		local, err := storage.NewLocal("product_imgs", "")
+		if err != nil {
+			return err, nil
+		}
+		store = local
+	}
+	images := []CompressedImage{}
+	seen := map[string]*CompressedImage{}
+	ctx := context.Background()
 	for _, url := range urls {
-		img, err := DownloadImage(url)
+		compressed, err := processImage(ctx, url, cfg, fetcher, store, product_id, seen)
+		if cfg.Progress != nil {
+			cfg.Progress(url, err)
+		}
 		if err != nil {
-			logrus.Errorf("Failed to download image: %s", err)
+			logrus.Errorf("Failed to process %s: %s", url, err)
 			continue
 		}
+		images = append(images, *compressed)
+	}
+	logrus.Infof("Successfully downloaded, resized, compressed and saved %d images", len(images))
+	return nil, images
+}
 
-		imgResized, err := ResizeImage(img)
+// processImage downloads or loads one source image, compresses it and stores the
+// output. When the image has the same content as one already stored under seen, the
+// existing output is recorded for url instead of compressing it again, so every
+// source keeps an entry in the product's list.
+func processImage(ctx context.Context, url string, cfg Config, fetcher *Fetcher, store storage.Storage, product_id string, seen map[string]*CompressedImage) (*CompressedImage, error) {
+	var data []byte
+	var contentType string
+	original, archived := cfg.Originals[url]
+	if ref, ok := uploadedRef(url, store, product_id); ok {
+		// Uploaded files are already in storage and serve as their own original. They
+		// have no URL to download them from instead.
+		maxBytes := cfg.MaxUploadBytes
+		if maxBytes <= 0 {
+			maxBytes = DefaultMaxUploadBytes
+		}
+		original, archived = ArchivedOriginal{Key: ref.Key}, true
+		var err error
+		data, err = LoadOriginal(ctx, store, original, DownloadLimits{MaxBytes: maxBytes})
 		if err != nil {
-			logrus.Errorf("Failed to resize image: %s", err)
-			continue
+			return nil, fmt.Errorf("failed to load upload: %w", err)
 		}
-
-		imgCompressed, err := CompressImage(imgResized, quality)
+		logrus.Infof("Using upload %s for %s", ref.Key, url)
+	} else if archived {
+		var err error
+		data, err = LoadOriginal(ctx, store, original, fetcher.Limits())
 		if err != nil {
-			logrus.Errorf("Failed to compress image: %s", err)
-			continue
+			logrus.Warnf("Failed to load archived original of %s, downloading it instead: %s", url, err)
+			archived = false
+		} else {
+			logrus.Infof("Using archived original %s for %s", original.Key, url)
 		}
-
-		filename := filepath.Base(url)
-		err, path := SaveImage(filename, imgCompressed, "product_imgs/"+product_id+"/")
+	}
+	if archived && original.Checksum == "" {
+		original.ContentType = normalizeContentType("", data)
+		original.Checksum = Checksum(data)
+		original.Size = len(data)
+	}
+	if !archived {
+		res, err := fetcher.Fetch(url)
 		if err != nil {
-			logrus.Errorf("Failed to save image: %s", err)
-			continue
+			return nil, fmt.Errorf("failed to download image: %w", err)
 		}
-		paths = append(paths, path)
+		data, contentType = res.Data, res.ContentType
+	}
+	hash := ContentHash(data)
+	if earlier, ok := seen[hash]; ok {
+		logrus.Infof("Reusing %s for %s: same image as an earlier URL", earlier.Key, url)
+		duplicate := *earlier
+		duplicate.SourceURL = url
+		return &duplicate, nil
+	}
+	img, err := fetcher.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if !archived && cfg.ArchiveOriginals {
+		original, err = ArchiveOriginal(ctx, store, product_id, data, contentType)
+		if err != nil {
+			logrus.Errorf("Failed to archive original of %s: %s", url, err)
+		} else {
+			archived = true
+		}
+	}
+
+	imgResized, err := ResizeImage(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize image: %w", err)
+	}
+
+	imgCompressed, err := CompressImageAdaptive(imgResized, cfg.Compress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress image: %w", err)
+	}
+	logrus.Infof("Compressed %s at quality %d to %d bytes (SSIM %.4f, PSNR %.2fdB)", url, imgCompressed.Quality, len(imgCompressed.Data), imgCompressed.SSIM, imgCompressed.PSNR)
+
+	key := product_id + "/" + OutputFilename(hash, DefaultRendition, "jpeg")
+	err = store.Put(ctx, key, bytes.NewReader(imgCompressed.Data), int64(len(imgCompressed.Data)), "image/jpeg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+	logrus.Infof("Image saved to %s storage as %s", store.Name(), key)
+	compressed := CompressedImage{
+		SourceURL:   url,
+		ContentHash: hash,
+		Rendition:   DefaultRendition,
+		Backend:     store.Name(),
+		Key:         key,
+		Quality:     imgCompressed.Quality,
+		SSIM:        imgCompressed.SSIM,
+		PSNR:        imgCompressed.PSNR,
+		Size:        len(imgCompressed.Data),
+	}
+	if archived {
+		compressed.OriginalKey = original.Key
+		compressed.OriginalContentType = original.ContentType
+		compressed.OriginalChecksum = original.Checksum
+		compressed.OriginalSize = original.Size
 	}
-	logrus.Infof("Successfully downloaded, resized, compressed and saved %d images", len(paths))
-	return nil, paths
+	seen[hash] = &compressed
+	return &compressed, nil
 }
@@ -2,16 +2,25 @@ package imageutils
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
 	"image"
 	"image/color"
 	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/golang_backend_assignment/consumer/storage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -152,3 +161,203 @@ func TestSaveImage(t *testing.T) {
 
 	assert.Equal(t, data, fileData, "Image file contents do not match test data")
 }
+
+func TestCompressImageAdaptive(t *testing.T) {
+	img := generateImage()
+
+	// Without targets the fixed quality is used
+	res, err := CompressImageAdaptive(img, CompressOptions{Quality: 60})
+	assert.NoError(t, err)
+	assert.Equal(t, 60, res.Quality)
+	assert.NotZero(t, res.SSIM)
+
+	// A byte budget picks the highest quality that fits
+	full, err := CompressImage(img, 95)
+	assert.NoError(t, err)
+	budget := len(full) / 2
+	res, err = CompressImageAdaptive(img, CompressOptions{TargetBytes: budget})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(res.Data), budget, "Output exceeds byte budget")
+	above, err := CompressImage(img, res.Quality+1)
+	assert.NoError(t, err)
+	assert.Greater(t, len(above), budget, "A higher quality would also have fit")
+
+	// An SSIM target picks the lowest quality that reaches it
+	res, err = CompressImageAdaptive(img, CompressOptions{MinSSIM: 0.95})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, res.SSIM, 0.95)
+	if res.Quality > 10 {
+		below, err := encodeAndScore(img, res.Quality-1)
+		assert.NoError(t, err)
+		assert.Less(t, below.SSIM, 0.95, "A lower quality would also have met the target")
+	}
+
+	// The byte budget wins over an unreachable SSIM target
+	res, err = CompressImageAdaptive(img, CompressOptions{MinSSIM: 0.9999, TargetBytes: budget})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(res.Data), budget)
+}
+
+// pngBomb returns a tiny PNG whose header claims the given dimensions
+func pngBomb(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length(4) type(4) width(4) height(4) ... crc(4)
+	binary.BigEndian.PutUint32(data[16:20], width)
+	binary.BigEndian.PutUint32(data[20:24], height)
+	binary.BigEndian.PutUint32(data[29:33], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestDownloadImageWithLimits(t *testing.T) {
+	var small bytes.Buffer
+	if err := jpeg.Encode(&small, generateImage(), nil); err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+	bomb := pngBomb(t, 50000, 50000)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/small.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(small.Bytes())
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(bytes.Repeat([]byte{0xff}, 2<<20))
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing the body forces chunked encoding with no Content-Length
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 64; i++ {
+			w.Write(bytes.Repeat([]byte{0xff}, 32<<10))
+		}
+	})
+	mux.HandleFunc("/bomb.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bomb)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.Write(small.Bytes())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	limits := DownloadLimits{MaxBytes: 1 << 20, MaxMegapixels: 10, Timeout: 200 * time.Millisecond}
+	tests := []struct {
+		name    string
+		path    string
+		wantErr error
+	}{
+		{name: "small image", path: "/small.jpg"},
+		{name: "content length over limit", path: "/large", wantErr: ErrImageTooLarge},
+		{name: "chunked body over limit", path: "/chunked", wantErr: ErrImageTooLarge},
+		{name: "decompression bomb", path: "/bomb.png", wantErr: ErrTooManyPixels},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := NewFetcher(FetcherConfig{Limits: limits, Policy: testPolicy}).FetchImage(server.URL + tt.path)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 640, img.Bounds().Dx())
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		_, err := NewFetcher(FetcherConfig{Limits: limits, Policy: testPolicy, MaxRetries: -1}).FetchImage(server.URL + "/slow")
+		var netErr net.Error
+		if assert.ErrorAs(t, err, &netErr) {
+			assert.True(t, netErr.Timeout(), "Expected a timeout error, got %v", err)
+		}
+	})
+}
+
+func TestDownloadResizeCompressSaveImagesNaming(t *testing.T) {
+	var first, second, pngData bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&first, generateImage(), nil))
+	assert.NoError(t, jpeg.Encode(&second, image.NewGray(image.Rect(0, 0, 320, 240)), nil))
+	assert.NoError(t, png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 200, 100))))
+
+	mux := http.NewServeMux()
+	serve := func(path, contentType string, data []byte) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write(data)
+		})
+	}
+	serve("/a/image.jpg", "image/jpeg", first.Bytes())
+	serve("/b/image.jpg", "image/jpeg", second.Bytes())
+	serve("/copy/first.jpg", "image/jpeg", first.Bytes())
+	serve("/logo.png", "image/png", pngData.Bytes())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	urls := []string{
+		server.URL + "/a/image.jpg",
+		server.URL + "/b/image.jpg",
+		server.URL + "/copy/first.jpg",
+		server.URL + "/logo.png?size=large&v=2",
+	}
+	cfg := Config{Compress: CompressOptions{Quality: 60}, Fetcher: NewFetcher(FetcherConfig{Policy: testPolicy}), Storage: store}
+	err, images := DownloadResizeCompressSaveImages(urls, cfg, "naming-test")
+	assert.NoError(t, err)
+
+	// The copy of the first image reuses its output, the rest get distinct names
+	assert.Len(t, images, 4)
+	assert.Equal(t, ContentHash(first.Bytes()), images[0].ContentHash)
+	assert.Equal(t, images[0].Key, images[2].Key)
+	assert.Equal(t, urls[2], images[2].SourceURL)
+	names := map[string]bool{}
+	for _, img := range images {
+		name := path.Base(img.Key)
+		assert.Equal(t, "naming-test/"+OutputFilename(img.ContentHash, DefaultRendition, "jpeg"), img.Key)
+		assert.Equal(t, ".jpg", path.Ext(name), "Outputs are JPEG whatever the source format")
+		assert.Equal(t, "local", img.Backend)
+		_, err := store.Stat(context.Background(), img.Key)
+		assert.NoError(t, err)
+		names[name] = true
+	}
+	assert.Len(t, names, 3)
+}
+
+func TestDownloadResizeCompressSaveImagesProgress(t *testing.T) {
+	var data bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&data, generateImage(), nil))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.jpg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data.Bytes())
+	}))
+	defer server.Close()
+
+	store, err := storage.NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	reported := map[string]error{}
+	cfg := Config{
+		Compress: CompressOptions{Quality: 60},
+		Fetcher:  NewFetcher(FetcherConfig{Policy: testPolicy, MaxRetries: 0}),
+		Storage:  store,
+		Progress: func(url string, err error) { reported[url] = err },
+	}
+	urls := []string{server.URL + "/a.jpg", server.URL + "/missing.jpg", server.URL + "/copy.jpg"}
+	err, images := DownloadResizeCompressSaveImages(urls, cfg, "progress-test")
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+
+	// Every image is reported once, a duplicate as processed
+	assert.Len(t, reported, 3)
+	assert.NoError(t, reported[urls[0]])
+	assert.Error(t, reported[urls[1]])
+	assert.NoError(t, reported[urls[2]])
+}
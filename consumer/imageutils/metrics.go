@@ -0,0 +1,121 @@
+package imageutils
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// ssimWindow is the side length of the square blocks SSIM is averaged over
+const ssimWindow = 8
+
+var (
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// ErrSizeMismatch is returned when two images being compared have different dimensions
+var ErrSizeMismatch = errors.New("images have different dimensions")
+
+// luma converts an image to a row-major slice of 8-bit luma values
+func luma(img image.Image) []float64 {
+	b := img.Bounds()
+	out := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			out = append(out, (0.299*float64(r)+0.587*float64(g)+0.114*float64(bl))/257)
+		}
+	}
+	return out
+}
+
+// maxPSNR is reported for identical images, whose PSNR would otherwise be infinite
+const maxPSNR = 100.0
+
+// PSNR computes the peak signal-to-noise ratio in decibels across the RGB channels of a and b.
+// Higher is better; identical images score maxPSNR.
+func PSNR(a, b image.Image) (float64, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return 0, ErrSizeMismatch
+	}
+	if ab.Dx() == 0 || ab.Dy() == 0 {
+		return 0, ErrSizeMismatch
+	}
+
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(ab.Dx()*ab.Dy()*3)
+	if mse == 0 {
+		return maxPSNR, nil
+	}
+	return math.Min(maxPSNR, 10*math.Log10(255*255/mse)), nil
+}
+
+// SSIM computes the mean structural similarity of the luma channels of a and b.
+// The result is 1 for identical images and decreases towards 0 as they diverge.
+func SSIM(a, b image.Image) (float64, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return 0, ErrSizeMismatch
+	}
+	w, h := ab.Dx(), ab.Dy()
+	if w == 0 || h == 0 {
+		return 0, ErrSizeMismatch
+	}
+	la, lb := luma(a), luma(b)
+
+	var total float64
+	var windows int
+	for y0 := 0; y0 < h; y0 += ssimWindow {
+		for x0 := 0; x0 < w; x0 += ssimWindow {
+			y1, x1 := minInt(y0+ssimWindow, h), minInt(x0+ssimWindow, w)
+			n := float64((y1 - y0) * (x1 - x0))
+
+			var sumA, sumB float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					sumA += la[y*w+x]
+					sumB += lb[y*w+x]
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+
+			var varA, varB, cov float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					da, db := la[y*w+x]-meanA, lb[y*w+x]-meanB
+					varA += da * da
+					varB += db * db
+					cov += da * db
+				}
+			}
+			varA, varB, cov = varA/n, varB/n, cov/n
+
+			total += ((2*meanA*meanB + ssimC1) * (2*cov + ssimC2)) /
+				((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,57 @@
+package imageutils
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSIM(t *testing.T) {
+	img := generateImage()
+
+	// An image compared with itself is a perfect match
+	score, err := SSIM(img, img)
+	assert.NoError(t, err)
+	assert.InDelta(t, 1.0, score, 1e-9, "SSIM of identical images should be 1")
+
+	// Lower JPEG quality should give a lower score
+	scores := []float64{}
+	for _, q := range []int{10, 50, 90} {
+		data, err := CompressImage(img, q)
+		assert.NoError(t, err)
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		s, err := SSIM(img, decoded)
+		assert.NoError(t, err)
+		scores = append(scores, s)
+	}
+	assert.Less(t, scores[0], scores[1])
+	assert.Less(t, scores[1], scores[2])
+
+	// Images of different sizes cannot be compared
+	_, err = SSIM(img, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+}
+
+func TestPSNR(t *testing.T) {
+	img := generateImage()
+
+	score, err := PSNR(img, img)
+	assert.NoError(t, err)
+	assert.Equal(t, maxPSNR, score, "PSNR of identical images should be capped")
+
+	data, err := CompressImage(img, 50)
+	assert.NoError(t, err)
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	score, err = PSNR(img, decoded)
+	assert.NoError(t, err)
+	assert.Greater(t, score, 20.0)
+	assert.Less(t, score, maxPSNR)
+
+	_, err = PSNR(img, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+}
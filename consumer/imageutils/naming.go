@@ -0,0 +1,54 @@
+package imageutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// DefaultRendition names the 1024px wide output produced by ResizeImage
+const DefaultRendition = "w1024"
+
+// contentHashLength is the number of hex characters of the SHA-256 digest kept in file names
+const contentHashLength = 32
+
+// ContentHash returns a hex digest identifying data, used to name outputs so that
+// identical source images map to the same file
+func ContentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:contentHashLength]
+}
+
+// formatExtensions maps encoder format names to file extensions
+var formatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
+
+// OutputFilename builds a filesystem-safe name for a rendition of a source image
+// from the source's content hash, the rendition name and the encoded format
+func OutputFilename(contentHash, rendition, format string) string {
+	ext, ok := formatExtensions[strings.ToLower(format)]
+	if !ok {
+		ext = ".bin"
+	}
+	return contentHash + "_" + sanitizeName(rendition) + ext
+}
+
+// sanitizeName keeps only lowercase letters, digits and dashes
+func sanitizeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	if b.Len() == 0 {
+		return "default"
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package imageutils
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentHash(t *testing.T) {
+	a := ContentHash([]byte("image one"))
+	assert.Len(t, a, contentHashLength)
+	assert.Equal(t, a, ContentHash([]byte("image one")), "Hash should be deterministic")
+	assert.NotEqual(t, a, ContentHash([]byte("image two")))
+}
+
+func TestOutputFilename(t *testing.T) {
+	safe := regexp.MustCompile(`^[a-z0-9_-]+\.[a-z]+$`)
+	tests := []struct {
+		name      string
+		rendition string
+		format    string
+		want      string
+	}{
+		{name: "jpeg output", rendition: DefaultRendition, format: "jpeg", want: "abc123_w1024.jpg"},
+		{name: "png output", rendition: "thumb", format: "png", want: "abc123_thumb.png"},
+		{name: "unsafe rendition", rendition: "../../etc", format: "jpeg", want: "abc123_------etc.jpg"},
+		{name: "empty rendition", rendition: "", format: "jpeg", want: "abc123_default.jpg"},
+		{name: "unknown format", rendition: "x", format: "tiff", want: "abc123_x.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := OutputFilename("abc123", tt.rendition, tt.format)
+			assert.Equal(t, tt.want, got)
+			assert.Regexp(t, safe, got)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package imageutils
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SweepResult is the size and scores of one image compressed at one JPEG quality
+type SweepResult struct {
+	File    string
+	Quality int
+	Size    int
+	SSIM    float64
+	PSNR    float64
+}
+
+// SweepQualities compresses img at each of the given qualities and scores every output
+func SweepQualities(img image.Image, qualities []int) ([]SweepResult, error) {
+	results := []SweepResult{}
+	for _, q := range qualities {
+		r, err := encodeAndScore(img, q)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, SweepResult{Quality: q, Size: len(r.Data), SSIM: r.SSIM, PSNR: r.PSNR})
+	}
+	return results, nil
+}
+
+// SweepDirectory resizes every decodable image in dir the same way the consumer does
+// and sweeps it over the given qualities. Files that cannot be decoded are skipped.
+func SweepDirectory(dir string, qualities []int) ([]SweepResult, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	results := []SweepResult{}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			logrus.Warnf("Skipping %s: %v", name, err)
+			continue
+		}
+		imgResized, err := ResizeImage(img)
+		if err != nil {
+			return nil, err
+		}
+		fileResults, err := SweepQualities(imgResized, qualities)
+		if err != nil {
+			return nil, err
+		}
+		for i := range fileResults {
+			fileResults[i].File = name
+		}
+		results = append(results, fileResults...)
+	}
+	return results, nil
+}
@@ -0,0 +1,34 @@
+package imageutils
+
+import (
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	// Write one sample image and one file that is not an image
+	f, err := os.Create(filepath.Join(dir, "sample.jpg"))
+	assert.NoError(t, err)
+	assert.NoError(t, jpeg.Encode(f, generateImage(), &jpeg.Options{Quality: 100}))
+	f.Close()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644))
+
+	results, err := SweepDirectory(dir, []int{30, 60, 90})
+	assert.NoError(t, err)
+	assert.Len(t, results, 3, "Expected one result per quality for the single image")
+
+	for i, r := range results {
+		assert.Equal(t, "sample.jpg", r.File)
+		assert.NotZero(t, r.Size)
+		if i > 0 {
+			assert.Greater(t, r.Size, results[i-1].Size, "Size should grow with quality")
+			assert.Greater(t, r.PSNR, results[i-1].PSNR, "PSNR should grow with quality")
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package imageutils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+
+	"github.com/nfnt/resize"
+)
+
+// Fit modes accepted by Transform
+const (
+	FitContain = "contain" // scale to fit inside the box, keeping the aspect ratio
+	FitCover   = "cover"   // scale to cover the box, keeping the aspect ratio, then crop the centre
+	FitFill    = "fill"    // stretch to exactly the box
+)
+
+// ErrUnsupportedFormat is returned by EncodeImage for formats it cannot write
+var ErrUnsupportedFormat = errors.New("unsupported output format")
+
+// TransformOptions describes an on-demand rendition. A zero Width or Height is
+// derived from the other one using the source aspect ratio.
+type TransformOptions struct {
+	Width  int
+	Height int
+	Fit    string
+}
+
+// Transform resizes img according to opts
+func Transform(img image.Image, opts TransformOptions) image.Image {
+	b := img.Bounds()
+	w, h := opts.Width, opts.Height
+	if w == 0 && h == 0 {
+		return img
+	}
+	if w == 0 || h == 0 {
+		return resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	}
+
+	switch opts.Fit {
+	case FitFill:
+		return resize.Resize(uint(w), uint(h), img, resize.Lanczos3)
+	case FitCover:
+		// Scale the side that overflows the least to the box, then crop the other
+		if b.Dx()*h > b.Dy()*w {
+			img = resize.Resize(0, uint(h), img, resize.Lanczos3)
+		} else {
+			img = resize.Resize(uint(w), 0, img, resize.Lanczos3)
+		}
+		return cropCenter(img, w, h)
+	default:
+		return resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
+	}
+}
+
+// cropCenter returns the w by h region in the middle of img
+func cropCenter(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	x0 := b.Min.X + (b.Dx()-w)/2
+	y0 := b.Min.Y + (b.Dy()-h)/2
+	rect := image.Rect(x0, y0, x0+w, y0+h).Intersect(b)
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	return img
+}
+
+// EncodeImage encodes img as "jpeg" or "png" and returns the data with its content type.
+// quality only applies to JPEG.
+func EncodeImage(img image.Image, format string, quality int) ([]byte, string, error) {
+	switch format {
+	case "jpeg", "jpg":
+		data, err := CompressImage(img, quality)
+		return data, "image/jpeg", err
+	case "png":
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	default:
+		return nil, "", ErrUnsupportedFormat
+	}
+}
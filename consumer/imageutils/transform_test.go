@@ -0,0 +1,52 @@
+package imageutils
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransform(t *testing.T) {
+	img := generateImage() // 640x480
+
+	tests := []struct {
+		name  string
+		opts  TransformOptions
+		wantW int
+		wantH int
+	}{
+		{name: "no size keeps the image", opts: TransformOptions{}, wantW: 640, wantH: 480},
+		{name: "width only", opts: TransformOptions{Width: 320}, wantW: 320, wantH: 240},
+		{name: "height only", opts: TransformOptions{Height: 120}, wantW: 160, wantH: 120},
+		{name: "contain", opts: TransformOptions{Width: 200, Height: 200, Fit: FitContain}, wantW: 200, wantH: 150},
+		{name: "cover", opts: TransformOptions{Width: 200, Height: 200, Fit: FitCover}, wantW: 200, wantH: 200},
+		{name: "fill", opts: TransformOptions{Width: 100, Height: 300, Fit: FitFill}, wantW: 100, wantH: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := Transform(img, tt.opts)
+			assert.Equal(t, tt.wantW, out.Bounds().Dx())
+			assert.Equal(t, tt.wantH, out.Bounds().Dy())
+		})
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	img := generateImage()
+
+	data, contentType, err := EncodeImage(img, "png", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+	_, err = png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	_, contentType, err = EncodeImage(img, "jpeg", 70)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+
+	_, _, err = EncodeImage(image.NewRGBA(image.Rect(0, 0, 1, 1)), "bmp", 0)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/imageserver"
+	"github.com/golang_backend_assignment/consumer/imageutils"
 	"github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/consumer/webhooks"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
@@ -23,7 +32,7 @@ func main() {
 	}
 	defer db.Close()
 
-	queue := os.Getenv("RM_QUEUENAME")
+	lanes := msgqueue.LanesFromEnv()
 	conn, err := msgqueue.NewRMQ()
 	if err != nil {
 		logrus.Errorf("Failed to connect to RabbitMQ: %v", err)
@@ -36,6 +45,131 @@ func main() {
 		return
 	}
 	defer ch.Close()
-	image_quality := 60
-	msgqueue.Consumer(ch, queue, db, image_quality)
+	store, err := storage.FromEnv()
+	if err != nil {
+		logrus.Errorf("Failed to set up storage: %v", err)
+		return
+	}
+	archiveOriginals, _ := strconv.ParseBool(os.Getenv("IMAGE_ARCHIVE_ORIGINALS"))
+	cfg := imageutils.Config{
+		Compress: imageutils.CompressOptions{
+			Quality:     getEnvInt("IMAGE_QUALITY", 60),
+			TargetBytes: getEnvInt("IMAGE_TARGET_BYTES", 0),
+			MinSSIM:     getEnvFloat("IMAGE_MIN_SSIM", 0),
+		},
+		Fetcher: imageutils.NewFetcher(imageutils.FetcherConfig{
+			Limits: imageutils.DownloadLimits{
+				MaxBytes:      int64(getEnvInt("IMAGE_MAX_BYTES", int(imageutils.DefaultDownloadLimits.MaxBytes))),
+				MaxMegapixels: getEnvFloat("IMAGE_MAX_MEGAPIXELS", imageutils.DefaultDownloadLimits.MaxMegapixels),
+				Timeout:       time.Duration(getEnvInt("IMAGE_DOWNLOAD_TIMEOUT_SECONDS", int(imageutils.DefaultDownloadLimits.Timeout.Seconds()))) * time.Second,
+			},
+			ConnectTimeout: time.Duration(getEnvInt("IMAGE_CONNECT_TIMEOUT_SECONDS", 5)) * time.Second,
+			ReadTimeout:    time.Duration(getEnvInt("IMAGE_READ_TIMEOUT_SECONDS", 15)) * time.Second,
+			UserAgent:      os.Getenv("IMAGE_USER_AGENT"),
+			MaxRetries:     getEnvInt("IMAGE_MAX_RETRIES", 3),
+			Cache:          imageutils.NewResponseCache(getEnvInt("IMAGE_CACHE_BYTES", 64<<20)),
+			Policy:         urlpolicy.FromEnv(),
+		}),
+		Storage:          store,
+		ArchiveOriginals: archiveOriginals,
+		MaxUploadBytes:   imageutils.MaxUploadBytesFromEnv(),
+	}
+
+	// Serve the stored renditions alongside the queue consumer
+	addr := os.Getenv("IMAGE_SERVER_ADDR")
+	if addr == "" {
+		addr = ":3001"
+	}
+	cacheDir := os.Getenv("IMAGE_TRANSFORM_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "image_cache"
+	}
+	transformCache, err := imageserver.NewDiskCache(cacheDir, int64(getEnvInt("IMAGE_TRANSFORM_CACHE_BYTES", 512<<20)))
+	if err != nil {
+		logrus.Errorf("Failed to set up the transform cache: %v", err)
+		return
+	}
+	server := imageserver.New(store, imageserver.Options{
+		SigningSecret: []byte(os.Getenv("IMAGE_SIGNING_SECRET")),
+		Cache:         transformCache,
+		Limits:        cfg.Fetcher.Limits(),
+	})
+	go func() {
+		logrus.Infof("Serving images on %s", addr)
+		if err := http.ListenAndServe(addr, server.Handler()); err != nil {
+			logrus.Fatalf("Error in starting the image server: %v", err)
+		}
+	}()
+
+	// Send webhook deliveries recorded when products finish processing
+	dispatcher := webhooks.NewDispatcher(db, urlpolicy.FromEnv(), webhooks.Options{
+		MaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		Backoff:     time.Duration(getEnvInt("WEBHOOK_BACKOFF_SECONDS", 30)) * time.Second,
+		Timeout:     time.Duration(getEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second,
+	})
+	go dispatcher.Run(context.Background(), time.Duration(getEnvInt("WEBHOOK_POLL_SECONDS", 5))*time.Second)
+
+	// Progress and domain events are published from the running jobs on a channel of
+	// their own, so that publishing many of them never holds up consuming or
+	// acknowledging jobs, and a publish error closing it leaves the jobs running
+	pubCh, err := msgqueue.NewChannel(conn)
+	if err != nil {
+		logrus.Errorf("Failed to open a rmq channel: %v", err)
+		return
+	}
+	defer pubCh.Close()
+
+	// Publish the progress of every job for the producer to relay to clients
+	exchange := os.Getenv("RMQ_PROGRESS_EXCHANGE")
+	if exchange == "" {
+		exchange = "product_progress"
+	}
+	progress, err := msgqueue.NewProgressPublisher(pubCh, exchange)
+	if err != nil {
+		logrus.Errorf("Failed to set up progress events: %v", err)
+		return
+	}
+
+	// Publish domain events for other services to bind their own queues to
+	eventsExchange := os.Getenv("RMQ_EVENTS_EXCHANGE")
+	if eventsExchange == "" {
+		eventsExchange = "product_events"
+	}
+	publishEvent, err := msgqueue.NewEventPublisher(pubCh, eventsExchange)
+	if err != nil {
+		logrus.Errorf("Failed to set up domain events: %v", err)
+		return
+	}
+
+	if err := msgqueue.Consumer(ch, lanes, db, cfg, msgqueue.Notifiers{Progress: progress, Events: publishEvent}); err != nil {
+		logrus.Fatalf("Failed to consume jobs: %v", err)
+	}
+}
+
+// getEnvInt reads an integer environment variable, falling back to def when it is unset or invalid
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		logrus.Warnf("Invalid value %q for %s, using %d", v, key, def)
+		return def
+	}
+	return n
+}
+
+// getEnvFloat reads a float environment variable, falling back to def when it is unset or invalid
+func getEnvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logrus.Warnf("Invalid value %q for %s, using %g", v, key, def)
+		return def
+	}
+	return f
 }
@@ -0,0 +1,33 @@
+package msgqueue
+
+import "github.com/streadway/amqp"
+
+// Publisher declares exchanges and queues and publishes messages to them. Its methods
+// are those of *amqp.Channel, which implements it, as does MemoryBroker.
+type Publisher interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Subscriber declares queues, binds them to exchanges and consumes them. Deliveries
+// are acknowledged through their amqp.Acknowledger, so they are acked, nacked and
+// redelivered the same way whatever the implementation.
+type Subscriber interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+}
+
+// Broker both publishes and subscribes
+type Broker interface {
+	Publisher
+	Subscriber
+}
+
+var (
+	_ Broker = (*amqp.Channel)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
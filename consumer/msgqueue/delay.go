@@ -0,0 +1,92 @@
+package msgqueue
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// delayLevels are the TTLs of the delay queues, each four times the previous one.
+// RabbitMQ only expires the message at the head of a queue, so a single queue with
+// per-message TTLs would hold short delays behind long ones. Every delay queue has
+// one TTL instead, and a job waits in the longest one that does not overshoot its
+// not-before time, hopping down the levels until it is due.
+var delayLevels = []time.Duration{
+	time.Second,
+	4 * time.Second,
+	16 * time.Second,
+	64 * time.Second,
+	256 * time.Second,
+	1024 * time.Second,
+	4096 * time.Second,
+	16384 * time.Second,
+	65536 * time.Second, // about 18 hours, longer delays take several hops
+}
+
+// delayLevel returns the longest delay level not longer than wait, or the shortest
+// level when wait is shorter than all of them
+func delayLevel(wait time.Duration) time.Duration {
+	level := delayLevels[0]
+	for _, l := range delayLevels {
+		if l <= wait {
+			level = l
+		}
+	}
+	return level
+}
+
+// DelayQueue names the delay queue of a level for queue
+func DelayQueue(queue string, level time.Duration) string {
+	return fmt.Sprintf("%s.delay.%ds", queue, int64(level/time.Second))
+}
+
+// declareDelayQueue declares the delay queue of a level for queue. Its messages
+// expire after the level and are dead-lettered through the default exchange back
+// to queue. Nothing consumes it.
+func declareDelayQueue(ch Publisher, queue string, level time.Duration) (string, error) {
+	name := DelayQueue(queue, level)
+	_, err := ch.QueueDeclare(
+		name,  // queue name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             int64(level / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		},
+	)
+	if err != nil {
+		logrus.Errorf("Failed to declare delay queue %s: %v", name, err)
+		return "", err
+	}
+	return name, nil
+}
+
+// PublishDelayed parks a message for queue in the delay queue bringing it closest
+// to, but not past, the end of wait
+func PublishDelayed(ch Publisher, queue string, msg amqp.Publishing, wait time.Duration) error {
+	name, err := declareDelayQueue(ch, queue, delayLevel(wait))
+	if err != nil {
+		return err
+	}
+	if err := ch.Publish("", name, false, false, msg); err != nil {
+		logrus.Errorf("Failed to publish a message to %s: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+// deferJob parks a delivery of queue that is not due yet in its delay queues
+func deferJob(ch Publisher, queue string, d amqp.Delivery, wait time.Duration) error {
+	logrus.Infof("Job is not due for %v, putting it back on hold", wait.Round(time.Second))
+	return PublishDelayed(ch, queue, amqp.Publishing{
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Headers:      d.Headers,
+		Body:         d.Body,
+	}, wait)
+}
@@ -0,0 +1,31 @@
+package msgqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelayLevel(t *testing.T) {
+	assert.Equal(t, time.Second, delayLevel(100*time.Millisecond))
+	assert.Equal(t, 16*time.Second, delayLevel(63*time.Second))
+	assert.Equal(t, 1024*time.Second, delayLevel(30*time.Minute))
+	assert.Equal(t, 65536*time.Second, delayLevel(72*time.Hour))
+	assert.Equal(t, "products.delay.64s", DelayQueue("products", 64*time.Second))
+}
+
+func TestJobDue(t *testing.T) {
+	job, err := ParseJob([]byte(`{"product_id": 1, "not_before": "2024-03-01T12:30:00Z"}`))
+	assert.NoError(t, err)
+
+	due, wait := job.Due(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	assert.False(t, due)
+	assert.Equal(t, 30*time.Minute, wait)
+
+	due, _ = job.Due(time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC))
+	assert.True(t, due)
+
+	due, _ = Job{ProductID: 1}.Due(time.Now())
+	assert.True(t, due, "a job without a not-before time is always due")
+}
@@ -0,0 +1,143 @@
+package msgqueue
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/webhooks"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// EventSource names the consumer in the events it publishes
+const EventSource = "image-crunch-consumer"
+
+// Domain events published by the consumer. Webhooks name a processed product
+// product.images.completed instead, as subscriptions were made to that name.
+const (
+	EventImagesProcessed = "product.images.processed"
+	EventImagesFailed    = "product.images.failed"
+)
+
+// DomainEvent is the envelope of every event published to the events exchange. It is
+// routed by "<type>.v<version>", e.g. product.images.processed.v1, and the data of a
+// version only ever gains fields.
+type DomainEvent struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Version    int         `json:"version"`
+	Source     string      `json:"source"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// RoutingKey is the key the event is published with
+func (e DomainEvent) RoutingKey() string {
+	return fmt.Sprintf("%s.v%d", e.Type, e.Version)
+}
+
+// ProductImagesV1 is the data of product.images.processed and product.images.failed
+// version 1
+type ProductImagesV1 struct {
+	ProductID               int      `json:"product_id"`
+	UserID                  int      `json:"user_id"`
+	ProcessingStatus        string   `json:"processing_status"`
+	CompressedProductImages []string `json:"compressed_product_images"`
+	Error                   string   `json:"error,omitempty"`
+}
+
+// NewEvent returns an event of the given type and version that occurred now
+func NewEvent(eventType string, version int, data interface{}) DomainEvent {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return DomainEvent{
+		ID:         hex.EncodeToString(b),
+		Type:       eventType,
+		Version:    version,
+		Source:     EventSource,
+		OccurredAt: time.Now().UTC(),
+		Data:       data,
+	}
+}
+
+// EventPublisher publishes domain events
+type EventPublisher func(event DomainEvent) error
+
+// NewEventPublisher declares the durable topic exchange domain events are published
+// to and returns an EventPublisher for it. Events are persistent, but only reach the
+// queues bound to the exchange when they are published.
+func NewEventPublisher(ch Publisher, exchange string) (EventPublisher, error) {
+	err := ch.ExchangeDeclare(
+		exchange, // name
+		"topic",  // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		logrus.Errorf("Failed to declare exchange %s: %v", exchange, err)
+		return nil, err
+	}
+	return func(event DomainEvent) error {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		err = ch.Publish(exchange, event.RoutingKey(), false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    event.ID,
+			Timestamp:    event.OccurredAt,
+			Type:         event.Type,
+			AppId:        event.Source,
+			Headers:      amqp.Table{"event_version": int32(event.Version)},
+			Body:         body,
+		})
+		if err != nil {
+			logrus.Errorf("Failed to publish %s event: %v", event.RoutingKey(), err)
+			return err
+		}
+		logrus.Infof("Published %s event %s", event.RoutingKey(), event.ID)
+		return nil
+	}, nil
+}
+
+// Notifiers are told about the processing of products. Nil fields are skipped.
+type Notifiers struct {
+	Progress ProgressFunc   // progress of every job
+	Events   EventPublisher // domain events when a product's images were processed
+}
+
+// announce sends the webhooks and publishes the domain event for the outcome of
+// processing a product, failed with jobErr when it is set. Failing to announce it
+// does not fail the job.
+func (n Notifiers) announce(db *sql.DB, productID int, jobErr error) {
+	webhook, eventType, errMsg := webhooks.EventCompleted, EventImagesProcessed, ""
+	if jobErr != nil {
+		webhook, eventType, errMsg = webhooks.EventFailed, EventImagesFailed, jobErr.Error()
+	}
+	if _, err := webhooks.Enqueue(db, productID, webhook, errMsg); err != nil {
+		logrus.Errorf("Error queueing webhooks for product_id %d: %v", productID, err)
+	}
+	if n.Events == nil {
+		return
+	}
+	product, err := database.GetProductEvent(db, productID)
+	if err != nil {
+		return
+	}
+	n.Events(NewEvent(eventType, 1, ProductImagesV1{
+		ProductID:               product.ProductID,
+		UserID:                  product.UserID,
+		ProcessingStatus:        product.ProcessingStatus,
+		CompressedProductImages: product.CompressedImages,
+		Error:                   errMsg,
+	}))
+}
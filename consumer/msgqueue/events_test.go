@@ -0,0 +1,161 @@
+package msgqueue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/consumer/webhooks"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bindEvents consumes the events published to exchange with routing keys matching key
+func bindEvents(t *testing.T, b *MemoryBroker, exchange, key string) <-chan amqp.Delivery {
+	t.Helper()
+	q, err := b.QueueDeclare("", false, true, true, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.QueueBind(q.Name, key, exchange, false, nil))
+	msgs, err := b.Consume(q.Name, "", true, false, false, false, nil)
+	require.NoError(t, err)
+	return msgs
+}
+
+func TestEventPublisher(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	publish, err := NewEventPublisher(b, "events")
+	require.NoError(t, err)
+	outcomes := bindEvents(t, b, "events", "product.images.*.v1")
+	everything := bindEvents(t, b, "events", "#")
+
+	event := NewEvent(EventImagesProcessed, 1, ProductImagesV1{ProductID: 1, UserID: 2, ProcessingStatus: database.StatusDone, CompressedProductImages: []string{"local:1/a_w1024.jpg"}})
+	require.NoError(t, publish(event))
+	d := receive(t, outcomes)
+	assert.Equal(t, "product.images.processed.v1", d.RoutingKey)
+	assert.Equal(t, "application/json", d.ContentType)
+	assert.Equal(t, uint8(amqp.Persistent), d.DeliveryMode)
+	assert.Equal(t, event.ID, d.MessageId)
+	assert.Equal(t, EventImagesProcessed, d.Type)
+	assert.Equal(t, EventSource, d.AppId)
+	assert.Equal(t, int32(1), d.Headers["event_version"])
+
+	var envelope map[string]interface{}
+	require.NoError(t, json.Unmarshal(d.Body, &envelope))
+	assert.Equal(t, event.ID, envelope["id"])
+	assert.Len(t, envelope["id"], 32)
+	assert.Equal(t, "product.images.processed", envelope["type"])
+	assert.Equal(t, float64(1), envelope["version"])
+	assert.Equal(t, EventSource, envelope["source"])
+	assert.NotEmpty(t, envelope["occurred_at"])
+	assert.Equal(t, map[string]interface{}{
+		"product_id":                float64(1),
+		"user_id":                   float64(2),
+		"processing_status":         "done",
+		"compressed_product_images": []interface{}{"local:1/a_w1024.jpg"},
+	}, envelope["data"], "the error is left out of processed events")
+	receive(t, everything)
+
+	// Another version is routed by its own key, so bindings to a version keep
+	// receiving the data they expect
+	require.NoError(t, publish(NewEvent(EventImagesProcessed, 2, nil)))
+	assert.Equal(t, "product.images.processed.v2", receive(t, everything).RoutingKey)
+	assertNoDelivery(t, outcomes)
+
+	assert.NotEqual(t, event.ID, NewEvent(EventImagesProcessed, 1, nil).ID, "every event has its own ID")
+}
+
+// announcements collects the events and webhook deliveries announcing the outcome of jobs
+type announcements struct {
+	db     *sql.DB
+	events []DomainEvent
+}
+
+func (a *announcements) notifiers() Notifiers {
+	return Notifiers{Events: func(event DomainEvent) error {
+		a.events = append(a.events, event)
+		return nil
+	}}
+}
+
+// webhooks returns the events of the webhook deliveries recorded so far
+func (a *announcements) webhooks(t *testing.T) []string {
+	t.Helper()
+	rows, err := a.db.Query("SELECT event FROM WebhookDeliveries ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+	events := []string{}
+	for rows.Next() {
+		var event string
+		require.NoError(t, rows.Scan(&event))
+		events = append(events, event)
+	}
+	return events
+}
+
+// newAnnouncedDB creates the jobs database with a webhook subscription to every event
+func newAnnouncedDB(t *testing.T) (*sql.DB, *announcements) {
+	db := newJobsDB(t)
+	_, err := db.Exec("INSERT INTO WebhookSubscriptions (url, secret, events, active) VALUES ('https://example.com/hook', 'secret', ?, ?)", webhooks.EventCompleted+","+webhooks.EventFailed, true)
+	require.NoError(t, err)
+	return db, &announcements{db: db}
+}
+
+func TestHandleJobAnnouncesOutcome(t *testing.T) {
+	db, a := newAnnouncedDB(t)
+	require.NoError(t, HandleJob(db, imageutils.Config{}, a.notifiers(), Job{ProductID: 1, Key: "product:1"}))
+
+	// Webhooks and events both see the recorded status
+	assert.Equal(t, []string{webhooks.EventFailed}, a.webhooks(t))
+	require.Len(t, a.events, 1)
+	assert.Equal(t, "product.images.failed.v1", a.events[0].RoutingKey())
+	assert.Equal(t, EventImagesFailed, a.events[0].Type)
+	data := a.events[0].Data.(ProductImagesV1)
+	assert.Equal(t, database.StatusFailed, data.ProcessingStatus)
+	assert.NotEmpty(t, data.Error)
+
+	// A redelivered job that already completed is not announced again
+	require.NoError(t, database.RecordJob(db, "product:1", 1, database.JobDone, ""))
+	require.NoError(t, HandleJob(db, imageutils.Config{}, a.notifiers(), Job{ProductID: 1, Key: "product:1"}))
+	assert.Len(t, a.webhooks(t), 1)
+	assert.Len(t, a.events, 1)
+}
+
+func TestHandleJobAnnouncesRecordedOutcomeOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		breakSQL string // breaks recording the outcome once processing started
+		fixSQL   string
+	}{
+		{"product status", "ALTER TABLE Products RENAME TO BrokenProducts", "ALTER TABLE BrokenProducts RENAME TO Products"},
+		{"job", "ALTER TABLE ProcessedJobs RENAME TO BrokenJobs", "ALTER TABLE BrokenJobs RENAME TO ProcessedJobs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, a := newAnnouncedDB(t)
+			notify := a.notifiers()
+			notify.Progress = func(e ProgressEvent) {
+				if e.Status == StatusProcessing && e.Image == "" {
+					db.Exec(tt.breakSQL)
+				}
+			}
+			job := Job{ProductID: 1, Key: "product:1"}
+
+			// The job is delivered again when its outcome cannot be recorded, and
+			// nothing is announced until then
+			assert.Error(t, HandleJob(db, imageutils.Config{}, notify, job))
+			_, err := db.Exec(tt.fixSQL)
+			require.NoError(t, err)
+			assert.Empty(t, a.webhooks(t))
+			assert.Empty(t, a.events)
+
+			notify.Progress = nil
+			require.NoError(t, HandleJob(db, imageutils.Config{}, notify, job))
+			assert.Equal(t, []string{webhooks.EventFailed}, a.webhooks(t))
+			assert.Len(t, a.events, 1)
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package msgqueue
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// lockTTL bounds how long a product stays locked by a consumer that died while
+	// processing it. Running jobs renew their lease every third of it.
+	lockTTL = 10 * time.Minute
+
+	// lockPollInterval is how often a duplicate job checks whether the product lock was released
+	lockPollInterval = 2 * time.Second
+
+	// lockWaitTimeout bounds how long a duplicate job waits for the product lock
+	// before it is given back to the broker to be delivered again
+	lockWaitTimeout = 15 * time.Minute
+)
+
+// errLockLost is returned when a job's lease on its product expired and was taken
+// over while it ran, so its outcome is left to the job holding the lease now
+var errLockLost = errors.New("product lock lost while processing")
+
+// Job asks for the images of a product to be processed. Messages are either a JSON
+// job or a plain product ID.
+type Job struct {
+	ProductID int      `json:"product_id"`
+	Key       string   `json:"key,omitempty"`       // idempotency key, deliveries with the same key are processed once
+	Force     bool     `json:"force,omitempty"`     // process even if the key was already completed
+	Reprocess bool     `json:"reprocess,omitempty"` // reuse archived originals instead of downloading
+	JobID     string   `json:"job_id,omitempty"`    // reprocessing job the message belongs to
+	Images    []string `json:"images,omitempty"`    // product images to process, all of them when empty
+	// NotBefore holds the job back until then, e.g. until a product's embargo lifts
+	NotBefore *time.Time `json:"not_before,omitempty"`
+}
+
+// ParseJob decodes a message body. Jobs without a key are keyed by product, so that
+// a product created once is processed once.
+func ParseJob(body []byte) (Job, error) {
+	body = bytes.TrimSpace(body)
+	var job Job
+	if len(body) > 0 && body[0] == '{' {
+		if err := json.Unmarshal(body, &job); err != nil {
+			return Job{}, err
+		}
+		if job.ProductID <= 0 {
+			return Job{}, fmt.Errorf("invalid product_id %d", job.ProductID)
+		}
+	} else {
+		productID, err := strconv.Atoi(string(body))
+		if err != nil {
+			return Job{}, fmt.Errorf("failed to convert product_id to int: %w", err)
+		}
+		job.ProductID = productID
+	}
+	if job.Key == "" {
+		job.Key = fmt.Sprintf("product:%d", job.ProductID)
+	}
+	return job, nil
+}
+
+// Due reports whether the job may be processed at now, and if not how long it must
+// still wait
+func (j Job) Due(now time.Time) (bool, time.Duration) {
+	if j.NotBefore == nil || !j.NotBefore.After(now) {
+		return true, 0
+	}
+	return false, j.NotBefore.Sub(now)
+}
+
+// HandleJob processes a job at most once per idempotency key. Concurrent deliveries
+// for the same product wait for a per-product lock, and a job whose key already
+// completed is skipped unless it is forced. The returned error means the outcome
+// could not be recorded and the job should be delivered again; processing failures
+// are recorded and not returned.
+func HandleJob(db *sql.DB, cfg imageutils.Config, notify Notifiers, job Job) error {
+	if !job.Force {
+		done, err := database.JobCompleted(db, job.Key)
+		if err != nil {
+			return err
+		}
+		if done {
+			logrus.Infof("Skipping job %s: already completed", job.Key)
+			return nil
+		}
+	}
+
+	lease, err := waitForLock(db, job.ProductID, job.Key+"/"+randomID())
+	if err != nil {
+		return err
+	}
+	defer lease.release()
+
+	// A duplicate may have completed the job while this one waited for the lock
+	if !job.Force {
+		done, err := database.JobCompleted(db, job.Key)
+		if err != nil {
+			return err
+		}
+		if done {
+			logrus.Infof("Skipping job %s: completed by a concurrent delivery", job.Key)
+			return nil
+		}
+	}
+
+	if err := database.RecordJob(db, job.Key, job.ProductID, database.JobProcessing, ""); err != nil {
+		return err
+	}
+	tracker := newProgressTracker(notify.Progress, job.ProductID)
+	jobErr := processProduct(db, cfg, tracker, job.ProductID, job.Reprocess, job.Images)
+	status, productStatus, errMsg := database.JobDone, database.StatusDone, ""
+	if jobErr != nil {
+		status, productStatus, errMsg = database.JobFailed, database.StatusFailed, jobErr.Error()
+	}
+	if !lease.held() {
+		logrus.Errorf("Not recording job %s: %v", job.Key, errLockLost)
+		return errLockLost
+	}
+	if err := database.SetProductStatus(db, job.ProductID, productStatus); err != nil {
+		return err
+	}
+	if job.JobID != "" {
+		database.CompleteReprocessItem(db, job.JobID, job.ProductID, errMsg)
+	}
+	if err := database.RecordJob(db, job.Key, job.ProductID, status, errMsg); err != nil {
+		return err
+	}
+	// The outcome is only announced once recorded, so that a job delivered again
+	// because its outcome could not be recorded does not announce it twice
+	tracker.finish(productStatus, jobErr)
+	notify.announce(db, job.ProductID, jobErr)
+	return nil
+}
+
+// productLease is the lock of a product held by a job, renewed in the background
+// for as long as the job runs
+type productLease struct {
+	db        *sql.DB
+	productID int
+	owner     string
+	stop      chan struct{}
+	stopped   chan struct{}
+
+	mu   sync.Mutex
+	lost bool
+}
+
+// waitForLock blocks until owner holds the lock of the product, for at most
+// lockWaitTimeout, and keeps the lock renewed until it is released
+func waitForLock(db *sql.DB, productID int, owner string) (*productLease, error) {
+	deadline := time.Now().Add(lockWaitTimeout)
+	for {
+		locked, err := database.AcquireProductLock(db, productID, owner, lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("product %d still locked after %s", productID, lockWaitTimeout)
+		}
+		logrus.Infof("Product %d is being processed by another job, waiting", productID)
+		time.Sleep(lockPollInterval)
+	}
+	lease := &productLease{db: db, productID: productID, owner: owner, stop: make(chan struct{}), stopped: make(chan struct{})}
+	go lease.renew()
+	return lease, nil
+}
+
+// renew extends the lease every third of lockTTL until it is released or lost.
+// A renewal that fails is retried on the next tick, as the lease is still valid
+// until it expires.
+func (l *productLease) renew() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			renewed, err := database.RenewProductLock(l.db, l.productID, l.owner, lockTTL)
+			if err != nil {
+				logrus.Warnf("Failed to renew the lock of product %d: %v", l.productID, err)
+				continue
+			}
+			if !renewed {
+				logrus.Errorf("Lock of product %d was taken over by another job", l.productID)
+				l.mu.Lock()
+				l.lost = true
+				l.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// held reports whether the job still owns the product, checking the database so
+// that a lease lost between two renewals is noticed
+func (l *productLease) held() bool {
+	l.mu.Lock()
+	lost := l.lost
+	l.mu.Unlock()
+	if lost {
+		return false
+	}
+	renewed, err := database.RenewProductLock(l.db, l.productID, l.owner, lockTTL)
+	return err == nil && renewed
+}
+
+// release stops renewing the lease and gives it up
+func (l *productLease) release() {
+	close(l.stop)
+	<-l.stopped
+	database.ReleaseProductLock(l.db, l.productID, l.owner)
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,121 @@
+package msgqueue
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newJobsDB creates a SQLite database with the schema of init.sql and one product
+func newJobsDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../../init.sql")
+	require.NoError(t, err)
+	schemaSQL := regexp.MustCompile(`(?m)^(CREATE DATABASE|USE) .*$`).ReplaceAllString(string(schema), "")
+	schemaSQL = strings.ReplaceAll(schemaSQL, "INT PRIMARY KEY AUTO_INCREMENT", "INTEGER PRIMARY KEY AUTOINCREMENT")
+	_, err = db.Exec(schemaSQL)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO Products (product_id, user_id, product_images) VALUES (1, 1, 'ftp://example.com/a.jpg')")
+	require.NoError(t, err)
+	return db
+}
+
+// setLockTimings shortens the product lock timings for a test
+func setLockTimings(t *testing.T, ttl, poll, wait time.Duration) {
+	oldTTL, oldPoll, oldWait := lockTTL, lockPollInterval, lockWaitTimeout
+	lockTTL, lockPollInterval, lockWaitTimeout = ttl, poll, wait
+	t.Cleanup(func() { lockTTL, lockPollInterval, lockWaitTimeout = oldTTL, oldPoll, oldWait })
+}
+
+// startCounter counts the jobs that started processing
+func startCounter(started *int32) Notifiers {
+	return Notifiers{Progress: func(e ProgressEvent) {
+		if e.Status == StatusProcessing && e.Image == "" {
+			atomic.AddInt32(started, 1)
+		}
+	}}
+}
+
+func TestHandleJobSkipsCompletedJobs(t *testing.T) {
+	db := newJobsDB(t)
+	var started int32
+	notify := startCounter(&started)
+	job := Job{ProductID: 1, Key: "product:1"}
+	require.NoError(t, database.RecordJob(db, job.Key, 1, database.JobDone, ""))
+
+	require.NoError(t, HandleJob(db, imageutils.Config{}, notify, job))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&started), "a completed job is skipped")
+
+	job.Force = true
+	require.NoError(t, HandleJob(db, imageutils.Config{}, notify, job))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&started), "a forced job is processed again")
+
+	// The lock is released once the job ends
+	locked, err := database.AcquireProductLock(db, 1, "other", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, locked)
+}
+
+func TestHandleJobWaitsForLockForAWhile(t *testing.T) {
+	setLockTimings(t, time.Minute, 10*time.Millisecond, 50*time.Millisecond)
+	db := newJobsDB(t)
+	var started int32
+	locked, err := database.AcquireProductLock(db, 1, "other", time.Minute)
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	// The job gives up instead of holding a worker until the lock is released
+	err = HandleJob(db, imageutils.Config{}, startCounter(&started), Job{ProductID: 1, Key: "product:1"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&started))
+	done, _ := database.JobCompleted(db, "product:1")
+	assert.False(t, done)
+}
+
+func TestHandleJobRenewsLock(t *testing.T) {
+	setLockTimings(t, 300*time.Millisecond, 10*time.Millisecond, time.Minute)
+	db := newJobsDB(t)
+
+	// A job running for longer than the lock TTL keeps the product to itself
+	var takenOver int32
+	notify := Notifiers{Progress: func(e ProgressEvent) {
+		if e.Status != StatusProcessing || e.Image != "" {
+			return
+		}
+		time.Sleep(2 * lockTTL)
+		if locked, _ := database.AcquireProductLock(db, 1, "other", time.Minute); locked {
+			atomic.StoreInt32(&takenOver, 1)
+		}
+	}}
+	require.NoError(t, HandleJob(db, imageutils.Config{}, notify, Job{ProductID: 1, Key: "product:1"}))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&takenOver))
+}
+
+func TestHandleJobLostLock(t *testing.T) {
+	db := newJobsDB(t)
+
+	// A job whose lease was taken over does not record an outcome
+	notify := Notifiers{Progress: func(e ProgressEvent) {
+		if e.Status == StatusProcessing && e.Image == "" {
+			db.Exec("UPDATE ProductLocks SET owner = 'other' WHERE product_id = 1")
+		}
+	}}
+	err := HandleJob(db, imageutils.Config{}, notify, Job{ProductID: 1, Key: "product:1"})
+	assert.ErrorIs(t, err, errLockLost)
+	var status string
+	db.QueryRow("SELECT status FROM ProcessedJobs WHERE job_key = 'product:1'").Scan(&status)
+	assert.Equal(t, database.JobProcessing, status)
+}
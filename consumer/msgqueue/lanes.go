@@ -0,0 +1,47 @@
+package msgqueue
+
+import (
+	"os"
+	"strconv"
+)
+
+// Lanes are the queues the consumer reads jobs from and how its workers are shared
+// between them. Interactive jobs can use every worker, while bulk jobs, such as
+// imports and reprocessing, leave Reserved workers free for interactive ones.
+type Lanes struct {
+	Interactive string // queue of jobs someone is waiting for
+	Bulk        string // queue of jobs that may wait
+	Workers     int    // jobs processed at once, default 8
+	Reserved    int    // workers bulk jobs may not use, default 2
+}
+
+// LanesFromEnv reads the lanes from RM_QUEUENAME, RM_BULK_QUEUENAME, CONSUMER_WORKERS
+// and CONSUMER_RESERVED_INTERACTIVE. The bulk queue defaults to "<RM_QUEUENAME>.bulk".
+func LanesFromEnv() Lanes {
+	lanes := Lanes{Interactive: os.Getenv("RM_QUEUENAME"), Bulk: os.Getenv("RM_BULK_QUEUENAME")}
+	if lanes.Bulk == "" {
+		lanes.Bulk = lanes.Interactive + ".bulk"
+	}
+	lanes.Workers, _ = strconv.Atoi(os.Getenv("CONSUMER_WORKERS"))
+	lanes.Reserved, _ = strconv.Atoi(os.Getenv("CONSUMER_RESERVED_INTERACTIVE"))
+	return lanes.withDefaults()
+}
+
+// withDefaults fills in unset sizes and keeps at least one worker for bulk jobs
+func (l Lanes) withDefaults() Lanes {
+	if l.Workers <= 0 {
+		l.Workers = 8
+	}
+	if l.Reserved <= 0 {
+		l.Reserved = 2
+	}
+	if l.Reserved >= l.Workers {
+		l.Reserved = l.Workers - 1
+	}
+	return l
+}
+
+// bulkWorkers is the number of workers bulk jobs may use
+func (l Lanes) bulkWorkers() int {
+	return l.Workers - l.Reserved
+}
@@ -0,0 +1,140 @@
+package msgqueue
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLanesFromEnv(t *testing.T) {
+	t.Setenv("RM_QUEUENAME", "products")
+	t.Setenv("RM_BULK_QUEUENAME", "")
+	t.Setenv("CONSUMER_WORKERS", "")
+	t.Setenv("CONSUMER_RESERVED_INTERACTIVE", "")
+	lanes := LanesFromEnv()
+	assert.Equal(t, Lanes{Interactive: "products", Bulk: "products.bulk", Workers: 8, Reserved: 2}, lanes)
+	assert.Equal(t, 6, lanes.bulkWorkers())
+
+	t.Setenv("RM_BULK_QUEUENAME", "imports")
+	t.Setenv("CONSUMER_WORKERS", "4")
+	t.Setenv("CONSUMER_RESERVED_INTERACTIVE", "1")
+	lanes = LanesFromEnv()
+	assert.Equal(t, "imports", lanes.Bulk)
+	assert.Equal(t, 3, lanes.bulkWorkers())
+}
+
+func TestLanesKeepABulkWorker(t *testing.T) {
+	lanes := Lanes{Workers: 2, Reserved: 5}.withDefaults()
+	assert.Equal(t, 1, lanes.Reserved)
+	assert.Equal(t, 1, lanes.bulkWorkers())
+}
+
+func TestConsumerReservesWorkersForInteractiveJobs(t *testing.T) {
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(logrus.InfoLevel)
+	db := newJobsDB(t)
+	for id := 2; id <= 6; id++ {
+		_, err := db.Exec("INSERT INTO Products (product_id, user_id, product_images) VALUES (?, 1, 'ftp://example.com/a.jpg')", id)
+		require.NoError(t, err)
+	}
+	b := NewMemoryBroker()
+	lanes := Lanes{Interactive: "products", Bulk: "products.bulk", Workers: 3, Reserved: 1}
+
+	// Jobs hold their worker until released
+	started := make(chan int, 6)
+	release := make(chan struct{})
+	notify := Notifiers{Progress: func(e ProgressEvent) {
+		if e.Status == StatusProcessing && e.Image == "" {
+			started <- e.ProductID
+			<-release
+		}
+	}}
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, Consumer(b, lanes, db, imageutils.Config{}, notify))
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		interactive, err1 := b.QueueInspect("products")
+		bulk, err2 := b.QueueInspect("products.bulk")
+		return err1 == nil && err2 == nil && interactive.Consumers == 1 && bulk.Consumers == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	startedJob := func() int {
+		t.Helper()
+		select {
+		case id := <-started:
+			return id
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timed out waiting for a job to start")
+			return 0
+		}
+	}
+
+	// A backlog of bulk jobs only takes the workers that are not reserved
+	for id := 1; id <= 5; id++ {
+		require.NoError(t, b.Publish("", "products.bulk", false, false, amqp.Publishing{Body: []byte(strconv.Itoa(id))}))
+	}
+	assert.ElementsMatch(t, []int{1, 2}, []int{startedJob(), startedJob()})
+	select {
+	case id := <-started:
+		t.Fatalf("Bulk job %d took a reserved worker", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	bulk, _ := b.QueueInspect("products.bulk")
+	assert.Equal(t, 3, bulk.Messages, "the jobs that cannot run stay in the queue for other consumers")
+
+	// An interactive job starts right away on the reserved worker
+	require.NoError(t, b.Publish("", "products", false, false, amqp.Publishing{Body: []byte("6")}))
+	assert.Equal(t, 6, startedJob())
+
+	// The rest of the backlog runs once workers are free
+	close(release)
+	require.Eventually(t, func() bool {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM ProcessedJobs WHERE status = ?", database.JobFailed).Scan(&count)
+		return count == 6
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, b.Close())
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Consumer to return once the broker closed")
+	}
+}
+
+// brokenLaneBroker cannot declare one of the queues
+type brokenLaneBroker struct {
+	*MemoryBroker
+	broken string
+}
+
+func (b brokenLaneBroker) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if name == b.broken {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	return b.MemoryBroker.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func TestConsumerFailsWithoutBothLanes(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	lanes := Lanes{Interactive: "products", Bulk: "products.bulk"}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- Consumer(brokenLaneBroker{b, "products.bulk"}, lanes, nil, imageutils.Config{}, Notifiers{})
+	}()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, amqp.ErrClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Consumer kept running without its bulk lane")
+	}
+}
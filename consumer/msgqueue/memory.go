@@ -0,0 +1,462 @@
+package msgqueue
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// MemoryBroker is a Broker running in-process, so that the services can be tested
+// without RabbitMQ. It behaves like a single channel: messages are routed through
+// the default, direct, fanout and topic exchanges, delivered messages are held until
+// they are acknowledged, nacked and rejected messages are requeued as redelivered,
+// prefetch limits apply to the consumers started after Qos, and messages that expire
+// or are rejected without requeueing go to their queue's dead-letter exchange.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	changed   *sync.Cond        // signalled whenever a consumer may be able to take a message
+	exchanges map[string]string // kind by name
+	queues    map[string]*memoryQueue
+	bindings  []memoryBinding
+	prefetch  int
+	lastID    uint64 // numbers messages, deliveries and generated names
+	done      chan struct{}
+	closed    bool
+}
+
+type memoryQueue struct {
+	name      string
+	args      amqp.Table
+	ready     []memoryMessage
+	consumers int
+}
+
+type memoryMessage struct {
+	id       uint64
+	delivery amqp.Delivery
+}
+
+type memoryBinding struct {
+	exchange, key, queue string
+}
+
+// NewMemoryBroker returns an empty broker with only the default exchange
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]string{"": amqp.ExchangeDirect},
+		queues:    map[string]*memoryQueue{},
+		done:      make(chan struct{}),
+	}
+	b.changed = sync.NewCond(&b.mu)
+	return b
+}
+
+// ExchangeDeclare declares a direct, fanout or topic exchange
+func (b *MemoryBroker) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return &amqp.Error{Code: amqp.NotImplemented, Reason: fmt.Sprintf("exchange type %q is not supported", kind)}
+	}
+	if existing, ok := b.exchanges[name]; ok && existing != kind {
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("exchange %s is a %s exchange, not %s", name, existing, kind)}
+	}
+	b.exchanges[name] = kind
+	return nil
+}
+
+// QueueDeclare declares a queue, naming it when name is empty. Like RabbitMQ, it
+// fails when the queue exists with other arguments.
+func (b *MemoryBroker) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		b.lastID++
+		name = fmt.Sprintf("amq.gen-%d", b.lastID)
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memoryQueue{name: name, args: args}
+		b.queues[name] = q
+	} else if (len(q.args) > 0 || len(args) > 0) && !reflect.DeepEqual(q.args, args) {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("queue %s was declared with arguments %v, not %v", name, q.args, args)}
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: q.consumers}, nil
+}
+
+// QueueInspect reports the messages ready in a queue and its consumers
+func (b *MemoryBroker) QueueInspect(name string) (amqp.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: "no queue " + name}
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: q.consumers}, nil
+}
+
+// QueueBind routes the messages published to exchange with key to a queue
+func (b *MemoryBroker) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: "no queue " + name}
+	}
+	if _, ok := b.exchanges[exchange]; !ok || exchange == "" {
+		return &amqp.Error{Code: amqp.NotFound, Reason: "no exchange " + exchange}
+	}
+	binding := memoryBinding{exchange: exchange, key: key, queue: name}
+	for _, existing := range b.bindings {
+		if existing == binding {
+			return nil
+		}
+	}
+	b.bindings = append(b.bindings, binding)
+	return nil
+}
+
+// Qos limits the unacknowledged messages of the consumers started afterwards. Zero
+// means no limit.
+func (b *MemoryBroker) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	b.prefetch = prefetchCount
+	return nil
+}
+
+// Publish routes a message to the queues bound to exchange with key. Like RabbitMQ,
+// it drops messages no queue is bound for.
+func (b *MemoryBroker) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[exchange]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: "no exchange " + exchange}
+	}
+	b.route(exchange, key, msg)
+	return nil
+}
+
+// Consume starts delivering the messages of a queue. The channel is closed when the
+// broker is.
+func (b *MemoryBroker) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{Code: amqp.NotFound, Reason: "no queue " + queue}
+	}
+	if consumer == "" {
+		b.lastID++
+		consumer = fmt.Sprintf("ctag-%d", b.lastID)
+	}
+	c := &memoryConsumer{
+		broker:     b,
+		queue:      q,
+		tag:        consumer,
+		autoAck:    autoAck,
+		prefetch:   b.prefetch,
+		unacked:    map[uint64]memoryMessage{},
+		deliveries: make(chan amqp.Delivery),
+	}
+	q.consumers++
+	go c.run()
+	return c.deliveries, nil
+}
+
+// Close stops the broker and closes the delivery channels of its consumers.
+// Messages not acknowledged yet are lost.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return amqp.ErrClosed
+	}
+	b.closed = true
+	close(b.done)
+	b.changed.Broadcast()
+	return nil
+}
+
+// route adds a message to the queues bound to exchange with key
+func (b *MemoryBroker) route(exchange, key string, msg amqp.Publishing) {
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			b.enqueue(q, exchange, key, msg)
+		}
+		return
+	}
+	kind := b.exchanges[exchange]
+	routed := map[string]bool{}
+	for _, binding := range b.bindings {
+		if binding.exchange != exchange || routed[binding.queue] {
+			continue
+		}
+		if kind == amqp.ExchangeFanout || (kind == amqp.ExchangeDirect && binding.key == key) || (kind == amqp.ExchangeTopic && topicMatch(binding.key, key)) {
+			routed[binding.queue] = true
+			b.enqueue(b.queues[binding.queue], exchange, key, msg)
+		}
+	}
+}
+
+// enqueue adds a message to a queue and schedules its expiry
+func (b *MemoryBroker) enqueue(q *memoryQueue, exchange, key string, msg amqp.Publishing) {
+	b.lastID++
+	m := memoryMessage{id: b.lastID, delivery: amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Exchange:        exchange,
+		RoutingKey:      key,
+		Body:            msg.Body,
+	}}
+	q.ready = append(q.ready, m)
+	if ttl, ok := q.ttl(msg.Expiration); ok {
+		time.AfterFunc(ttl, func() { b.expire(q, m.id) })
+	}
+	b.changed.Broadcast()
+}
+
+// expire dead-letters a message if it is still waiting in its queue
+func (b *MemoryBroker) expire(q *memoryQueue, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	for i, m := range q.ready {
+		if m.id == id {
+			q.ready = append(q.ready[:i:i], q.ready[i+1:]...)
+			b.deadLetter(q, m.delivery)
+			return
+		}
+	}
+}
+
+// deadLetter routes a message that expired in or was rejected from a queue to the
+// queue's dead-letter exchange, with its dead-letter routing key if it has one. It
+// drops the message when the queue has no dead-letter exchange.
+func (b *MemoryBroker) deadLetter(q *memoryQueue, d amqp.Delivery) {
+	exchange, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := d.RoutingKey
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+	// The expiration is removed so that the message does not expire again
+	b.route(exchange, key, amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+}
+
+// ttl returns how long a message published with expiration lives in the queue, the
+// shorter of the queue's message TTL and the expiration
+func (q *memoryQueue) ttl(expiration string) (time.Duration, bool) {
+	var ttl time.Duration
+	found := false
+	if ms, ok := tableInt(q.args["x-message-ttl"]); ok {
+		ttl, found = time.Duration(ms)*time.Millisecond, true
+	}
+	if ms, err := strconv.ParseInt(expiration, 10, 64); err == nil && (!found || time.Duration(ms)*time.Millisecond < ttl) {
+		ttl, found = time.Duration(ms)*time.Millisecond, true
+	}
+	return ttl, found
+}
+
+func tableInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// topicMatch reports whether a routing key matches the binding key of a topic
+// exchange, where * stands for one word and # for zero or more
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 || (pattern[0] != "*" && pattern[0] != words[0]) {
+		return false
+	}
+	return matchWords(pattern[1:], words[1:])
+}
+
+// memoryConsumer delivers the messages of a queue and is the amqp.Acknowledger of
+// its deliveries
+type memoryConsumer struct {
+	broker     *MemoryBroker
+	queue      *memoryQueue
+	tag        string
+	autoAck    bool
+	prefetch   int
+	unacked    map[uint64]memoryMessage // by delivery tag
+	deliveries chan amqp.Delivery
+}
+
+// run delivers messages while the consumer is under its prefetch limit, until the
+// broker closes
+func (c *memoryConsumer) run() {
+	b := c.broker
+	defer func() {
+		b.mu.Lock()
+		c.queue.consumers--
+		b.mu.Unlock()
+		close(c.deliveries)
+	}()
+	for {
+		b.mu.Lock()
+		for !b.closed && !c.canTake() {
+			b.changed.Wait()
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		m := c.queue.ready[0]
+		c.queue.ready = c.queue.ready[1:]
+		b.lastID++
+		d := m.delivery
+		d.Acknowledger, d.ConsumerTag, d.DeliveryTag = c, c.tag, b.lastID
+		if !c.autoAck {
+			c.unacked[d.DeliveryTag] = m
+		}
+		b.mu.Unlock()
+
+		select {
+		case c.deliveries <- d:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (c *memoryConsumer) canTake() bool {
+	return len(c.queue.ready) > 0 && (c.autoAck || c.prefetch == 0 || len(c.unacked) < c.prefetch)
+}
+
+// Ack acknowledges a delivery, or with multiple every delivery up to it
+func (c *memoryConsumer) Ack(tag uint64, multiple bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	_, err := c.settle(tag, multiple)
+	return err
+}
+
+// Nack returns a delivery, or with multiple every delivery up to it, to the front of
+// the queue to be redelivered, or dead-letters them without requeue
+func (c *memoryConsumer) Nack(tag uint64, multiple bool, requeue bool) error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	msgs, err := c.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	if !requeue {
+		for _, m := range msgs {
+			c.broker.deadLetter(c.queue, m.delivery)
+		}
+		return nil
+	}
+	for i := range msgs {
+		msgs[i].delivery.Redelivered = true
+	}
+	c.queue.ready = append(msgs, c.queue.ready...)
+	return nil
+}
+
+// Reject is Nack for a single delivery
+func (c *memoryConsumer) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
+
+// settle removes the deliveries settled by tag from the unacknowledged ones and
+// returns their messages in delivery order
+func (c *memoryConsumer) settle(tag uint64, multiple bool) ([]memoryMessage, error) {
+	if c.broker.closed {
+		return nil, amqp.ErrClosed
+	}
+	tags := []uint64{}
+	for t := range c.unacked {
+		if t == tag || (multiple && t < tag) {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("unknown delivery tag %d", tag)}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	msgs := make([]memoryMessage, len(tags))
+	for i, t := range tags {
+		msgs[i] = c.unacked[t]
+		delete(c.unacked, t)
+	}
+	c.broker.changed.Broadcast()
+	return msgs, nil
+}
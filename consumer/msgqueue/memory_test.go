@@ -0,0 +1,186 @@
+package msgqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a delivery")
+		return amqp.Delivery{}
+	}
+}
+
+func assertNoDelivery(t *testing.T, msgs <-chan amqp.Delivery) {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		t.Fatalf("Unexpected delivery %q", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerAcknowledgements(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	_, err := b.QueueDeclare("jobs", true, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.Qos(1, 0, false))
+	msgs, err := b.Consume("jobs", "", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	for _, body := range []string{"1", "2"} {
+		require.NoError(t, b.Publish("", "jobs", false, false, amqp.Publishing{Body: []byte(body)}))
+	}
+	first := receive(t, msgs)
+	assert.Equal(t, "1", string(first.Body))
+	assert.False(t, first.Redelivered)
+	// The prefetch limit holds the second message back until the first is settled
+	assertNoDelivery(t, msgs)
+
+	require.NoError(t, first.Nack(false, true))
+	again := receive(t, msgs)
+	assert.Equal(t, "1", string(again.Body))
+	assert.True(t, again.Redelivered, "a requeued message is redelivered")
+	assert.Error(t, first.Ack(false), "a delivery is settled once")
+
+	require.NoError(t, again.Ack(false))
+	assert.Equal(t, "2", string(receive(t, msgs).Body))
+
+	q, err := b.QueueInspect("jobs")
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Messages)
+	assert.Equal(t, 1, q.Consumers)
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	require.NoError(t, b.ExchangeDeclare("events", amqp.ExchangeTopic, true, false, false, false, nil))
+	require.NoError(t, b.ExchangeDeclare("progress", amqp.ExchangeFanout, true, false, false, false, nil))
+	assert.Error(t, b.ExchangeDeclare("events", amqp.ExchangeFanout, true, false, false, false, nil), "an exchange keeps its type")
+
+	bind := func(exchange, key string) <-chan amqp.Delivery {
+		q, err := b.QueueDeclare("", false, true, true, false, nil)
+		require.NoError(t, err)
+		require.NoError(t, b.QueueBind(q.Name, key, exchange, false, nil))
+		msgs, err := b.Consume(q.Name, "", true, false, false, false, nil)
+		require.NoError(t, err)
+		return msgs
+	}
+	processed := bind("events", "product.images.*.v1")
+	everything := bind("events", "#")
+	listeners := []<-chan amqp.Delivery{bind("progress", ""), bind("progress", "")}
+
+	require.NoError(t, b.Publish("events", "product.images.processed.v1", false, false, amqp.Publishing{Body: []byte("processed")}))
+	require.NoError(t, b.Publish("events", "product.created.v1", false, false, amqp.Publishing{Body: []byte("created")}))
+	assert.Equal(t, "processed", string(receive(t, processed).Body))
+	assertNoDelivery(t, processed)
+	assert.Equal(t, "processed", string(receive(t, everything).Body))
+	assert.Equal(t, "created", string(receive(t, everything).Body))
+
+	require.NoError(t, b.Publish("progress", "", false, false, amqp.Publishing{Body: []byte("50%")}))
+	for _, msgs := range listeners {
+		assert.Equal(t, "50%", string(receive(t, msgs).Body))
+	}
+
+	assert.Error(t, b.Publish("missing", "", false, false, amqp.Publishing{}))
+	assert.NoError(t, b.Publish("", "unbound", false, false, amqp.Publishing{}), "unroutable messages are dropped")
+	_, err := b.QueueDeclare("jobs", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = b.QueueDeclare("jobs", true, false, false, false, amqp.Table{"x-max-priority": 10})
+	assert.Error(t, err, "a queue cannot be declared again with other arguments")
+}
+
+func TestMemoryBrokerDeadLetters(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	_, err := b.QueueDeclare("failed", true, false, false, false, nil)
+	require.NoError(t, err)
+	_, err = b.QueueDeclare("jobs", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "failed"})
+	require.NoError(t, err)
+	_, err = b.QueueDeclare("jobs.delay", true, false, false, false, amqp.Table{
+		"x-message-ttl":             int64(50),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "jobs",
+	})
+	require.NoError(t, err)
+	jobs, err := b.Consume("jobs", "", false, false, false, false, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, b.Publish("", "jobs.delay", false, false, amqp.Publishing{Body: []byte("later")}))
+	d := receive(t, jobs)
+	assert.Equal(t, "later", string(d.Body))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond, "a message is held until its TTL expires")
+
+	// Rejected messages go to the dead-letter exchange too
+	require.NoError(t, d.Reject(false))
+	q, _ := b.QueueInspect("failed")
+	assert.Equal(t, 1, q.Messages)
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	_, err := b.QueueDeclare("jobs", true, false, false, false, nil)
+	require.NoError(t, err)
+	msgs, err := b.Consume("jobs", "", false, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	select {
+	case _, ok := <-msgs:
+		assert.False(t, ok, "closing the broker closes the deliveries")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the deliveries to close")
+	}
+	assert.Equal(t, amqp.ErrClosed, b.Publish("", "jobs", false, false, amqp.Publishing{}))
+}
+
+func TestConsumerDefersJobsNotDue(t *testing.T) {
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(logrus.InfoLevel)
+	b := NewMemoryBroker()
+	lanes := Lanes{Interactive: "products", Bulk: "products.bulk"}
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, Consumer(b, lanes, nil, imageutils.Config{}, Notifiers{}))
+		close(done)
+	}()
+
+	notBefore := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	require.Eventually(t, func() bool {
+		q, err := b.QueueInspect("products")
+		return err == nil && q.Consumers == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, b.Publish("", "products", false, false, amqp.Publishing{Body: []byte(`{"product_id": 1, "not_before": "` + notBefore + `"}`)}))
+	require.NoError(t, b.Publish("", "products", false, false, amqp.Publishing{Body: []byte("not a job")}))
+
+	// The job waits in the longest delay queue that does not overshoot the hour, and
+	// the invalid message is dropped
+	delayQueue := DelayQueue("products", 1024*time.Second)
+	assert.Eventually(t, func() bool {
+		q, err := b.QueueInspect(delayQueue)
+		return err == nil && q.Messages == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	q, _ := b.QueueInspect("products")
+	assert.Equal(t, 0, q.Messages)
+
+	require.NoError(t, b.Close())
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected Consumer to return once the broker closed")
+	}
+}
@@ -0,0 +1,108 @@
+package msgqueue
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// StatusProcessing is the status of a product in progress events until its job ends
+const StatusProcessing = "processing"
+
+// ProgressEvent reports how far the processing of a product's images got. An event is
+// sent when a job starts, after each image and when the job ends.
+type ProgressEvent struct {
+	ProductID   int       `json:"product_id"`
+	Status      string    `json:"status"`                 // processing, done or failed
+	Image       string    `json:"image,omitempty"`        // image just processed, empty at the start and end of a job
+	ImageStatus string    `json:"image_status,omitempty"` // done or failed
+	Error       string    `json:"error,omitempty"`        // why the image or the job failed
+	Completed   int       `json:"completed"`              // images processed so far
+	Failed      int       `json:"failed"`                 // images that could not be processed
+	Total       int       `json:"total"`                  // images in the job
+	Time        time.Time `json:"time"`
+}
+
+// ProgressFunc is sent the progress events of every job
+type ProgressFunc func(ProgressEvent)
+
+// NewProgressPublisher declares the fanout exchange progress events are published
+// to and returns a ProgressFunc publishing to it. Events are transient: they are lost
+// when no one is listening, and failing to publish one does not fail the job.
+func NewProgressPublisher(ch Publisher, exchange string) (ProgressFunc, error) {
+	err := ch.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		logrus.Errorf("Failed to declare exchange %s: %v", exchange, err)
+		return nil, err
+	}
+	return func(event ProgressEvent) {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		err = ch.Publish(exchange, "", false, false, amqp.Publishing{
+			ContentType: "application/json",
+			Timestamp:   event.Time,
+			Body:        body,
+		})
+		if err != nil {
+			logrus.Warnf("Failed to publish progress of product_id %d: %v", event.ProductID, err)
+		}
+	}, nil
+}
+
+// progressTracker counts the images of a job and reports each step
+type progressTracker struct {
+	publish ProgressFunc
+	event   ProgressEvent
+}
+
+func newProgressTracker(publish ProgressFunc, productID int) *progressTracker {
+	return &progressTracker{publish: publish, event: ProgressEvent{ProductID: productID, Status: StatusProcessing}}
+}
+
+// start reports that the job began with total images
+func (t *progressTracker) start(total int) {
+	t.event.Total = total
+	t.send()
+}
+
+// image reports that an image was processed, or failed with err
+func (t *progressTracker) image(url string, err error) {
+	t.event.Image, t.event.ImageStatus, t.event.Error = url, database.StatusDone, ""
+	if err != nil {
+		t.event.ImageStatus, t.event.Error = database.StatusFailed, err.Error()
+		t.event.Failed++
+	} else {
+		t.event.Completed++
+	}
+	t.send()
+}
+
+// finish reports that the job ended with status, or failed with err
+func (t *progressTracker) finish(status string, err error) {
+	t.event.Status, t.event.Image, t.event.ImageStatus, t.event.Error = status, "", "", ""
+	if err != nil {
+		t.event.Error = err.Error()
+	}
+	t.send()
+}
+
+func (t *progressTracker) send() {
+	if t.publish == nil {
+		return
+	}
+	t.event.Time = time.Now().UTC()
+	t.publish(t.event)
+}
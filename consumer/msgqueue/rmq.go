@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/golang_backend_assignment/consumer/database"
 	"github.com/golang_backend_assignment/consumer/imageutils"
@@ -40,7 +42,85 @@ func NewChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	return ch, nil
 }
 
-func Consumer(ch *amqp.Channel, queue string, db *sql.DB, image_quality int) {
+// Consumer processes the jobs of both lanes until the broker stops delivering them,
+// and returns once the running jobs end. At most lanes.Workers jobs run at once, and
+// bulk jobs never take the workers reserved for interactive ones. It returns an error
+// without processing any job if either lane cannot be consumed.
+func Consumer(ch Broker, lanes Lanes, db *sql.DB, cfg imageutils.Config, notify Notifiers) error {
+	lanes = lanes.withDefaults()
+	type lane struct {
+		queue string
+		msgs  <-chan amqp.Delivery
+	}
+	// Each lane gets as many unacknowledged messages as it may run jobs at once, and
+	// every job takes a worker. Bulk jobs can hold at most bulkWorkers() of them, so
+	// the rest are always free for interactive jobs. Both lanes are consumed before
+	// any job runs.
+	consumed := []lane{}
+	for _, l := range []struct {
+		queue    string
+		prefetch int
+	}{{lanes.Interactive, lanes.Workers}, {lanes.Bulk, lanes.bulkWorkers()}} {
+		msgs, err := consumeQueue(ch, l.queue, l.prefetch)
+		if err != nil {
+			return err
+		}
+		consumed = append(consumed, lane{l.queue, msgs})
+	}
+
+	workers := make(chan struct{}, lanes.Workers)
+	var listening, running sync.WaitGroup
+	for _, lane := range consumed {
+		listening.Add(1)
+		go func(queue string, msgs <-chan amqp.Delivery) {
+			defer listening.Done()
+			logrus.Info("Listening for messages on queue: ", queue)
+			for d := range msgs {
+				logrus.Info("Received message: ", string(d.Body))
+				job, err := ParseJob(d.Body)
+				if err != nil {
+					logrus.Errorf("Failed to parse message: %v", err)
+					d.Reject(false)
+					continue
+				}
+				// Jobs normally reach the queue when due, but one published by a
+				// producer with a fast clock goes back to wait out the rest
+				if due, wait := job.Due(time.Now()); !due {
+					if err := deferJob(ch, queue, d, wait); err != nil {
+						d.Nack(false, true)
+						continue
+					}
+					d.Ack(false)
+					continue
+				}
+				workers <- struct{}{}
+				running.Add(1)
+				go func(d amqp.Delivery, job Job) {
+					defer func() {
+						<-workers
+						running.Done()
+					}()
+					if err := HandleJob(db, cfg, notify, job); err != nil {
+						// The job could not be recorded, let it be delivered again
+						d.Nack(false, true)
+						return
+					}
+					d.Ack(false)
+				}(d, job)
+			}
+			logrus.Warn("Stopped receiving messages on queue: ", queue)
+		}(lane.queue, lane.msgs)
+	}
+	logrus.Infof("Processing %d jobs at once, %d of them reserved for %s", lanes.Workers, lanes.Reserved, lanes.Interactive)
+
+	listening.Wait()
+	running.Wait()
+	return nil
+}
+
+// consumeQueue declares a queue and consumes it with at most prefetch messages
+// unacknowledged at a time
+func consumeQueue(ch Subscriber, queue string, prefetch int) (<-chan amqp.Delivery, error) {
 	_, err := ch.QueueDeclare(
 		queue, // queue name
 		true,  // durable
@@ -51,49 +131,108 @@ func Consumer(ch *amqp.Channel, queue string, db *sql.DB, image_quality int) {
 	)
 	if err != nil {
 		logrus.Errorf("Failed to declare queue: %v", err)
-		return
+		return nil, err
 	}
-	msgs, _ := ch.Consume(
+	// The limit applies to the consumers started on the channel after it is set
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		logrus.Errorf("Failed to set the prefetch count of %s: %v", queue, err)
+		return nil, err
+	}
+	// Messages are acknowledged once handled, so a consumer that dies mid-job
+	// leaves them to be redelivered
+	msgs, err := ch.Consume(
 		queue,
 		"",
-		true,
+		false, // auto-ack
 		false,
 		false,
 		false,
 		nil,
 	)
+	if err != nil {
+		logrus.Errorf("Failed to consume queue: %v", err)
+		return nil, err
+	}
+	return msgs, nil
+}
 
-	forever := make(chan bool)
-	go func() {
-		logrus.Info("Listening for messages on queue: ", queue)
-		for d := range msgs {
-			product_id_str := string(d.Body)
-			logrus.Info("Received message: ", product_id_str)
-			// Spawn a new goroutine to process the message
-			go func(product_id_str string) {
-				product_id, err := strconv.Atoi(product_id_str)
-				if err != nil {
-					logrus.Errorf("Failed to convert product_id to int: %v", err)
-					return
-				}
-				image_urls, err := database.GetProductImages(product_id, db)
-				if err != nil {
-					logrus.Errorf("Error in fetching product images from db: %v", err)
-					return
-				}
-				err, compressedImagePaths := imageutils.DownloadResizeCompressSaveImages(image_urls, image_quality, product_id_str)
-				if err != nil {
-					logrus.Errorf("Error in DownloadResizeCompressSaveImages: %v", err)
-					return
-				}
-				err = database.UpdateProductImages(db, product_id, compressedImagePaths)
-				if err != nil {
-					logrus.Errorf("Error in updating product images in db: %v", err)
-					return
-				}
-			}(product_id_str)
+// processProduct downloads, compresses and stores the images of a product and records
+// the results. With useArchive set, archived originals are read from storage instead
+// of downloading the source URLs again. When only is not empty just those images are
+// processed, and their outputs are merged with those of the product's other images.
+// The progress is reported to tracker, while the outcome is left to the caller.
+func processProduct(db *sql.DB, cfg imageutils.Config, tracker *progressTracker, product_id int, useArchive bool, only []string) error {
+	image_urls, err := database.GetProductImages(product_id, db)
+	if err != nil {
+		logrus.Errorf("Error in fetching product images from db: %v", err)
+		return err
+	}
+	partial := len(only) > 0
+	if partial {
+		image_urls = selectImages(image_urls, only)
+	}
+	if useArchive {
+		originals, err := database.GetArchivedOriginals(db, product_id)
+		if err != nil {
+			logrus.Errorf("Error in fetching archived originals from db: %v", err)
+			return err
+		}
+		cfg.Originals = map[string]imageutils.ArchivedOriginal{}
+		for url, orig := range originals {
+			cfg.Originals[url] = imageutils.ArchivedOriginal(orig)
+		}
+	}
+	tracker.start(len(image_urls))
+	cfg.Progress = tracker.image
+	err, compressedImages := imageutils.DownloadResizeCompressSaveImages(image_urls, cfg, strconv.Itoa(product_id))
+	if err != nil {
+		logrus.Errorf("Error in DownloadResizeCompressSaveImages: %v", err)
+		return err
+	}
+	if len(image_urls) > 0 && len(compressedImages) == 0 {
+		return fmt.Errorf("none of the %d images of product_id %d could be processed", len(image_urls), product_id)
+	}
+	compressedImagePaths := []string{}
+	records := []database.CompressedImage{}
+	for _, img := range compressedImages {
+		compressedImagePaths = append(compressedImagePaths, img.Ref().String())
+		records = append(records, database.CompressedImage(img))
+	}
+	if !partial {
+		err = database.UpdateProductImages(db, product_id, compressedImagePaths)
+		if err != nil {
+			logrus.Errorf("Error in updating product images in db: %v", err)
+			return err
+		}
+	}
+	err = database.InsertCompressedImages(db, product_id, records)
+	if err != nil {
+		logrus.Errorf("Error in recording compressed images in db: %v", err)
+		return err
+	}
+	if partial {
+		// Merge the new outputs with those of the images processed before
+		err = database.RebuildCompressedProductImages(db, product_id)
+		if err != nil {
+			logrus.Errorf("Error in updating product images in db: %v", err)
+			return err
 		}
-	}()
+	}
+	return nil
+}
 
-	<-forever
+// selectImages returns the images of a product that are in only, in product order.
+// Images removed from the product since the job was queued are dropped.
+func selectImages(images []string, only []string) []string {
+	wanted := map[string]bool{}
+	for _, image := range only {
+		wanted[image] = true
+	}
+	selected := []string{}
+	for _, image := range images {
+		if wanted[image] {
+			selected = append(selected, image)
+		}
+	}
+	return selected
 }
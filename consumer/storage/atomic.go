@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tempPrefix marks files that are still being written by WriteFileAtomic
+const tempPrefix = ".tmp-"
+
+// syncFile is replaced in tests to simulate fsync failures
+var syncFile = func(f *os.File) error {
+	return f.Sync()
+}
+
+// WriteFileAtomic writes r to path so that readers only ever see the old file or the
+// complete new one. Data goes to a temp file in the same directory, which is fsynced
+// and renamed into place before the directory itself is fsynced.
+func WriteFileAtomic(path string, r io.Reader) (err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, tempPrefix+name+"-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if err = syncFile(f); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that a rename inside it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return syncFile(d)
+}
+
+// CleanupTempFiles removes temp files under root left behind by writes that never
+// finished, e.g. because the process crashed. Files modified within olderThan are
+// kept as they may belong to a write still in progress.
+func CleanupTempFiles(root string, olderThan time.Duration) (int, error) {
+	removed := 0
+	cutoff := time.Now().Add(-olderThan)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		logrus.Warnf("Removed stale temp file %s", p)
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingReader returns n bytes of data and then an error, like a connection dropping mid-write
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 0xff
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+// tempFiles lists the temp files left in dir
+func tempFiles(t *testing.T, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	assert.NoError(t, err)
+	return matches
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "image.jpg")
+
+	assert.NoError(t, WriteFileAtomic(path, bytes.NewReader([]byte("original"))))
+
+	// A write that fails part way leaves the previous file untouched and no temp file behind
+	err := WriteFileAtomic(path, &failingReader{n: 4096})
+	assert.Error(t, err)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("original"), data)
+	assert.Empty(t, tempFiles(t, dir))
+
+	// A failed fsync is treated like a failed write
+	syncFile = func(f *os.File) error { return errors.New("disk full") }
+	err = WriteFileAtomic(path, bytes.NewReader([]byte("replacement")))
+	syncFile = func(f *os.File) error { return f.Sync() }
+	assert.Error(t, err)
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("original"), data)
+	assert.Empty(t, tempFiles(t, dir))
+
+	// A successful write replaces the file
+	assert.NoError(t, WriteFileAtomic(path, bytes.NewReader([]byte("replacement"))))
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("replacement"), data)
+}
+
+func TestLocalPutFailure(t *testing.T) {
+	s, err := NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+
+	// A new key that fails mid-write never becomes visible
+	err = s.Put(context.Background(), "1/abc_w1024.jpg", io.MultiReader(bytes.NewReader([]byte("partial")), &failingReader{}), -1, "image/jpeg")
+	assert.Error(t, err)
+	_, err = s.Stat(context.Background(), "1/abc_w1024.jpg")
+	assert.ErrorIs(t, err, ErrNotFound)
+	objects, err := s.List(context.Background(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestCleanupTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "1"), os.ModePerm))
+
+	// Simulate a crash that left a temp file behind next to a completed image
+	stale := filepath.Join(dir, "1", tempPrefix+"abc_w1024.jpg-123")
+	fresh := filepath.Join(dir, "1", tempPrefix+"def_w1024.jpg-456")
+	done := filepath.Join(dir, "1", "ghi_w1024.jpg")
+	for _, p := range []string{stale, fresh, done} {
+		assert.NoError(t, os.WriteFile(p, []byte("data"), 0644))
+	}
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(stale, old, old))
+	assert.NoError(t, os.Chtimes(done, old, old))
+
+	// Starting a Local backend removes only the stale temp file
+	_, err := NewLocal(dir, "")
+	assert.NoError(t, err)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "Stale temp file should be removed")
+	_, err = os.Stat(fresh)
+	assert.NoError(t, err, "Temp file of a write in progress should be kept")
+	_, err = os.Stat(done)
+	assert.NoError(t, err, "Completed images should be kept")
+}
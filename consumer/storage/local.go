@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local stores objects as files under a root directory
+type Local struct {
+	root      string
+	publicURL string
+}
+
+// staleTempAge is how old a temp file must be before NewLocal treats it as left over from a crash
+const staleTempAge = 15 * time.Minute
+
+// NewLocal creates a Local backend rooted at dir, creating it if needed and removing
+// stale temp files from interrupted writes. When publicURL is set, URL returns
+// publicURL joined with the key, otherwise the file path.
+func NewLocal(dir string, publicURL string) (*Local, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if _, err := CleanupTempFiles(dir, staleTempAge); err != nil {
+		return nil, err
+	}
+	return &Local{root: dir, publicURL: strings.TrimRight(publicURL, "/")}, nil
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+// path maps a key to a file path under the root
+func (l *Local) path(key string) (string, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	return WriteFileAtomic(p, r)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, notFound(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, l.info(key, st), nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	return notFound(os.Remove(p))
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if st.IsDir() {
+		return nil, ErrNotFound
+	}
+	return l.info(key, st), nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	// Only the deepest directory the prefix names is walked, as every key under the
+	// prefix is in it
+	start := l.root
+	if dir := path.Dir(prefix); dir != "." {
+		p, err := l.path(dir)
+		if err != nil {
+			// No stored key has the prefix of an invalid one
+			return objects, nil
+		}
+		start = p
+	}
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *l.info(key, st))
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) && start != l.root {
+		return objects, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (l *Local) URL(key string) string {
+	if l.publicURL != "" {
+		return l.publicURL + "/" + (&url.URL{Path: key}).EscapedPath()
+	}
+	p, err := l.path(key)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+func (l *Local) info(key string, st fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:         key,
+		Size:        st.Size(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+		ModTime:     st.ModTime(),
+	}
+}
+
+// notFound translates missing-file errors into ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config configures an S3 backend
+type S3Config struct {
+	Endpoint  string // e.g. http://localhost:9000 for MinIO or https://s3.eu-west-1.amazonaws.com
+	Region    string // default us-east-1
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // prepended to every key, e.g. "product_imgs/"
+	PublicURL string // if set, URL returns PublicURL joined with the key
+	Client    *http.Client
+}
+
+// S3 stores objects in an S3-compatible bucket using path-style requests signed with AWS Signature Version 4
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+// NewS3 creates an S3 backend
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage requires an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 60 * time.Second}
+	}
+	cfg.PublicURL = strings.TrimRight(cfg.PublicURL, "/")
+	return &S3{cfg: cfg, endpoint: endpoint, now: time.Now}, nil
+}
+
+func (s *S3) Name() string {
+	return "s3"
+}
+
+// objectPath returns the path-style request path for a key
+func (s *S3) objectPath(key string) string {
+	return "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+}
+
+func (s *S3) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, s.now())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %d %s: %s", req.Method, req.URL.Path, resp.StatusCode, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: unexpected status %d", req.Method, req.URL.Path, resp.StatusCode)
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	// S3 needs the length up front, so bodies of unknown size are buffered
+	if size < 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, s.objectPath(key), nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := s.newRequest(ctx, http.MethodGet, s.objectPath(key), nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, objectInfo(key, resp), nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest(ctx, http.MethodDelete, s.objectPath(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(ctx, http.MethodHead, s.objectPath(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp), nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.cfg.Prefix+prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "/"+s.cfg.Bucket, query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(c.Key, s.cfg.Prefix),
+				Size:    c.Size,
+				ETag:    c.ETag,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) URL(key string) string {
+	if s.cfg.PublicURL != "" {
+		return s.cfg.PublicURL + "/" + uriEncode(key, false)
+	}
+	return strings.TrimRight(s.endpoint.String(), "/") + uriEncode(s.objectPath(key), false)
+}
+
+func objectInfo(key string, resp *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:         key,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Host, Range, Content-Type and all x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters, and slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
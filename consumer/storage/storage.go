@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the backend
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is returned for keys that are empty or try to escape the backend's root
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+}
+
+// Storage is a blob store that compressed images are written to and served from.
+// Keys are slash-separated paths relative to the backend's root.
+type Storage interface {
+	// Name identifies the backend in stored references, e.g. "local" or "s3"
+	Name() string
+	// Put stores r under key. size may be -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key. The caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// List returns the objects whose keys start with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// URL returns where clients can fetch the object from
+	URL(key string) string
+}
+
+// Ref points at an object in a named backend. It is stored in the database as "backend:key".
+type Ref struct {
+	Backend string
+	Key     string
+}
+
+func (r Ref) String() string {
+	return r.Backend + ":" + r.Key
+}
+
+// ParseRef parses a reference written by Ref.String
+func ParseRef(s string) (Ref, error) {
+	backend, key, ok := strings.Cut(s, ":")
+	if !ok || backend == "" || key == "" {
+		return Ref{}, fmt.Errorf("%w: malformed reference %q", ErrInvalidKey, s)
+	}
+	return Ref{Backend: backend, Key: key}, nil
+}
+
+// UploadsPrefix is the folder holding the files uploaded for a product. Only keys
+// under it are read as the uploads of the product, so a product cannot reference
+// the files of another one.
+func UploadsPrefix(productID string) string {
+	return "uploads/" + productID + "/"
+}
+
+// CleanKey validates a key and normalises its separators
+func CleanKey(key string) (string, error) {
+	key = strings.TrimLeft(strings.ReplaceAll(key, "\\", "/"), "/")
+	if key == "" {
+		return "", ErrInvalidKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return key, nil
+}
+
+// FromEnv creates the backend selected by STORAGE_BACKEND ("local" by default or "s3")
+func FromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		dir := os.Getenv("STORAGE_LOCAL_DIR")
+		if dir == "" {
+			dir = "product_imgs"
+		}
+		return NewLocal(dir, os.Getenv("STORAGE_PUBLIC_URL"))
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			PublicURL: os.Getenv("STORAGE_PUBLIC_URL"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBackend runs the behaviour every Storage implementation must share
+func testBackend(t *testing.T, s Storage) {
+	ctx := context.Background()
+	data := []byte("compressed image bytes")
+
+	assert.NoError(t, s.Put(ctx, "1/abc_w1024.jpg", bytes.NewReader(data), int64(len(data)), "image/jpeg"))
+	assert.NoError(t, s.Put(ctx, "1/def_w1024.jpg", bytes.NewReader(data), -1, "image/jpeg"))
+	assert.NoError(t, s.Put(ctx, "2/abc_w1024.jpg", bytes.NewReader(data), int64(len(data)), "image/jpeg"))
+
+	r, info, err := s.Get(ctx, "1/abc_w1024.jpg")
+	if assert.NoError(t, err) {
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+		assert.Equal(t, int64(len(data)), info.Size)
+		assert.Equal(t, "image/jpeg", info.ContentType)
+	}
+
+	info, err = s.Stat(ctx, "1/def_w1024.jpg")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(data)), info.Size)
+	}
+
+	objects, err := s.List(ctx, "1/")
+	assert.NoError(t, err)
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"1/abc_w1024.jpg", "1/def_w1024.jpg"}, keys)
+
+	assert.NoError(t, s.Delete(ctx, "1/abc_w1024.jpg"))
+	_, err = s.Stat(ctx, "1/abc_w1024.jpg")
+	assert.True(t, errors.Is(err, ErrNotFound), "Expected ErrNotFound after delete, got %v", err)
+	_, _, err = s.Get(ctx, "missing.jpg")
+	assert.True(t, errors.Is(err, ErrNotFound), "Expected ErrNotFound for missing key, got %v", err)
+
+	assert.ErrorIs(t, s.Put(ctx, "../escape.jpg", bytes.NewReader(data), -1, ""), ErrInvalidKey)
+	assert.NotEmpty(t, s.URL("2/abc_w1024.jpg"))
+}
+
+func TestLocal(t *testing.T) {
+	s, err := NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	testBackend(t, s)
+
+	s, err = NewLocal(t.TempDir(), "https://cdn.example.com/images/")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/images/1/a%20b.jpg", s.URL("1/a b.jpg"))
+}
+
+func TestLocalList(t *testing.T) {
+	s, err := NewLocal(t.TempDir(), "")
+	assert.NoError(t, err)
+	ctx := context.Background()
+	for _, key := range []string{"1/a.jpg", "1/originals/a.jpg", "12/b.jpg", "uploads/1/c.png", "top.jpg"} {
+		assert.NoError(t, s.Put(ctx, key, bytes.NewReader([]byte("data")), 4, ""))
+	}
+	list := func(prefix string) []string {
+		objects, err := s.List(ctx, prefix)
+		assert.NoError(t, err)
+		keys := []string{}
+		for _, o := range objects {
+			keys = append(keys, o.Key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	assert.Equal(t, []string{"1/a.jpg", "1/originals/a.jpg", "12/b.jpg", "top.jpg", "uploads/1/c.png"}, list(""))
+	assert.Equal(t, []string{"1/a.jpg", "1/originals/a.jpg", "12/b.jpg"}, list("1"))
+	assert.Equal(t, []string{"1/a.jpg", "1/originals/a.jpg"}, list("1/"))
+	assert.Equal(t, []string{"1/originals/a.jpg"}, list("1/orig"))
+	assert.Equal(t, []string{"uploads/1/c.png"}, list("uploads/1/"))
+	assert.Empty(t, list("uploads/2/"), "a missing directory has no keys")
+	assert.Empty(t, list("1/a.jpg/"), "a file is no directory")
+	assert.Empty(t, list("../"), "no key is outside the root")
+}
+
+// TestS3MinIO runs against a real S3-compatible server when S3_TEST_ENDPOINT is set, e.g.
+// S3_TEST_ENDPOINT=http://localhost:9000 S3_TEST_BUCKET=images S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin
+func TestS3MinIO(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	s, err := NewS3(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+		Prefix:    "storage-test/",
+	})
+	assert.NoError(t, err)
+	testBackend(t, s)
+}
+
+func TestRef(t *testing.T) {
+	ref := Ref{Backend: "s3", Key: "1/abc_w1024.jpg"}
+	assert.Equal(t, "s3:1/abc_w1024.jpg", ref.String())
+
+	parsed, err := ParseRef(ref.String())
+	assert.NoError(t, err)
+	assert.Equal(t, ref, parsed)
+
+	_, err = ParseRef("no-backend")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestCleanKey(t *testing.T) {
+	key, err := CleanKey("/1\\abc.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, "1/abc.jpg", key)
+
+	for _, bad := range []string{"", "1/../../etc/passwd", "1//a.jpg", "./a.jpg"} {
+		_, err := CleanKey(bad)
+		assert.ErrorIs(t, err, ErrInvalidKey, "key %q", bad)
+	}
+}
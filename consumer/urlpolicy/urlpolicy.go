@@ -0,0 +1,185 @@
+package urlpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked is wrapped by every error returned for a URL or address the policy rejects
+var ErrBlocked = errors.New("blocked by url policy")
+
+// Policy decides which user-supplied URLs may be fetched
+type Policy struct {
+	AllowedSchemes  []string // default http and https
+	AllowedHosts    []string // if set, only these hosts and their subdomains are allowed
+	DeniedHosts     []string // these hosts and their subdomains are always rejected
+	AllowPrivateIPs bool     // allow loopback, private, link-local and other non-public addresses
+	MaxRedirects    int      // default 5
+}
+
+// Default is a policy that only allows http(s) URLs resolving to public addresses
+var Default = &Policy{
+	AllowedSchemes: []string{"http", "https"},
+	MaxRedirects:   5,
+}
+
+// FromEnv builds a policy from the URL_* environment variables, using Default for unset values
+func FromEnv() *Policy {
+	p := *Default
+	if v := os.Getenv("URL_ALLOWED_SCHEMES"); v != "" {
+		p.AllowedSchemes = splitList(v)
+	}
+	p.AllowedHosts = splitList(os.Getenv("URL_ALLOWED_HOSTS"))
+	p.DeniedHosts = splitList(os.Getenv("URL_DENIED_HOSTS"))
+	p.AllowPrivateIPs, _ = strconv.ParseBool(os.Getenv("URL_ALLOW_PRIVATE_IPS"))
+	if n, err := strconv.Atoi(os.Getenv("URL_MAX_REDIRECTS")); err == nil {
+		p.MaxRedirects = n
+	}
+	return &p
+}
+
+func splitList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// matchHost reports whether host is one of hosts or a subdomain of one of them
+func matchHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckURL validates the scheme and host of a URL without resolving it.
+// Hosts given as IP literals are checked against the address rules as well.
+func (p *Policy) CheckURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	allowed := false
+	for _, s := range p.AllowedSchemes {
+		if scheme == s {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrBlocked, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrBlocked)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: credentials in url are not allowed", ErrBlocked)
+	}
+	if matchHost(host, p.DeniedHosts) {
+		return fmt.Errorf("%w: host %q is denied", ErrBlocked, host)
+	}
+	if len(p.AllowedHosts) > 0 && !matchHost(host, p.AllowedHosts) {
+		return fmt.Errorf("%w: host %q is not in the allow list", ErrBlocked, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckString parses and validates a URL
+func (p *Policy) CheckString(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	return p.CheckURL(u)
+}
+
+// cgnat is the carrier-grade NAT range, which is not covered by net.IP.IsPrivate
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// CheckIP rejects loopback, private, link-local, multicast and unspecified addresses
+// unless the policy allows private IPs
+func (p *Policy) CheckIP(ip net.IP) error {
+	if p.AllowPrivateIPs {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if ip[0] == 0 || cgnat.Contains(ip) {
+			return fmt.Errorf("%w: address %s is not public", ErrBlocked, ip)
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: address %s is not public", ErrBlocked, ip)
+	}
+	return nil
+}
+
+// Resolve validates a URL and checks every address its host resolves to
+func (p *Policy) Resolve(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	if err := p.CheckURL(u); err != nil {
+		return err
+	}
+	if p.AllowPrivateIPs || net.ParseIP(u.Hostname()) != nil {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if err := p.CheckIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialControl can be used as net.Dialer.Control to check the resolved address of
+// every connection, which also covers redirects and DNS rebinding
+func (p *Policy) DialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBlocked, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: unresolved address %q", ErrBlocked, host)
+	}
+	return p.CheckIP(ip)
+}
+
+// Dialer returns a net.Dialer that refuses connections to addresses the policy rejects
+func (p *Policy) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: p.DialControl}
+}
+
+// CheckRedirect can be used as http.Client.CheckRedirect to limit redirects and
+// validate every URL in the redirect chain
+func (p *Policy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrBlocked, p.MaxRedirects)
+	}
+	return p.CheckURL(req.URL)
+}
@@ -0,0 +1,247 @@
+// Package webhooks notifies subscribed endpoints when the images of a product have
+// been processed. Events are recorded as deliveries in the database and sent by a
+// Dispatcher, which retries failed deliveries with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/sirupsen/logrus"
+)
+
+// Events sent to subscriptions
+const (
+	EventCompleted = "product.images.completed"
+	EventFailed    = "product.images.failed"
+)
+
+// Headers set on every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature" // "sha256=" and the hex HMAC of "<timestamp>.<body>"
+	TimestampHeader = "X-Webhook-Timestamp" // Unix time the delivery was sent at
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery" // delivery ID, the same for every retry
+)
+
+// Payload is the JSON body of a delivery
+type Payload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      ProductData `json:"data"`
+}
+
+// ProductData describes the product an event is about
+type ProductData struct {
+	ProductID               int      `json:"product_id"`
+	UserID                  int      `json:"user_id"`
+	ProcessingStatus        string   `json:"processing_status"`
+	CompressedProductImages []string `json:"compressed_product_images"`
+	Error                   string   `json:"error,omitempty"`
+}
+
+// Enqueue records a delivery of event for every subscription to it that covers the
+// product. errMsg describes why processing failed, for EventFailed. It returns the
+// number of deliveries recorded.
+func Enqueue(db *sql.DB, productID int, event string, errMsg string) (int, error) {
+	product, err := database.GetProductEvent(db, productID)
+	if err != nil {
+		return 0, err
+	}
+	subs, err := database.FindWebhookSubscriptions(db, product.UserID, event)
+	if err != nil || len(subs) == 0 {
+		return 0, err
+	}
+	payload, err := json.Marshal(Payload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data: ProductData{
+			ProductID:               product.ProductID,
+			UserID:                  product.UserID,
+			ProcessingStatus:        product.ProcessingStatus,
+			CompressedProductImages: product.CompressedImages,
+			Error:                   errMsg,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, sub := range subs {
+		if _, err := database.InsertWebhookDelivery(db, sub.ID, event, productID, payload); err != nil {
+			return 0, err
+		}
+	}
+	logrus.Infof("Queued %s for product_id %d to %d webhooks", event, productID, len(subs))
+	return len(subs), nil
+}
+
+// Sign returns the signature of a delivery body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Options configures a Dispatcher. Zero values use the defaults.
+type Options struct {
+	MaxAttempts int           // attempts before a delivery is marked failed, default 8
+	Backoff     time.Duration // wait after the first failed attempt, doubled after each one, default 30s
+	MaxBackoff  time.Duration // longest wait between attempts, default 1h
+	Timeout     time.Duration // time allowed for an endpoint to respond, default 10s
+	BatchSize   int           // deliveries sent per poll, default 50
+}
+
+// Dispatcher sends due deliveries to their endpoints
+type Dispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	policy *urlpolicy.Policy
+	opts   Options
+}
+
+// NewDispatcher returns a Dispatcher that only sends to URLs allowed by policy
+func NewDispatcher(db *sql.DB, policy *urlpolicy.Policy, opts Options) *Dispatcher {
+	if policy == nil {
+		policy = urlpolicy.Default
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 8
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 30 * time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Hour
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 50
+	}
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: &http.Transport{DialContext: policy.Dialer(opts.Timeout).DialContext},
+		// Endpoints must answer themselves, a redirect counts as a failure
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return &Dispatcher{db: db, client: client, policy: policy, opts: opts}
+}
+
+// Run sends due deliveries every interval until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.DeliverDue(ctx); err != nil {
+			logrus.Errorf("Error delivering webhooks: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue sends the deliveries whose next attempt is due and returns how many
+// were attempted
+func (d *Dispatcher) DeliverDue(ctx context.Context) (int, error) {
+	due, err := database.DueWebhookDeliveries(d.db, time.Now(), d.opts.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, delivery := range due {
+		// Hold the delivery for longer than an attempt can take
+		claimed, err := database.ClaimWebhookDelivery(d.db, delivery, time.Now().Add(d.opts.Timeout+time.Minute))
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := d.deliver(ctx, delivery); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// deliver makes one attempt and records its outcome
+func (d *Dispatcher) deliver(ctx context.Context, delivery database.WebhookDelivery) error {
+	start := time.Now()
+	attempt := database.WebhookAttempt{}
+	status, err := d.send(ctx, delivery)
+	attempt.ResponseStatus = status
+	attempt.Duration = time.Since(start)
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("endpoint responded with status %d", status)
+	}
+
+	if err == nil {
+		logrus.Infof("Delivered webhook %d (%s) to %s", delivery.ID, delivery.Event, delivery.Subscription.URL)
+		return database.RecordWebhookAttempt(d.db, delivery.ID, attempt, database.DeliveryDelivered, time.Now())
+	}
+	attempt.Error = err.Error()
+	attempts := delivery.Attempts + 1
+	if attempts >= d.opts.MaxAttempts {
+		logrus.Errorf("Giving up on webhook %d to %s after %d attempts: %v", delivery.ID, delivery.Subscription.URL, attempts, err)
+		return database.RecordWebhookAttempt(d.db, delivery.ID, attempt, database.DeliveryFailed, time.Now())
+	}
+	next := time.Now().Add(d.backoff(attempts))
+	logrus.Warnf("Webhook %d to %s failed, retrying at %s: %v", delivery.ID, delivery.Subscription.URL, next.Format(time.RFC3339), err)
+	return database.RecordWebhookAttempt(d.db, delivery.ID, attempt, database.DeliveryPending, next)
+}
+
+// backoff is the wait after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.opts.Backoff
+	for i := 1; i < attempts && wait < d.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.opts.MaxBackoff {
+		wait = d.opts.MaxBackoff
+	}
+	return wait
+}
+
+// send posts a delivery and returns the response status
+func (d *Dispatcher) send(ctx context.Context, delivery database.WebhookDelivery) (int, error) {
+	if err := d.policy.CheckString(delivery.Subscription.URL); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "image-crunch-webhooks")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Subscription.Secret, timestamp, delivery.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/database"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPolicy allows sending to httptest servers on the loopback interface
+var testPolicy = &urlpolicy.Policy{
+	AllowedSchemes:  []string{"http"},
+	AllowPrivateIPs: true,
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+		CREATE TABLE Products (product_id INTEGER PRIMARY KEY, user_id INTEGER, processing_status TEXT, compressed_product_images TEXT);
+		CREATE TABLE WebhookSubscriptions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NULL, url TEXT, secret TEXT, events TEXT, active BOOLEAN DEFAULT TRUE, created_at DATETIME);
+		CREATE TABLE WebhookDeliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, subscription_id INTEGER, event TEXT, product_id INTEGER, payload TEXT, status TEXT, attempts INTEGER DEFAULT 0, response_status INTEGER DEFAULT 0, last_error TEXT, next_attempt_at DATETIME, created_at DATETIME, updated_at DATETIME);
+		CREATE TABLE WebhookAttempts (id INTEGER PRIMARY KEY AUTOINCREMENT, delivery_id INTEGER, response_status INTEGER, error TEXT, duration_ms INTEGER, attempted_at DATETIME);
+		INSERT INTO Products VALUES (1, 7, 'completed', 'a.jpg,b.jpg');
+	`)
+	require.NoError(t, err)
+	return db
+}
+
+func subscribe(t *testing.T, db *sql.DB, url string, events string) {
+	_, err := db.Exec("INSERT INTO WebhookSubscriptions (user_id, url, secret, events, active) VALUES (7, ?, 'secret', ?, 1)", url, events)
+	require.NoError(t, err)
+}
+
+// received is a request recorded by a test endpoint
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// newEndpoint returns a server that responds with the given statuses in turn,
+// repeating the last one, and records the requests it receives
+func newEndpoint(t *testing.T, statuses ...int) (*httptest.Server, *[]received) {
+	var mu sync.Mutex
+	requests := []received{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, received{header: r.Header.Clone(), body: body})
+		status := statuses[len(statuses)-1]
+		if len(requests) <= len(statuses) {
+			status = statuses[len(requests)-1]
+		}
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// makeDue moves the next attempt of every pending delivery into the past
+func makeDue(t *testing.T, db *sql.DB) {
+	_, err := db.Exec("UPDATE WebhookDeliveries SET next_attempt_at = ?", time.Now().Add(-time.Second).Format("2006-01-02 15:04:05"))
+	require.NoError(t, err)
+}
+
+func deliveryState(t *testing.T, db *sql.DB) (string, int) {
+	var status string
+	var attempts int
+	require.NoError(t, db.QueryRow("SELECT status, attempts FROM WebhookDeliveries").Scan(&status, &attempts))
+	return status, attempts
+}
+
+func TestSign(t *testing.T) {
+	sig := Sign("secret", 1700000000, []byte(`{"event":"x"}`))
+	assert.Equal(t, "sha256=", sig[:7])
+	assert.Len(t, sig, 7+64)
+	assert.Equal(t, sig, Sign("secret", 1700000000, []byte(`{"event":"x"}`)))
+	assert.NotEqual(t, sig, Sign("other", 1700000000, []byte(`{"event":"x"}`)))
+	assert.NotEqual(t, sig, Sign("secret", 1700000001, []byte(`{"event":"x"}`)))
+}
+
+func TestEnqueue(t *testing.T) {
+	db := newTestDB(t)
+	subscribe(t, db, "http://a", EventCompleted)
+	subscribe(t, db, "http://b", EventFailed)
+
+	n, err := Enqueue(db, 1, EventCompleted, "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	var raw string
+	require.NoError(t, db.QueryRow("SELECT payload FROM WebhookDeliveries").Scan(&raw))
+	var payload Payload
+	require.NoError(t, json.Unmarshal([]byte(raw), &payload))
+	assert.Equal(t, EventCompleted, payload.Event)
+	assert.Equal(t, 1, payload.Data.ProductID)
+	assert.Equal(t, 7, payload.Data.UserID)
+	assert.Equal(t, []string{"a.jpg", "b.jpg"}, payload.Data.CompressedProductImages)
+
+	n, err = Enqueue(db, 1, "product.other", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestDeliverSigned(t *testing.T) {
+	db := newTestDB(t)
+	server, requests := newEndpoint(t, http.StatusOK)
+	subscribe(t, db, server.URL, EventCompleted)
+	_, err := Enqueue(db, 1, EventCompleted, "")
+	require.NoError(t, err)
+
+	d := NewDispatcher(db, testPolicy, Options{})
+	sent, err := d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	require.Len(t, *requests, 1)
+	req := (*requests)[0]
+	timestamp, err := strconv.ParseInt(req.header.Get(TimestampHeader), 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, Sign("secret", timestamp, req.body), req.header.Get(SignatureHeader))
+	assert.Equal(t, EventCompleted, req.header.Get(EventHeader))
+	assert.Equal(t, "1", req.header.Get(DeliveryHeader))
+
+	status, attempts := deliveryState(t, db)
+	assert.Equal(t, database.DeliveryDelivered, status)
+	assert.Equal(t, 1, attempts)
+
+	sent, err = d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent, "a delivered event is not sent again")
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	db := newTestDB(t)
+	server, requests := newEndpoint(t, http.StatusInternalServerError, http.StatusOK)
+	subscribe(t, db, server.URL, EventCompleted)
+	_, err := Enqueue(db, 1, EventCompleted, "")
+	require.NoError(t, err)
+
+	d := NewDispatcher(db, testPolicy, Options{Backoff: time.Hour})
+	_, err = d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	status, attempts := deliveryState(t, db)
+	assert.Equal(t, database.DeliveryPending, status)
+	assert.Equal(t, 1, attempts)
+
+	sent, err := d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent, "the retry waits for the backoff")
+
+	makeDue(t, db)
+	_, err = d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	status, attempts = deliveryState(t, db)
+	assert.Equal(t, database.DeliveryDelivered, status)
+	assert.Equal(t, 2, attempts)
+	assert.Len(t, *requests, 2)
+	assert.Equal(t, (*requests)[0].header.Get(DeliveryHeader), (*requests)[1].header.Get(DeliveryHeader))
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	db := newTestDB(t)
+	server, _ := newEndpoint(t, http.StatusFound)
+	subscribe(t, db, server.URL, EventCompleted)
+	_, err := Enqueue(db, 1, EventCompleted, "")
+	require.NoError(t, err)
+
+	d := NewDispatcher(db, testPolicy, Options{MaxAttempts: 2})
+	for i := 0; i < 3; i++ {
+		_, err = d.DeliverDue(context.Background())
+		require.NoError(t, err)
+		makeDue(t, db)
+	}
+	status, attempts := deliveryState(t, db)
+	assert.Equal(t, database.DeliveryFailed, status)
+	assert.Equal(t, 2, attempts)
+
+	var logged int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM WebhookAttempts WHERE response_status = 302").Scan(&logged))
+	assert.Equal(t, 2, logged)
+}
+
+func TestDeliverBlockedURL(t *testing.T) {
+	db := newTestDB(t)
+	server, requests := newEndpoint(t, http.StatusOK)
+	subscribe(t, db, server.URL, EventCompleted)
+	_, err := Enqueue(db, 1, EventCompleted, "")
+	require.NoError(t, err)
+
+	d := NewDispatcher(db, urlpolicy.Default, Options{})
+	_, err = d.DeliverDue(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, *requests)
+
+	var lastError string
+	require.NoError(t, db.QueryRow("SELECT last_error FROM WebhookDeliveries").Scan(&lastError))
+	assert.NotEmpty(t, lastError)
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(nil, testPolicy, Options{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 4*time.Second, d.backoff(3))
+	assert.Equal(t, 5*time.Second, d.backoff(4))
+	assert.Equal(t, 5*time.Second, d.backoff(40))
+}
@@ -0,0 +1,6 @@
+// Package e2e runs the producer and the consumer together in-process, on SQLite, an
+// in-memory broker and fixture images served over HTTP, and checks that products
+// posted to the API end up processed in the database and in storage.
+//
+//	cd e2e && go test ./...
+package e2e
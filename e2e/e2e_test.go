@@ -0,0 +1,391 @@
+package e2e
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	consumerstorage "github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/producer/app"
+	"github.com/golang_backend_assignment/producer/handlers"
+	producerqueue "github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/progress"
+	"github.com/golang_backend_assignment/producer/uploads"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+const adminToken = "e2e-admin-token"
+
+// waitTimeout bounds how long a test waits for the consumer
+const waitTimeout = 20 * time.Second
+
+// stack is the producer and consumer running in-process on one SQLite database, one
+// memory broker and one storage directory, with fixture images served over HTTP
+type stack struct {
+	db         *sql.DB
+	broker     *consumerqueue.MemoryBroker
+	app        *fiber.App
+	storageDir string
+	images     *httptest.Server
+
+	mu     sync.Mutex
+	events []string // routing keys of the domain events published so far
+}
+
+func newStack(t *testing.T) *stack {
+	t.Helper()
+	logrus.SetLevel(logrus.WarnLevel)
+	t.Cleanup(func() { logrus.SetLevel(logrus.InfoLevel) })
+
+	dir := t.TempDir()
+	s := &stack{
+		db:         openDB(t, filepath.Join(dir, "catalog.db")),
+		broker:     consumerqueue.NewMemoryBroker(),
+		storageDir: filepath.Join(dir, "product_imgs"),
+		images:     httptest.NewServer(fixtureImages(t)),
+	}
+	t.Cleanup(s.images.Close)
+
+	// Both services declare what they use, as they do against RabbitMQ
+	lanes := producerqueue.Lanes{Interactive: "products", Bulk: "products.bulk"}
+	for _, queue := range []string{lanes.Interactive, lanes.Bulk} {
+		must(t, producerqueue.DeclareQueue(s.broker, queue))
+	}
+	hub := progress.NewHub()
+	must(t, producerqueue.SubscribeProgress(s.broker, "product_progress", hub.Publish))
+	publishEvent, err := producerqueue.NewEventPublisher(s.broker, "product_events")
+	must(t, err)
+	s.recordEvents(t, "product_events")
+
+	producerStore, err := consumerstorage.NewLocal(s.storageDir, "")
+	must(t, err)
+	s.app = app.New(app.Config{
+		DB:              s.db,
+		Broker:          s.broker,
+		Lanes:           lanes,
+		PublishEvent:    publishEvent,
+		Progress:        hub,
+		Policy:          &urlpolicy.Policy{AllowedSchemes: []string{"http"}, AllowPrivateIPs: true},
+		Storage:         producerStore,
+		Limits:          uploads.Limits{MaxBytes: uploads.DefaultMaxBytes, MaxFiles: 10},
+		ResumableExpiry: time.Hour,
+		IdempotencyTTL:  time.Hour,
+		AdminToken:      adminToken,
+	})
+
+	consumerStore, err := consumerstorage.NewLocal(s.storageDir, "")
+	must(t, err)
+	cfg := imageutils.Config{
+		Compress: imageutils.CompressOptions{Quality: 60},
+		Fetcher: imageutils.NewFetcher(imageutils.FetcherConfig{
+			Limits:         imageutils.DefaultDownloadLimits,
+			ConnectTimeout: time.Second,
+			ReadTimeout:    5 * time.Second,
+			Policy:         &urlpolicy.Policy{AllowedSchemes: []string{"http"}, AllowPrivateIPs: true},
+		}),
+		Storage: consumerStore,
+	}
+	progressFn, err := consumerqueue.NewProgressPublisher(s.broker, "product_progress")
+	must(t, err)
+	consumerEvents, err := consumerqueue.NewEventPublisher(s.broker, "product_events")
+	must(t, err)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err := consumerqueue.Consumer(s.broker, consumerqueue.Lanes{Interactive: lanes.Interactive, Bulk: lanes.Bulk, Workers: 2, Reserved: 1}, s.db, cfg,
+			consumerqueue.Notifiers{Progress: progressFn, Events: consumerEvents})
+		if err != nil {
+			t.Errorf("Error consuming jobs: %v", err)
+		}
+	}()
+	// Closing the broker stops the consumer, which returns once its jobs end
+	t.Cleanup(func() {
+		s.broker.Close()
+		<-stopped
+	})
+	return s
+}
+
+// openDB creates a SQLite database with the schema and users of init.sql
+func openDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate")
+	must(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("../init.sql")
+	must(t, err)
+	if _, err := db.Exec(sqliteSchema(string(schema))); err != nil {
+		t.Fatalf("Error creating the schema: %v", err)
+	}
+	return db
+}
+
+// sqliteSchema adapts the MySQL statements of init.sql to SQLite
+func sqliteSchema(schema string) string {
+	schema = regexp.MustCompile(`(?m)^(CREATE DATABASE|USE) .*$`).ReplaceAllString(schema, "")
+	return strings.ReplaceAll(schema, "INT PRIMARY KEY AUTO_INCREMENT", "INTEGER PRIMARY KEY AUTOINCREMENT")
+}
+
+// fixtureImages serves a JPEG and a PNG, and 404 for anything else
+func fixtureImages(t *testing.T) http.Handler {
+	t.Helper()
+	photo := image.NewRGBA(image.Rect(0, 0, 1600, 1200))
+	logo := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	for _, img := range []*image.RGBA{photo, logo} {
+		b := img.Bounds()
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				img.Set(x, y, color.RGBA{uint8(x * 255 / b.Dx()), uint8(y * 255 / b.Dy()), 128, 255})
+			}
+		}
+	}
+	var jpg, pngData bytes.Buffer
+	must(t, jpeg.Encode(&jpg, photo, &jpeg.Options{Quality: 95}))
+	must(t, png.Encode(&pngData, logo))
+
+	files := map[string][]byte{"/photo.jpg": jpg.Bytes(), "/logo.png": pngData.Bytes()}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+}
+
+// recordEvents binds a queue to the domain events exchange and records the routing
+// key of every event
+func (s *stack) recordEvents(t *testing.T, exchange string) {
+	t.Helper()
+	q, err := s.broker.QueueDeclare("", false, true, true, false, nil)
+	must(t, err)
+	must(t, s.broker.QueueBind(q.Name, "#", exchange, false, nil))
+	msgs, err := s.broker.Consume(q.Name, "", true, false, false, false, nil)
+	must(t, err)
+	go func() {
+		for d := range msgs {
+			s.mu.Lock()
+			s.events = append(s.events, d.RoutingKey)
+			s.mu.Unlock()
+		}
+	}()
+}
+
+func (s *stack) hasEvent(routingKey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.events {
+		if e == routingKey {
+			return true
+		}
+	}
+	return false
+}
+
+// request sends a JSON request to the producer and decodes the JSON response into out
+func (s *stack) request(t *testing.T, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		must(t, err)
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if strings.HasPrefix(path, "/admin/") {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := s.app.Test(req, -1)
+	must(t, err)
+	defer resp.Body.Close()
+	if out != nil {
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("Error decoding the response to %s %s (status %d): %v: %s", method, path, resp.StatusCode, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+// createProduct posts a product of user 1 with images
+func (s *stack) createProduct(t *testing.T, images ...string) handlers.ProductResponse {
+	t.Helper()
+	var product handlers.ProductResponse
+	status := s.request(t, http.MethodPost, "/products", handlers.Product{
+		UserID:             1,
+		ProductName:        "Headphones",
+		ProductDescription: "These headphones will blow your mind!",
+		ProductImages:      images,
+		ProductPrice:       10000,
+	}, &product)
+	if status != http.StatusAccepted || product.ProductID == 0 {
+		t.Fatalf("Expected the product to be accepted, got status %d and %+v", status, product)
+	}
+	return product
+}
+
+// waitForStatus polls the product until its processing status is one of done and
+// failed, and fails the test unless it is want
+func (s *stack) waitForStatus(t *testing.T, productID int64, want string) handlers.ProductResponse {
+	t.Helper()
+	var product handlers.ProductResponse
+	waitFor(t, fmt.Sprintf("product %d to be processed", productID), func() bool {
+		product = handlers.ProductResponse{}
+		s.request(t, http.MethodGet, fmt.Sprintf("/products/%d", productID), nil, &product)
+		return product.ProcessingStatus == "done" || product.ProcessingStatus == "failed"
+	})
+	if product.ProcessingStatus != want {
+		t.Fatalf("Expected product %d to be %s, got %+v", productID, want, product)
+	}
+	return product
+}
+
+// waitFor polls cond until it holds, failing the test after waitTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProductImagesAreProcessed(t *testing.T) {
+	s := newStack(t)
+	sources := []string{s.images.URL + "/photo.jpg", s.images.URL + "/logo.png"}
+	created := s.createProduct(t, sources...)
+	if created.ProcessingStatus != "pending" {
+		t.Errorf("Expected a new product to be pending, got %q", created.ProcessingStatus)
+	}
+
+	product := s.waitForStatus(t, created.ProductID, "done")
+	if len(product.CompressedProductImages) != len(sources) {
+		t.Errorf("Expected %d compressed images, got %v", len(sources), product.CompressedProductImages)
+	}
+
+	// Every source has its renditions recorded and written to storage
+	rows, err := s.db.Query("SELECT source_url, storage_key, size_bytes FROM CompressedImages WHERE product_id = ?", product.ProductID)
+	must(t, err)
+	defer rows.Close()
+	processed := map[string]bool{}
+	for rows.Next() {
+		var source, key string
+		var size int64
+		must(t, rows.Scan(&source, &key, &size))
+		processed[source] = true
+		info, err := os.Stat(filepath.Join(s.storageDir, key))
+		if err != nil {
+			t.Errorf("Expected %s to be stored: %v", key, err)
+		} else if info.Size() != size || size == 0 {
+			t.Errorf("Expected %s to be %d bytes, got %d", key, size, info.Size())
+		}
+	}
+	must(t, rows.Err())
+	for _, source := range sources {
+		if !processed[source] {
+			t.Errorf("Expected a compressed image of %s", source)
+		}
+	}
+
+	var jobStatus string
+	must(t, s.db.QueryRow("SELECT status FROM ProcessedJobs WHERE job_key = ?", fmt.Sprintf("product:%d", product.ProductID)).Scan(&jobStatus))
+	if jobStatus != "done" {
+		t.Errorf("Expected the job to be recorded as done, got %q", jobStatus)
+	}
+	waitFor(t, "the domain events", func() bool {
+		return s.hasEvent("product.created.v1") && s.hasEvent("product.images.processed.v1")
+	})
+}
+
+func TestProductWithMissingImagesFails(t *testing.T) {
+	s := newStack(t)
+	created := s.createProduct(t, s.images.URL+"/missing.jpg")
+	s.waitForStatus(t, created.ProductID, "failed")
+
+	var jobStatus, jobError string
+	must(t, s.db.QueryRow("SELECT status, error FROM ProcessedJobs WHERE job_key = ?", fmt.Sprintf("product:%d", created.ProductID)).Scan(&jobStatus, &jobError))
+	if jobStatus != "failed" || jobError == "" {
+		t.Errorf("Expected the job to be recorded as failed with its error, got %q, %q", jobStatus, jobError)
+	}
+	var count int
+	must(t, s.db.QueryRow("SELECT COUNT(*) FROM CompressedImages WHERE product_id = ?", created.ProductID).Scan(&count))
+	if count != 0 {
+		t.Errorf("Expected no compressed images, got %d", count)
+	}
+	waitFor(t, "the failure event", func() bool { return s.hasEvent("product.images.failed.v1") })
+}
+
+func TestDelayedReprocessing(t *testing.T) {
+	s := newStack(t)
+	created := s.createProduct(t, s.images.URL+"/logo.png")
+	s.waitForStatus(t, created.ProductID, "done")
+
+	var started handlers.ReprocessStarted
+	start := time.Now()
+	status := s.request(t, http.MethodPost, "/admin/reprocess", handlers.ReprocessRequest{
+		MinProductID: created.ProductID,
+		MaxProductID: created.ProductID,
+		DelaySeconds: 1,
+	}, &started)
+	if status != http.StatusAccepted || started.Total != 1 {
+		t.Fatalf("Expected the job to start with 1 product, got status %d and %+v", status, started)
+	}
+
+	// The job waits in the delay queue of the bulk lane before it is processed
+	waitFor(t, "the job to be delayed", func() bool {
+		q, err := s.broker.QueueInspect(consumerqueue.DelayQueue("products.bulk", time.Second))
+		return err == nil && q.Messages == 1
+	})
+	var progress struct {
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	}
+	waitFor(t, "the job to complete", func() bool {
+		s.request(t, http.MethodGet, "/admin/reprocess/"+started.JobID, nil, &progress)
+		return progress.Completed+progress.Failed == 1
+	})
+	if progress.Completed != 1 {
+		t.Errorf("Expected the product to be reprocessed, got %+v", progress)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("Expected the job to wait about a second, it completed after %v", waited)
+	}
+}
+
+// The memory broker is shared by both services through their own interfaces
+var (
+	_ producerqueue.Publisher  = (*consumerqueue.MemoryBroker)(nil)
+	_ producerqueue.Subscriber = (*consumerqueue.MemoryBroker)(nil)
+)
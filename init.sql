@@ -13,15 +13,126 @@ CREATE TABLE IF NOT EXISTS Users (
 
 CREATE TABLE IF NOT EXISTS Products (
   product_id INT PRIMARY KEY AUTO_INCREMENT,
+  user_id INT,
   product_name VARCHAR(255),
   product_description TEXT,
   product_images TEXT,
   product_price DECIMAL(10, 2),
   compressed_product_images TEXT,
+  processing_status VARCHAR(32) DEFAULT 'pending',
   created_at DATETIME,
   updated_at DATETIME
 );
 
+CREATE TABLE IF NOT EXISTS CompressedImages (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  product_id INT,
+  source_url TEXT,
+  content_hash CHAR(32),
+  rendition VARCHAR(64),
+  storage_backend VARCHAR(32),
+  storage_key VARCHAR(1024),
+  quality INT,
+  ssim DOUBLE,
+  psnr DOUBLE,
+  size_bytes INT,
+  original_key VARCHAR(1024) DEFAULT '',
+  original_content_type VARCHAR(255) DEFAULT '',
+  original_checksum CHAR(64) DEFAULT '',
+  original_size INT DEFAULT 0,
+  created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS ReprocessJobs (
+  id VARCHAR(64) PRIMARY KEY,
+  filter TEXT,
+  total INT DEFAULT 0,
+  created_at DATETIME,
+  updated_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS ReprocessItems (
+  job_id VARCHAR(64),
+  product_id INT,
+  enqueued_at DATETIME,
+  completed_at DATETIME NULL,
+  error TEXT,
+  PRIMARY KEY (job_id, product_id)
+);
+
+CREATE TABLE IF NOT EXISTS ProcessedJobs (
+  job_key VARCHAR(255) PRIMARY KEY,
+  product_id INT,
+  status VARCHAR(32),
+  error TEXT,
+  created_at DATETIME,
+  updated_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS ProductLocks (
+  product_id INT PRIMARY KEY,
+  owner VARCHAR(255),
+  expires_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS IdempotencyKeys (
+  idem_key VARCHAR(255) PRIMARY KEY,
+  request_hash CHAR(64),
+  completed BOOLEAN DEFAULT FALSE,
+  status_code INT,
+  content_type VARCHAR(255),
+  location VARCHAR(1024),
+  response_body MEDIUMTEXT,
+  created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS ResumableUploads (
+  upload_id VARCHAR(64) PRIMARY KEY,
+  product_id INT,
+  filename VARCHAR(255),
+  upload_length BIGINT,
+  upload_offset BIGINT DEFAULT 0,
+  image_ref VARCHAR(1024) DEFAULT '',
+  assembling_until DATETIME NULL,
+  expires_at DATETIME,
+  created_at DATETIME,
+  updated_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS WebhookSubscriptions (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  user_id INT NULL,
+  url VARCHAR(2048),
+  secret VARCHAR(128),
+  events VARCHAR(255),
+  active BOOLEAN DEFAULT TRUE,
+  created_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS WebhookDeliveries (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  subscription_id INT,
+  event VARCHAR(64),
+  product_id INT,
+  payload MEDIUMTEXT,
+  status VARCHAR(32),
+  attempts INT DEFAULT 0,
+  response_status INT DEFAULT 0,
+  last_error TEXT,
+  next_attempt_at DATETIME,
+  created_at DATETIME,
+  updated_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS WebhookAttempts (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  delivery_id INT,
+  response_status INT,
+  error TEXT,
+  duration_ms INT,
+  attempted_at DATETIME
+);
+
 INSERT INTO Users (id, name, mobile, latitude, longitude, created_at, updated_at) VALUES
   (1, 'John Doe', '555-1234', 37.7749, -122.4194, '2021-05-01 12:00:00', '2021-05-01 12:00:00'),
   (2, 'Jane Smith', '555-5678', 40.7128, -74.0060, '2021-05-02 09:00:00', '2021-05-03 15:00:00'),
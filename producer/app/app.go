@@ -0,0 +1,82 @@
+// Package app sets up the routes of the producer API, so that main and end-to-end
+// tests serve the same application.
+package app
+
+import (
+	"database/sql"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/gofiber/swagger"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/producer/handlers"
+	"github.com/golang_backend_assignment/producer/idempotency"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/progress"
+	"github.com/golang_backend_assignment/producer/uploads"
+)
+
+// Config holds what the routes depend on
+type Config struct {
+	DB           *sql.DB
+	Broker       msgqueue.Publisher // jobs are published to its lanes, which must be declared
+	Lanes        msgqueue.Lanes
+	PublishEvent msgqueue.EventPublisher
+	Progress     *progress.Hub
+	Policy       *urlpolicy.Policy
+	Storage      storage.Storage
+	Limits       uploads.Limits
+
+	ResumableExpiry time.Duration
+	IdempotencyTTL  time.Duration
+	AdminToken      string // admin routes are disabled when empty
+}
+
+// New creates the Fiber app serving the API
+func New(cfg Config) *fiber.App {
+	// Request bodies are streamed rather than buffered, and multipart forms are only
+	// parsed by the routes taking uploads, which spool the files to disk. Each route
+	// reading a body limits its size.
+	app := fiber.New(fiber.Config{
+		ErrorHandler:                 handlers.ErrorHandler,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+	})
+	db, ch, store := cfg.DB, cfg.Broker, cfg.Storage
+	limit := handlers.BodyLimit(fiber.DefaultBodyLimit)
+	// Leave room in the body for the largest accepted upload
+	uploadLimit := handlers.UploadBodyLimit(cfg.Limits.MaxBytes*int64(cfg.Limits.MaxFiles) + 1<<20)
+
+	// Images added to a product are interactive, reprocessing is bulk
+	publish := func(job msgqueue.Job) error { return msgqueue.PublishJob(job, ch, cfg.Lanes.Interactive) }
+	publishBulk := func(job msgqueue.Job) error { return msgqueue.PublishJob(job, ch, cfg.Lanes.Bulk) }
+
+	app.Post("/products", uploadLimit, idempotency.New(db, idempotency.Options{TTL: cfg.IdempotencyTTL}), handlers.SaveProduct(db, ch, cfg.Lanes, cfg.PublishEvent, cfg.Policy, store, cfg.Limits))
+	app.Get("/products/:id", handlers.GetProduct(db))
+	app.Post("/products/:id/images", uploadLimit, handlers.AddProductImages(db, publish, cfg.Policy, store, cfg.Limits))
+	app.Delete("/products/:id/images/:imageId", handlers.DeleteProductImage(db, store))
+	app.Put("/products/:id/images/order", limit, handlers.ReorderProductImages(db))
+	app.Get("/products/:id/events", handlers.ProductEvents(db, cfg.Progress))
+	app.Get("/swagger/*", swagger.HandlerDefault)
+
+	// Resumable uploads following the tus protocol, for images too large to send at once
+	tus := app.Group("/uploads", handlers.TusResumable())
+	tus.Options("", handlers.TusOptions(cfg.Limits.MaxBytes))
+	tus.Post("", limit, handlers.CreateUpload(db, cfg.Limits.MaxBytes, cfg.ResumableExpiry))
+	tus.Head("/:id", handlers.GetUploadOffset(db))
+	tus.Patch("/:id", handlers.BodyLimit(cfg.Limits.MaxBytes), handlers.PatchUpload(db, publish, store, cfg.Limits.MaxBytes))
+	tus.Delete("/:id", handlers.DeleteUpload(db, store))
+
+	// Admin routes for regenerating the images of existing products
+	admin := app.Group("/admin", limit, handlers.AdminAuth(cfg.AdminToken))
+	admin.Post("/reprocess", handlers.StartReprocess(db, publishBulk))
+	admin.Get("/reprocess/:id", handlers.GetReprocess(db))
+	// Admin routes for webhook subscriptions and their deliveries, sent by the consumer
+	admin.Post("/webhooks", handlers.CreateWebhook(db, cfg.Policy))
+	admin.Get("/webhooks", handlers.ListWebhooks(db))
+	admin.Delete("/webhooks/:id", handlers.DeleteWebhook(db))
+	admin.Get("/webhooks/:id/deliveries", handlers.ListWebhookDeliveries(db))
+	admin.Post("/webhooks/deliveries/:id/redeliver", handlers.RedeliverWebhook(db))
+	return app
+}
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/handlers"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/progress"
+	"github.com/golang_backend_assignment/producer/uploads"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// testLanes are the queues jobs are published to in the tests
+var testLanes = msgqueue.Lanes{Interactive: "products", Bulk: "products.bulk"}
+
+// testApp is the producer app on a SQLite database with the schema of init.sql, a
+// memory broker and local storage
+type testApp struct {
+	*fiber.App
+	db     *sql.DB
+	broker *flakyBroker
+	store  *storage.Local
+	hub    *progress.Hub
+	events []string // routing keys of the domain events published so far
+}
+
+// flakyBroker is a memory broker whose publishing can be made to fail. It keeps the
+// jobs published to each queue, so that tests can check them without consuming the
+// queue.
+type flakyBroker struct {
+	*consumerqueue.MemoryBroker
+	fail bool
+
+	mu   sync.Mutex
+	jobs map[string][][]byte
+}
+
+func (b *flakyBroker) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if b.fail {
+		return amqp.ErrClosed
+	}
+	if exchange == "" {
+		b.mu.Lock()
+		b.jobs[key] = append(b.jobs[key], msg.Body)
+		b.mu.Unlock()
+	}
+	return b.MemoryBroker.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+// newTestApp creates the app, letting configure change its config first
+func newTestApp(t *testing.T, configure func(*Config)) *testApp {
+	t.Helper()
+	logrus.SetLevel(logrus.WarnLevel)
+	t.Cleanup(func() { logrus.SetLevel(logrus.InfoLevel) })
+
+	store, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	a := &testApp{
+		db:     openDB(t),
+		broker: &flakyBroker{MemoryBroker: consumerqueue.NewMemoryBroker(), jobs: map[string][][]byte{}},
+		store:  store,
+		hub:    progress.NewHub(),
+	}
+	t.Cleanup(func() { a.broker.Close() })
+	for _, queue := range []string{testLanes.Interactive, testLanes.Bulk} {
+		if err := msgqueue.DeclareQueue(a.broker, queue); err != nil {
+			t.Fatalf("Error declaring queue: %v", err)
+		}
+	}
+	publish, err := msgqueue.NewEventPublisher(a.broker, "product_events")
+	if err != nil {
+		t.Fatalf("Error declaring the events exchange: %v", err)
+	}
+	cfg := Config{
+		DB:     a.db,
+		Broker: a.broker,
+		Lanes:  testLanes,
+		PublishEvent: func(event msgqueue.DomainEvent) error {
+			a.events = append(a.events, event.RoutingKey())
+			return publish(event)
+		},
+		Progress:        a.hub,
+		Policy:          &urlpolicy.Policy{AllowedSchemes: []string{"http", "https"}, AllowPrivateIPs: true},
+		Storage:         store,
+		Limits:          uploads.Limits{MaxBytes: uploads.DefaultMaxBytes, MaxFiles: 3},
+		ResumableExpiry: time.Hour,
+		IdempotencyTTL:  time.Hour,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	a.App = New(cfg)
+	return a
+}
+
+// openDB creates a SQLite database with the schema and users of init.sql
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "catalog.db")+"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema, err := os.ReadFile("../../init.sql")
+	if err != nil {
+		t.Fatalf("Error reading init.sql: %v", err)
+	}
+	sqlite := regexp.MustCompile(`(?m)^(CREATE DATABASE|USE) .*$`).ReplaceAllString(string(schema), "")
+	sqlite = strings.ReplaceAll(sqlite, "INT PRIMARY KEY AUTO_INCREMENT", "INTEGER PRIMARY KEY AUTOINCREMENT")
+	if _, err := db.Exec(sqlite); err != nil {
+		t.Fatalf("Error creating the schema: %v", err)
+	}
+	return db
+}
+
+// do sends a request to the app
+func (a *testApp) do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := a.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Error sending %s %s: %v", req.Method, req.URL, err)
+	}
+	return resp
+}
+
+// doJSON sends body as JSON
+func (a *testApp) doJSON(t *testing.T, method, target string, body interface{}) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Error encoding request: %v", err)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(data))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	return a.do(t, req)
+}
+
+// doMultipart sends a multipart form with the given fields and image files
+func (a *testApp) doMultipart(t *testing.T, method, target string, fields map[string]string, files ...[]byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		w.WriteField(name, value)
+	}
+	for i, data := range files {
+		part, err := w.CreateFormFile("images", fmt.Sprintf("image%d.png", i))
+		if err != nil {
+			t.Fatalf("Error creating form file: %v", err)
+		}
+		part.Write(data)
+	}
+	w.Close()
+	req := httptest.NewRequest(method, target, &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return a.do(t, req)
+}
+
+// queued returns how many jobs were published to a queue and not taken yet
+func (a *testApp) queued(t *testing.T, queue string) int {
+	t.Helper()
+	a.broker.mu.Lock()
+	defer a.broker.mu.Unlock()
+	return len(a.broker.jobs[queue])
+}
+
+// takeJob returns the oldest job published to a queue that was not taken yet
+func (a *testApp) takeJob(t *testing.T, queue string) msgqueue.Job {
+	t.Helper()
+	a.broker.mu.Lock()
+	defer a.broker.mu.Unlock()
+	if len(a.broker.jobs[queue]) == 0 {
+		t.Fatalf("No job in queue %s", queue)
+	}
+	// New products are queued as a plain product ID, other jobs as JSON
+	var job msgqueue.Job
+	body := a.broker.jobs[queue][0]
+	if id, err := strconv.ParseInt(string(body), 10, 64); err == nil {
+		job.ProductID = id
+	} else if err := json.Unmarshal(body, &job); err != nil {
+		t.Fatalf("Error decoding job: %v", err)
+	}
+	a.broker.jobs[queue] = a.broker.jobs[queue][1:]
+	return job
+}
+
+// insertProduct stores a product of user 1 directly
+func (a *testApp) insertProduct(t *testing.T, images ...string) int64 {
+	t.Helper()
+	if images == nil {
+		images = []string{}
+	}
+	id, err := database.InsertProduct(a.db, 1, "Lamp", "A lamp", 10, images)
+	if err != nil {
+		t.Fatalf("Error inserting product: %v", err)
+	}
+	return id
+}
+
+// product loads a product
+func (a *testApp) product(t *testing.T, id int64) *database.Product {
+	t.Helper()
+	product, err := database.GetProduct(a.db, id)
+	if err != nil {
+		t.Fatalf("Error getting product %d: %v", id, err)
+	}
+	return product
+}
+
+// uploadsOf lists the files stored among the uploads of a product
+func (a *testApp) uploadsOf(t *testing.T, id int64) []string {
+	t.Helper()
+	objects, err := a.store.List(context.Background(), storage.UploadsPrefix(fmt.Sprint(id)))
+	if err != nil {
+		t.Fatalf("Error listing uploads: %v", err)
+	}
+	keys := []string{}
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+	return keys
+}
+
+// decode reads a JSON response body
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+}
+
+// errorMessage reads the JSON error envelope of a response
+func errorMessage(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var body handlers.ErrorResponse
+	decode(t, resp, &body)
+	if body.Error.Status != resp.StatusCode || body.Error.Message == "" {
+		t.Errorf("Expected an error envelope with status %d and a message, but got %+v", resp.StatusCode, body.Error)
+	}
+	return body.Error.Message
+}
+
+// testPNG encodes a PNG of the given size
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("Error encoding image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readAll reads a response body
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	return string(data)
+}
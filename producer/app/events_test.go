@@ -0,0 +1,168 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+)
+
+// serve runs the app on a local port, as event streams never end for app.Test, and
+// returns its base URL
+func (a *testApp) serve(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go a.Listener(ln)
+	t.Cleanup(func() { a.ShutdownWithTimeout(time.Second) })
+	return "http://" + ln.Addr().String()
+}
+
+// eventStream reads the events of a Server-Sent Events response
+type eventStream struct {
+	t *testing.T
+	r *bufio.Reader
+}
+
+// next returns the next progress event, skipping heartbeats
+func (s *eventStream) next() msgqueue.ProgressEvent {
+	s.t.Helper()
+	events := make(chan msgqueue.ProgressEvent, 1)
+	errs := make(chan error, 1)
+	go func() {
+		var name, data string
+		for {
+			line, err := s.r.ReadString('\n')
+			if err != nil {
+				errs <- err
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && data != "":
+				var event msgqueue.ProgressEvent
+				if name != "progress" {
+					errs <- fmt.Errorf("unexpected event %q", name)
+				} else if err := json.Unmarshal([]byte(data), &event); err != nil {
+					errs <- err
+				} else {
+					events <- event
+				}
+				return
+			}
+		}
+	}()
+	select {
+	case event := <-events:
+		return event
+	case err := <-errs:
+		s.t.Fatalf("Error reading event: %v", err)
+	case <-time.After(2 * time.Second):
+		s.t.Fatalf("Timed out waiting for an event")
+	}
+	return msgqueue.ProgressEvent{}
+}
+
+// watch opens the event stream of a product
+func watch(t *testing.T, base string, productID int64) *eventStream {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("%s/products/%d/events", base, productID))
+	if err != nil {
+		t.Fatalf("Error opening the event stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("Expected an event stream, but got status %d with %q and %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("Cache-Control"))
+	}
+	return &eventStream{t: t, r: bufio.NewReader(resp.Body)}
+}
+
+func TestProductEvents(t *testing.T) {
+	a := newTestApp(t, nil)
+	// Progress reaches the app the way the consumer publishes it
+	if err := msgqueue.SubscribeProgress(a.broker, "product_progress", a.hub.Publish); err != nil {
+		t.Fatalf("Error subscribing to progress: %v", err)
+	}
+	publish, err := consumerqueue.NewProgressPublisher(a.broker, "product_progress")
+	if err != nil {
+		t.Fatalf("Error setting up progress: %v", err)
+	}
+	report := func(event consumerqueue.ProgressEvent) {
+		event.Time = time.Now().UTC()
+		publish(event)
+	}
+	productID := a.insertProduct(t, "http://127.0.0.1/a.jpg", "http://127.0.0.1/b.jpg")
+	other := a.insertProduct(t, "http://127.0.0.1/c.jpg")
+	base := a.serve(t)
+
+	// The current state comes first
+	stream := watch(t, base, productID)
+	if event := stream.next(); event.ProductID != int(productID) || event.Status != database.StatusPending || event.Total != 2 || event.Completed != 0 {
+		t.Errorf("Expected the pending state of 2 images, but got %+v", event)
+	}
+
+	// Then the progress of the product only
+	report(consumerqueue.ProgressEvent{ProductID: int(other), Status: consumerqueue.StatusProcessing, Total: 1})
+	report(consumerqueue.ProgressEvent{ProductID: int(productID), Status: consumerqueue.StatusProcessing, Total: 2})
+	report(consumerqueue.ProgressEvent{ProductID: int(productID), Status: consumerqueue.StatusProcessing, Image: "http://127.0.0.1/a.jpg", ImageStatus: "done", Completed: 1, Total: 2})
+	if event := stream.next(); event.ProductID != int(productID) || event.Status != consumerqueue.StatusProcessing || event.Image != "" {
+		t.Errorf("Expected the job to start, but got %+v", event)
+	}
+	if event := stream.next(); event.Image != "http://127.0.0.1/a.jpg" || event.ImageStatus != "done" || event.Completed != 1 {
+		t.Errorf("Expected the first image to be done, but got %+v", event)
+	}
+
+	// A client connecting mid-job starts from the latest progress
+	late := watch(t, base, productID)
+	if event := late.next(); event.Status != consumerqueue.StatusProcessing || event.Completed != 1 || event.Total != 2 {
+		t.Errorf("Expected the latest progress, but got %+v", event)
+	}
+
+	report(consumerqueue.ProgressEvent{ProductID: int(productID), Status: database.StatusFailed, Completed: 1, Failed: 1, Total: 2, Error: "image b.jpg failed"})
+	for _, s := range []*eventStream{stream, late} {
+		if event := s.next(); event.Status != database.StatusFailed || event.Failed != 1 || event.Error == "" {
+			t.Errorf("Expected the job to fail, but got %+v", event)
+		}
+	}
+
+	// Once the job ended the product reports its own state again
+	if _, err := a.db.Exec("UPDATE Products SET processing_status = ? WHERE product_id = ?", database.StatusDone, productID); err != nil {
+		t.Fatalf("Error updating product: %v", err)
+	}
+	if event := watch(t, base, productID).next(); event.Status != database.StatusDone || event.Completed != 2 {
+		t.Errorf("Expected the recorded state, but got %+v", event)
+	}
+}
+
+func TestProductEventsErrors(t *testing.T) {
+	a := newTestApp(t, nil)
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/products/999/events", http.StatusNotFound},
+		{"/products/abc/events", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := a.do(t, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, but got %d", tt.target, tt.status, resp.StatusCode)
+		}
+		errorMessage(t, resp)
+	}
+}
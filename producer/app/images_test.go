@@ -0,0 +1,230 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/handlers"
+)
+
+// putFile stores a file for the tests
+func (a *testApp) putFile(t *testing.T, key string) {
+	t.Helper()
+	if err := a.store.Put(context.Background(), key, bytes.NewReader([]byte("data")), 4, "image/png"); err != nil {
+		t.Fatalf("Error storing %s: %v", key, err)
+	}
+}
+
+// exists reports whether a file is in storage
+func (a *testApp) exists(key string) bool {
+	_, err := a.store.Stat(context.Background(), key)
+	return err == nil
+}
+
+func TestAddProductImages(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t, "http://127.0.0.1/a.jpg")
+	target := fmt.Sprintf("/products/%d/images", productID)
+
+	resp := a.doJSON(t, http.MethodPost, target, handlers.AddImagesRequest{ProductImages: []string{"http://127.0.0.1/b.jpg"}})
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != fmt.Sprintf("/products/%d", productID) {
+		t.Fatalf("Expected status 202 with the product's Location, but got %d and %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	var product handlers.ProductResponse
+	decode(t, resp, &product)
+	if want := []string{"http://127.0.0.1/a.jpg", "http://127.0.0.1/b.jpg"}; !reflect.DeepEqual(product.ProductImages, want) || product.ProcessingStatus != database.StatusPending {
+		t.Errorf("Expected images %v pending, but got %v %s", want, product.ProductImages, product.ProcessingStatus)
+	}
+	if job := a.takeJob(t, testLanes.Interactive); !reflect.DeepEqual(job.Images, []string{"http://127.0.0.1/b.jpg"}) {
+		t.Errorf("Expected a job for just the new image, but got %+v", job)
+	}
+
+	// Uploads are stored among the product's uploads
+	resp = a.doMultipart(t, http.MethodPost, target, nil, testPNG(t, 8, 8))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202 for an upload, but got %d", resp.StatusCode)
+	}
+	keys := a.uploadsOf(t, productID)
+	if len(keys) != 1 || a.product(t, productID).ProductImages[2] != "local:"+keys[0] {
+		t.Errorf("Expected the product to reference its upload, but got uploads %v", keys)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		images []string
+		status int
+	}{
+		{"image already on the product", target, []string{"http://127.0.0.1/a.jpg"}, http.StatusConflict},
+		{"URL with a comma", target, []string{"http://127.0.0.1/c.jpg,local:uploads/9/x.png"}, http.StatusBadRequest},
+		{"storage reference", target, []string{"local:" + storageKey(productID, "x.png")}, http.StatusBadRequest},
+		{"no images", target, []string{}, http.StatusBadRequest},
+		{"unknown product", "/products/999/images", []string{"http://127.0.0.1/c.jpg"}, http.StatusNotFound},
+		{"invalid product ID", "/products/abc/images", []string{"http://127.0.0.1/c.jpg"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := a.doJSON(t, http.MethodPost, tt.target, handlers.AddImagesRequest{ProductImages: tt.images})
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, but got %d", tt.status, resp.StatusCode)
+			}
+			errorMessage(t, resp)
+		})
+	}
+	if jobs := a.queued(t, testLanes.Interactive); jobs != 1 {
+		t.Errorf("Expected only the upload to be queued, but got %d jobs", jobs)
+	}
+}
+
+func TestAddProductImagesQueueFailure(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t, "http://127.0.0.1/a.jpg")
+	target := fmt.Sprintf("/products/%d/images", productID)
+	a.broker.fail = true
+
+	// Images that cannot be queued are taken off the product again, with their uploads
+	resp := a.doJSON(t, http.MethodPost, target, handlers.AddImagesRequest{ProductImages: []string{"http://127.0.0.1/b.jpg"}})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, but got %d", resp.StatusCode)
+	}
+	errorMessage(t, resp)
+	resp = a.doMultipart(t, http.MethodPost, target, nil, testPNG(t, 8, 8))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, but got %d", resp.StatusCode)
+	}
+	if images := a.product(t, productID).ProductImages; !reflect.DeepEqual(images, []string{"http://127.0.0.1/a.jpg"}) {
+		t.Errorf("Expected the product to keep only its first image, but got %v", images)
+	}
+	if keys := a.uploadsOf(t, productID); len(keys) != 0 {
+		t.Errorf("Expected the upload to be deleted, but got %v", keys)
+	}
+
+	// The same images can be added once the queue is back
+	a.broker.fail = false
+	resp = a.doJSON(t, http.MethodPost, target, handlers.AddImagesRequest{ProductImages: []string{"http://127.0.0.1/b.jpg"}})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("Expected status 202 after the queue is back, but got %d", resp.StatusCode)
+	}
+}
+
+// storageKey is the key of a file among the uploads of a product
+func storageKey(productID int64, name string) string {
+	return fmt.Sprintf("uploads/%d/%s", productID, name)
+}
+
+// recordOutput records an output of the consumer for an image of a product
+func (a *testApp) recordOutput(t *testing.T, productID int64, source, key, originalKey string) {
+	t.Helper()
+	_, err := a.db.Exec("INSERT INTO CompressedImages (product_id, source_url, rendition, storage_backend, storage_key, original_key) VALUES (?, ?, 'w1024', 'local', ?, ?)", productID, source, key, originalKey)
+	if err != nil {
+		t.Fatalf("Error recording output: %v", err)
+	}
+	a.putFile(t, key)
+}
+
+func TestDeleteProductImage(t *testing.T) {
+	a := newTestApp(t, nil)
+	other := a.insertProduct(t)
+	otherUpload := storageKey(other, "theirs.png")
+	a.putFile(t, otherUpload)
+
+	// A product stored before uploads were checked references another one's upload
+	upload := "local:" + storageKey(other+1, "mine.png")
+	smuggled := "local:" + otherUpload
+	productID := a.insertProduct(t, "http://127.0.0.1/a.jpg", upload, smuggled)
+	a.putFile(t, storageKey(productID, "mine.png"))
+	a.recordOutput(t, productID, "http://127.0.0.1/a.jpg", fmt.Sprintf("%d/a_w1024.jpg", productID), fmt.Sprintf("%d/originals/a.jpg", productID))
+	a.putFile(t, fmt.Sprintf("%d/originals/a.jpg", productID))
+	a.recordOutput(t, productID, upload, fmt.Sprintf("%d/mine_w1024.jpg", productID), storageKey(productID, "mine.png"))
+	if err := database.RebuildCompressedProductImages(a.db, productID); err != nil {
+		t.Fatalf("Error rebuilding compressed images: %v", err)
+	}
+
+	remove := func(source string) *http.Response {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("/products/%d/images/%s", productID, database.ImageID(source)), nil)
+		return a.do(t, req)
+	}
+
+	// Removing an upload deletes its output and the upload
+	resp := remove(upload)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	var product handlers.ProductResponse
+	decode(t, resp, &product)
+	if want := []string{"http://127.0.0.1/a.jpg", smuggled}; !reflect.DeepEqual(product.ProductImages, want) {
+		t.Errorf("Expected images %v, but got %v", want, product.ProductImages)
+	}
+	if want := []string{fmt.Sprintf("local:%d/a_w1024.jpg", productID)}; !reflect.DeepEqual(product.CompressedProductImages, want) {
+		t.Errorf("Expected compressed images %v, but got %v", want, product.CompressedProductImages)
+	}
+	for _, key := range []string{fmt.Sprintf("%d/mine_w1024.jpg", productID), storageKey(productID, "mine.png")} {
+		if a.exists(key) {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+	if !a.exists(fmt.Sprintf("%d/a_w1024.jpg", productID)) {
+		t.Errorf("Expected the files of the other image to be kept")
+	}
+
+	// Removing a reference to another product's file leaves the file alone
+	if resp := remove(smuggled); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	if !a.exists(otherUpload) {
+		t.Errorf("Expected the upload of product %d to be kept", other)
+	}
+
+	if resp := remove("http://127.0.0.1/missing.jpg"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown image, but got %d", resp.StatusCode)
+	}
+}
+
+func TestReorderProductImages(t *testing.T) {
+	a := newTestApp(t, nil)
+	images := []string{"http://127.0.0.1/a.jpg", "http://127.0.0.1/b.jpg", "http://127.0.0.1/c.jpg"}
+	productID := a.insertProduct(t, images...)
+	target := fmt.Sprintf("/products/%d/images/order", productID)
+	id := func(i int) string { return database.ImageID(images[i]) }
+
+	resp := a.doJSON(t, http.MethodPut, target, handlers.ImageOrder{ImageIDs: []string{id(2), id(0), id(1)}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.StatusCode)
+	}
+	var product handlers.ProductResponse
+	decode(t, resp, &product)
+	if want := []string{images[2], images[0], images[1]}; !reflect.DeepEqual(product.ProductImages, want) {
+		t.Errorf("Expected images %v, but got %v", want, product.ProductImages)
+	}
+
+	tests := []struct {
+		name string
+		ids  []string
+	}{
+		{"too few", []string{id(0), id(1)}},
+		{"too many", []string{id(0), id(1), id(2), id(0)}},
+		{"repeated", []string{id(0), id(0), id(1)}},
+		{"unknown", []string{id(0), id(1), "0123456789abcdef"}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := a.doJSON(t, http.MethodPut, target, handlers.ImageOrder{ImageIDs: tt.ids})
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Expected status 400, but got %d", resp.StatusCode)
+			}
+			if message := errorMessage(t, resp); !strings.Contains(message, "image ID") {
+				t.Errorf("Expected the message to name the image IDs, but got %q", message)
+			}
+		})
+	}
+	if got := a.product(t, productID).ProductImages; !reflect.DeepEqual(got, []string{images[2], images[0], images[1]}) {
+		t.Errorf("Expected rejected orders to leave the images alone, but got %v", got)
+	}
+}
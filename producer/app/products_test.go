@@ -0,0 +1,169 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/handlers"
+)
+
+func TestSaveProductLane(t *testing.T) {
+	a := newTestApp(t, func(cfg *Config) { cfg.Lanes.BulkAfter = 2 })
+	save := func(userID int, header http.Header) {
+		t.Helper()
+		body, _ := json.Marshal(handlers.Product{UserID: userID, ProductName: "Lamp", ProductImages: []string{"http://127.0.0.1/a.jpg"}})
+		req := httptest.NewRequest(http.MethodPost, "/products", bytes.NewReader(body))
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+		if resp := a.do(t, req); resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected status 202, but got %d", resp.StatusCode)
+		}
+	}
+	lanes := func() (int, int) {
+		return a.queued(t, testLanes.Interactive), a.queued(t, testLanes.Bulk)
+	}
+
+	// A user's first products are interactive, even when a client asks for another lane
+	save(1, http.Header{})
+	save(1, http.Header{"X-Job-Lane": {"bulk"}})
+	if interactive, bulk := lanes(); interactive != 2 || bulk != 0 {
+		t.Errorf("Expected 2 interactive jobs, but got %d interactive and %d bulk", interactive, bulk)
+	}
+
+	// Once the user creates products faster than a seller would, they are imported
+	save(1, http.Header{"X-Job-Lane": {"interactive"}})
+	save(1, http.Header{})
+	if interactive, bulk := lanes(); interactive != 2 || bulk != 2 {
+		t.Errorf("Expected the import to go to the bulk lane, but got %d interactive and %d bulk", interactive, bulk)
+	}
+
+	// Other users are not held up by the import
+	save(2, http.Header{})
+	if interactive, _ := lanes(); interactive != 3 {
+		t.Errorf("Expected another user's product to be interactive, but got %d interactive jobs", interactive)
+	}
+
+	// Products created before the window do not count
+	if _, err := a.db.Exec("UPDATE Products SET created_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatalf("Error aging products: %v", err)
+	}
+	save(1, http.Header{})
+	if interactive, _ := lanes(); interactive != 4 {
+		t.Errorf("Expected the user to be interactive again, but got %d interactive jobs", interactive)
+	}
+}
+
+// products counts the stored products
+func (a *testApp) products(t *testing.T) int {
+	t.Helper()
+	var count int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM Products").Scan(&count); err != nil {
+		t.Fatalf("Error counting products: %v", err)
+	}
+	return count
+}
+
+func TestSaveProduct(t *testing.T) {
+	a := newTestApp(t, nil)
+
+	resp := a.doJSON(t, http.MethodPost, "/products", handlers.Product{UserID: 1, ProductName: "Lamp", ProductPrice: 10, ProductImages: []string{"http://127.0.0.1/a.jpg"}})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202, but got %d", resp.StatusCode)
+	}
+	var product handlers.ProductResponse
+	decode(t, resp, &product)
+	location := fmt.Sprintf("/products/%d", product.ProductID)
+	if resp.Header.Get("Location") != location || product.StatusURL != location {
+		t.Errorf("Expected the product at %s, but got Location %q and status URL %q", location, resp.Header.Get("Location"), product.StatusURL)
+	}
+	if product.ProcessingStatus != database.StatusPending || len(product.ProductImages) != 1 || len(product.CompressedProductImages) != 0 {
+		t.Errorf("Expected a pending product with one image, but got %+v", product)
+	}
+	if job := a.takeJob(t, testLanes.Interactive); job.ProductID != product.ProductID {
+		t.Errorf("Expected a job for product %d, but got %+v", product.ProductID, job)
+	}
+	if len(a.events) != 1 || a.events[0] != "product.created.v1" {
+		t.Errorf("Expected a product.created.v1 event, but got %v", a.events)
+	}
+
+	// Uploads are stored among the uploads of the new product
+	resp = a.doMultipart(t, http.MethodPost, "/products", map[string]string{"user_id": "1", "product_name": "Lamp", "product_price": "10"}, testPNG(t, 8, 8))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202 for an upload, but got %d", resp.StatusCode)
+	}
+	decode(t, resp, &product)
+	if keys := a.uploadsOf(t, product.ProductID); len(keys) != 1 || product.ProductImages[0] != "local:"+keys[0] {
+		t.Errorf("Expected the product to reference its upload, but got %v and uploads %v", product.ProductImages, keys)
+	}
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"invalid JSON", httptest.NewRequest(http.MethodPost, "/products", strings.NewReader("{")), http.StatusBadRequest},
+		{"unknown user", jsonRequest(t, handlers.Product{UserID: 99, ProductName: "Lamp"}), http.StatusNotFound},
+		{"URL with a comma", jsonRequest(t, handlers.Product{UserID: 1, ProductImages: []string{"http://127.0.0.1/a.jpg,local:uploads/1/x.png"}}), http.StatusBadRequest},
+		{"storage reference", jsonRequest(t, handlers.Product{UserID: 1, ProductImages: []string{"local:uploads/1/x.png"}}), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Header.Set("Content-Type", "application/json")
+			resp := a.do(t, tt.req)
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, but got %d", tt.status, resp.StatusCode)
+			}
+			errorMessage(t, resp)
+		})
+	}
+	if count := a.products(t); count != 2 {
+		t.Errorf("Expected rejected products not to be stored, but got %d products", count)
+	}
+}
+
+// jsonRequest returns a request creating a product
+func jsonRequest(t *testing.T, product handlers.Product) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(product)
+	if err != nil {
+		t.Fatalf("Error encoding product: %v", err)
+	}
+	return httptest.NewRequest(http.MethodPost, "/products", bytes.NewReader(body))
+}
+
+func TestSaveProductCleanup(t *testing.T) {
+	a := newTestApp(t, nil)
+	fields := map[string]string{"user_id": "1", "product_name": "Lamp", "product_price": "10"}
+
+	// A product with a file that is not an image is not stored, nor are its other files
+	resp := a.doMultipart(t, http.MethodPost, "/products", fields, testPNG(t, 8, 8), []byte("not an image"))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415, but got %d", resp.StatusCode)
+	}
+	errorMessage(t, resp)
+
+	// Nor is a product whose job cannot be queued
+	a.broker.fail = true
+	resp = a.doMultipart(t, http.MethodPost, "/products", fields, testPNG(t, 8, 8))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, but got %d", resp.StatusCode)
+	}
+	errorMessage(t, resp)
+
+	if count := a.products(t); count != 0 {
+		t.Errorf("Expected no product to be stored, but got %d", count)
+	}
+	if objects, err := a.store.List(context.Background(), "uploads/"); err != nil || len(objects) != 0 {
+		t.Errorf("Expected no uploads to be left, but got %d: %v", len(objects), err)
+	}
+	if len(a.events) != 0 {
+		t.Errorf("Expected no event for products that were not stored, but got %v", a.events)
+	}
+}
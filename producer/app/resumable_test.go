@@ -0,0 +1,199 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/producer/uploads"
+)
+
+// createUpload starts a resumable upload of length bytes for a product and returns its URL
+func (a *testApp) createUpload(t *testing.T, productID int64, length int) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "product_id "+base64.StdEncoding.EncodeToString([]byte(fmt.Sprint(productID)))+",filename "+base64.StdEncoding.EncodeToString([]byte("photo.png")))
+	resp := a.do(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201 creating the upload, but got %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// patchUpload sends a chunk of an upload at offset
+func (a *testApp) patchUpload(t *testing.T, location string, offset int, chunk []byte) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPatch, location, bytes.NewReader(chunk))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return a.do(t, req)
+}
+
+// headUpload asks for the state of an upload
+func (a *testApp) headUpload(t *testing.T, location string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodHead, location, nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	return a.do(t, req)
+}
+
+func TestResumableUpload(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t)
+	data := testPNG(t, 64, 64)
+	half := len(data) / 2
+
+	location := a.createUpload(t, productID, len(data))
+	if resp := a.patchUpload(t, location, 0, data[:half]); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("Expected status 204 at offset %d, but got %d at %q", half, resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+
+	// A client that lost the connection asks where to resume
+	resp := a.headUpload(t, location)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) || resp.Header.Get("Upload-Length") != strconv.Itoa(len(data)) {
+		t.Errorf("Expected status 200 at offset %d of %d, but got %d at %q of %q", half, len(data), resp.StatusCode, resp.Header.Get("Upload-Offset"), resp.Header.Get("Upload-Length"))
+	}
+
+	// Sending a chunk at another offset is a conflict that reports the right one
+	resp = a.patchUpload(t, location, 0, data[:half])
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("Expected status 409 reporting offset %d, but got %d at %q", half, resp.StatusCode, resp.Header.Get("Upload-Offset"))
+	}
+	errorMessage(t, resp)
+	if jobs := a.queued(t, testLanes.Interactive); jobs != 0 {
+		t.Errorf("Expected no job before the upload completes, but got %d", jobs)
+	}
+
+	// The last chunk adds the image to the product and queues it
+	if resp := a.patchUpload(t, location, half, data[half:]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", resp.StatusCode)
+	}
+	product := a.product(t, productID)
+	keys := a.uploadsOf(t, productID)
+	if len(product.ProductImages) != 1 || len(keys) != 1 || product.ProductImages[0] != "local:"+keys[0] {
+		t.Fatalf("Expected the product to reference its one upload, but got images %v and uploads %v", product.ProductImages, keys)
+	}
+	if job := a.takeJob(t, testLanes.Interactive); job.ProductID != productID || len(job.Images) != 1 || job.Images[0] != product.ProductImages[0] {
+		t.Errorf("Expected a job for the uploaded image, but got %+v", job)
+	}
+	if parts, _ := a.store.List(context.Background(), "uploads/partial/"); len(parts) != 0 {
+		t.Errorf("Expected the chunks to be deleted, but got %d", len(parts))
+	}
+
+	// A completed upload accepts no more chunks
+	if resp := a.patchUpload(t, location, len(data), []byte{1}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for a completed upload, but got %d", resp.StatusCode)
+	}
+}
+
+func TestResumableUploadClaimed(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t)
+	data := testPNG(t, 16, 16)
+	location := a.createUpload(t, productID, len(data))
+
+	// Another request is assembling the upload, so this one adds nothing
+	if _, err := a.db.Exec("UPDATE ResumableUploads SET assembling_until = '2999-01-01 00:00:00'"); err != nil {
+		t.Fatalf("Error claiming upload: %v", err)
+	}
+	resp := a.patchUpload(t, location, 0, data)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 while another request completes the upload, but got %d", resp.StatusCode)
+	}
+	errorMessage(t, resp)
+	if images := a.product(t, productID).ProductImages; len(images) != 0 || a.queued(t, testLanes.Interactive) != 0 {
+		t.Errorf("Expected no image and no job, but got images %v", images)
+	}
+
+	// Once its claim ran out an empty chunk completes the upload
+	if _, err := a.db.Exec("UPDATE ResumableUploads SET assembling_until = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatalf("Error expiring the claim: %v", err)
+	}
+	if resp := a.patchUpload(t, location, len(data), nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status 204, but got %d", resp.StatusCode)
+	}
+	if images := a.product(t, productID).ProductImages; len(images) != 1 || a.queued(t, testLanes.Interactive) != 1 {
+		t.Errorf("Expected one image queued, but got images %v", images)
+	}
+}
+
+func TestResumableUploadExpired(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t)
+	location := a.createUpload(t, productID, 100)
+	if _, err := a.db.Exec("UPDATE ResumableUploads SET expires_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatalf("Error expiring upload: %v", err)
+	}
+
+	if resp := a.headUpload(t, location); resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected status 410 asking for an expired upload, but got %d", resp.StatusCode)
+	}
+	resp := a.patchUpload(t, location, 0, []byte("chunk"))
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("Expected status 410 continuing an expired upload, but got %d", resp.StatusCode)
+	}
+	errorMessage(t, resp)
+	if resp := a.headUpload(t, "/uploads/unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown upload, but got %d", resp.StatusCode)
+	}
+}
+
+func TestResumableUploadLarge(t *testing.T) {
+	a := newTestApp(t, nil)
+	productID := a.insertProduct(t)
+	// Noise does not compress, so the PNG is larger than the consumer's download limit
+	img := image.NewNRGBA(image.Rect(0, 0, 2600, 2100))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img); err != nil {
+		t.Fatalf("Error encoding image: %v", err)
+	}
+	data := buf.Bytes()
+	if int64(len(data)) <= imageutils.DefaultDownloadLimits.MaxBytes {
+		t.Fatalf("Expected an image over %d bytes, but got %d", imageutils.DefaultDownloadLimits.MaxBytes, len(data))
+	}
+
+	// Chunks larger than the default body limit are streamed to storage
+	location := a.createUpload(t, productID, len(data))
+	for offset, size := 0, 8<<20; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+		if resp := a.patchUpload(t, location, offset, data[offset:end]); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204 for the chunk at %d, but got %d: %s", offset, resp.StatusCode, readAll(t, resp.Body))
+		}
+	}
+	source := a.product(t, productID).ProductImages[0]
+	key := strings.TrimPrefix(source, "local:")
+	r, _, err := a.store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Error reading upload: %v", err)
+	}
+	stored, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(stored, data) {
+		t.Errorf("Stored upload differs from the sent image")
+	}
+
+	// The consumer reads every upload the producer accepts
+	cfg := imageutils.Config{Storage: a.store, MaxUploadBytes: uploads.DefaultMaxBytes}
+	err, images := imageutils.DownloadResizeCompressSaveImages([]string{source}, cfg, fmt.Sprint(productID))
+	if err != nil || len(images) != 1 {
+		t.Errorf("Expected the consumer to process the upload, but got %d images and error %v", len(images), err)
+	}
+}
@@ -0,0 +1,112 @@
+// Command reprocess enqueues existing products so that the consumer regenerates
+// their images, e.g. after the compression settings change. Products are selected
+// by ID range, creation date, processing status and user. Re-running the same job
+// only enqueues products it has not enqueued yet.
+//
+//	go run ./cmd/reprocess -min-id 1 -max-id 5000 -created-after 2023-01-01 -rate 20
+//	go run ./cmd/reprocess -status failed -delay 30m
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/reprocess"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	minID := flag.Int64("min-id", 0, "lowest product ID to reprocess")
+	maxID := flag.Int64("max-id", 0, "highest product ID to reprocess")
+	createdAfter := flag.String("created-after", "", "only products created on or after this date (YYYY-MM-DD)")
+	createdBefore := flag.String("created-before", "", "only products created before this date (YYYY-MM-DD)")
+	status := flag.String("status", "", "only products with this processing status (pending, done or failed)")
+	userID := flag.Int("user", 0, "only products of this user")
+	jobID := flag.String("job", "", "job ID, derived from the filter when empty")
+	rate := flag.Float64("rate", reprocess.DefaultRate, "messages published per second")
+	force := flag.Bool("force", false, "enqueue products the job already enqueued and regenerate them even if they completed")
+	notBefore := flag.String("not-before", "", "process the products from this time on (RFC 3339), e.g. when an embargo lifts")
+	delay := flag.Duration("delay", 0, "process the products after this delay, e.g. 30m")
+	dryRun := flag.Bool("dry-run", false, "list the matching products without enqueueing them")
+	flag.Parse()
+
+	filter := database.ProductFilter{MinProductID: *minID, MaxProductID: *maxID, Status: *status, UserID: *userID}
+	var err error
+	if filter.CreatedAfter, err = reprocess.ParseDate(*createdAfter); err != nil {
+		logrus.Fatalf("Invalid -created-after: %v", err)
+	}
+	if filter.CreatedBefore, err = reprocess.ParseDate(*createdBefore); err != nil {
+		logrus.Fatalf("Invalid -created-before: %v", err)
+	}
+	notBeforeTime, err := reprocess.NotBefore(*notBefore, *delay, time.Now())
+	if err != nil {
+		logrus.Fatalf("Invalid -not-before or -delay: %v", err)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		logrus.Warn("Error loading .env file")
+	}
+	db, err := database.NewDB()
+	if err != nil {
+		logrus.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	if *dryRun {
+		ids, err := database.FindProductIDs(db, filter)
+		if err != nil {
+			logrus.Fatalf("Failed to find products: %v", err)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		fmt.Fprintf(os.Stderr, "%d products match\n", len(ids))
+		return
+	}
+
+	// Reprocessing goes to the bulk lane, so that it does not delay new products
+	queue := msgqueue.LanesFromEnv().Bulk
+	conn, err := msgqueue.NewRMQ()
+	if err != nil {
+		logrus.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	}
+	defer conn.Close()
+	ch, err := msgqueue.NewChannel(conn)
+	if err != nil {
+		logrus.Fatalf("Failed to open a rmq channel: %v", err)
+	}
+	defer ch.Close()
+	if err := msgqueue.DeclareQueue(ch, queue); err != nil {
+		logrus.Fatalf("Failed to declare queue: %v", err)
+	}
+
+	// Stop publishing on Ctrl-C; the job resumes where it stopped when run again
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	publish := func(job msgqueue.Job) error { return msgqueue.PublishJob(job, ch, queue) }
+	last := time.Time{}
+	progress := func(p reprocess.Progress) {
+		done := p.Enqueued + p.Skipped + p.Failed
+		if time.Since(last) < time.Second && done < p.Total {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(os.Stderr, "%s: %d/%d (enqueued %d, skipped %d, failed %d)\n", p.JobID, done, p.Total, p.Enqueued, p.Skipped, p.Failed)
+	}
+	p, err := reprocess.Run(ctx, db, publish, reprocess.Options{Filter: filter, JobID: *jobID, Rate: *rate, Force: *force, NotBefore: notBeforeTime}, progress)
+	if err != nil {
+		logrus.Fatalf("Reprocess job %s stopped: %v", p.JobID, err)
+	}
+	if p.Failed > 0 {
+		logrus.Warnf("%d products could not be enqueued, run the job again to retry them", p.Failed)
+		os.Exit(1)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	sources "github.com/golang_backend_assignment/consumer/database"
 	"github.com/sirupsen/logrus"
 )
 
@@ -58,20 +59,37 @@ func UserExists(db *sql.DB, userID int) error {
 	return nil
 }
 
-func InsertProduct(db *sql.DB, ProductName string, ProductDescription string, ProductPrice float64, productImages []string) (int64, error) {
-	// Join the product images into a comma-separated string
-	productImagesStr := strings.Join(productImages, ",")
+// CountProductsSince counts the products a user created since the given time
+func CountProductsSince(db *sql.DB, userID int, since time.Time) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM Products WHERE user_id = ? AND created_at >= ?", userID, since.Format("2006-01-02 15:04:05")).Scan(&count)
+	if err != nil {
+		logrus.Errorf("Error counting the recent products of user_id %d: %v", userID, err)
+	}
+	return count, err
+}
+
+// Processing statuses of a product's images
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+func InsertProduct(db *sql.DB, userID int, ProductName string, ProductDescription string, ProductPrice float64, productImages []string) (int64, error) {
+	// Store the product images as a list, so a source can never be split in two
+	productImagesStr := sources.EncodeProductImages(productImages)
 
 	// Insert the product into the database
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	stmt, err := db.Prepare("INSERT INTO Products (product_name, product_description, product_images, product_price, created_at) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := db.Prepare("INSERT INTO Products (user_id, product_name, product_description, product_images, product_price, processing_status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		logrus.Errorf("Error preparing SQL statement: %v", err)
 		return 0, err
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(ProductName, ProductDescription, productImagesStr, ProductPrice, currentTime)
+	res, err := stmt.Exec(userID, ProductName, ProductDescription, productImagesStr, ProductPrice, StatusPending, currentTime)
 	if err != nil {
 		logrus.Errorf("Error executing SQL statement: %v", err)
 		return 0, err
@@ -86,3 +104,94 @@ func InsertProduct(db *sql.DB, ProductName string, ProductDescription string, Pr
 	logrus.Infof("Successfully inserted product into the database with ID: %d", productID)
 	return productID, nil
 }
+
+// Product is a stored product with the state of its image processing
+type Product struct {
+	ProductID          int64
+	UserID             int
+	ProductName        string
+	ProductDescription string
+	ProductImages      []string
+	ProductPrice       float64
+	CompressedImages   []string
+	ProcessingStatus   string
+	CreatedAt          string
+	UpdatedAt          string
+}
+
+// GetProduct returns the product with the given ID, or sql.ErrNoRows
+func GetProduct(db *sql.DB, productID int64) (*Product, error) {
+	var userID sql.NullInt64
+	var name, description, images, compressed, status, createdAt, updatedAt sql.NullString
+	var price sql.NullFloat64
+	err := db.QueryRow("SELECT user_id, product_name, product_description, product_images, product_price, compressed_product_images, processing_status, created_at, updated_at FROM Products WHERE product_id = ?", productID).
+		Scan(&userID, &name, &description, &images, &price, &compressed, &status, &createdAt, &updatedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("Error getting product %d: %v", productID, err)
+		}
+		return nil, err
+	}
+	product := &Product{
+		ProductID:          productID,
+		UserID:             int(userID.Int64),
+		ProductName:        name.String,
+		ProductDescription: description.String,
+		ProductImages:      sources.DecodeProductImages(images.String),
+		ProductPrice:       price.Float64,
+		CompressedImages:   splitList(compressed.String),
+		ProcessingStatus:   status.String,
+		CreatedAt:          createdAt.String,
+		UpdatedAt:          updatedAt.String,
+	}
+	if product.ProcessingStatus == "" {
+		product.ProcessingStatus = StatusPending
+	}
+	return product, nil
+}
+
+// splitList splits a comma-separated column into its values
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// AddProductImages appends images to a product and marks it pending, as its new
+// images are yet to be processed. It returns sql.ErrNoRows if the product does not exist.
+func AddProductImages(db *sql.DB, productID int64, productImages []string) error {
+	_, err := updateProductImages(db, productID, StatusPending, func(images []string) ([]string, error) {
+		return append(images, productImages...), nil
+	})
+	return err
+}
+
+// RemoveProductImages takes images off a product again, e.g. after they could not be
+// queued. Images added since are kept.
+func RemoveProductImages(db *sql.DB, productID int64, productImages []string) error {
+	removed := map[string]bool{}
+	for _, image := range productImages {
+		removed[image] = true
+	}
+	_, err := updateProductImages(db, productID, "", func(images []string) ([]string, error) {
+		kept := []string{}
+		for _, image := range images {
+			if !removed[image] {
+				kept = append(kept, image)
+			}
+		}
+		return kept, nil
+	})
+	return err
+}
+
+// DeleteProduct removes a product that could not be saved completely, e.g. because
+// its images could not be stored or queued
+func DeleteProduct(db *sql.DB, productID int64) error {
+	_, err := db.Exec("DELETE FROM Products WHERE product_id = ?", productID)
+	if err != nil {
+		logrus.Errorf("Error deleting product %d: %v", productID, err)
+	}
+	return err
+}
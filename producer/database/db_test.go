@@ -19,10 +19,12 @@ func TestInsertProduct(t *testing.T) {
 	_, err = testDB.Exec(`
 		CREATE TABLE Products (
 			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
 			product_name TEXT,
 			product_description TEXT,
 			product_images TEXT,
 			product_price REAL,
+			processing_status TEXT,
 			created_at TIMESTAMP
 		)
 	`)
@@ -32,16 +34,17 @@ func TestInsertProduct(t *testing.T) {
 
 	// Call the function to insert a product into the test database
 	productImages := []string{"image1.jpg", "image2.jpg"}
-	productID, err := InsertProduct(testDB, "Test Product", "A test product", 9.99, productImages)
+	productID, err := InsertProduct(testDB, 1, "Test Product", "A test product", 9.99, productImages)
 	if err != nil {
 		t.Fatalf("Error inserting product: %v", err)
 	}
 
 	// Check that the product was inserted with the correct values
-	var productName, productDescription, productImagesStr string
+	var userID int
+	var productName, productDescription, productImagesStr, status string
 	var productPrice float64
 	var createdAt time.Time
-	err = testDB.QueryRow("SELECT * FROM Products WHERE id = ?", productID).Scan(&productID, &productName, &productDescription, &productImagesStr, &productPrice, &createdAt)
+	err = testDB.QueryRow("SELECT * FROM Products WHERE id = ?", productID).Scan(&productID, &userID, &productName, &productDescription, &productImagesStr, &productPrice, &status, &createdAt)
 	if err != nil {
 		t.Fatalf("Error querying product: %v", err)
 	}
@@ -51,10 +54,110 @@ func TestInsertProduct(t *testing.T) {
 	if productDescription != "A test product" {
 		t.Errorf("Expected product_description to be 'A test product', but got '%s'", productDescription)
 	}
-	if productImagesStr != "image1.jpg,image2.jpg" {
-		t.Errorf("Expected product_images to be 'image1.jpg,image2.jpg', but got '%s'", productImagesStr)
+	if productImagesStr != `["image1.jpg","image2.jpg"]` {
+		t.Errorf(`Expected product_images to be '["image1.jpg","image2.jpg"]', but got '%s'`, productImagesStr)
 	}
 	if productPrice != 9.99 {
 		t.Errorf("Expected product_price to be 9.99, but got %f", productPrice)
 	}
+	if userID != 1 {
+		t.Errorf("Expected user_id to be 1, but got %d", userID)
+	}
+	if status != StatusPending {
+		t.Errorf("Expected processing_status to be '%s', but got '%s'", StatusPending, status)
+	}
+}
+
+func TestGetProduct(t *testing.T) {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	defer testDB.Close()
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (
+			product_id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			product_name TEXT,
+			product_description TEXT,
+			product_images TEXT,
+			product_price REAL,
+			compressed_product_images TEXT,
+			processing_status TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		);
+		INSERT INTO Products VALUES (1, 2, 'Lamp', 'A lamp', 'http://a/1.jpg,http://a/2.jpg', 12.5, 'local:1/x_w1024.jpg', 'done', '2023-01-01 10:00:00', '2023-01-01 10:05:00');
+		INSERT INTO Products (product_id, product_name) VALUES (2, 'Old');
+	`)
+	if err != nil {
+		t.Fatalf("Error creating Products table: %v", err)
+	}
+
+	product, err := GetProduct(testDB, 1)
+	if err != nil {
+		t.Fatalf("Error getting product: %v", err)
+	}
+	if product.UserID != 2 || product.ProductName != "Lamp" || product.ProductPrice != 12.5 || product.ProcessingStatus != StatusDone {
+		t.Errorf("Unexpected product: %+v", product)
+	}
+	if len(product.ProductImages) != 2 || len(product.CompressedImages) != 1 {
+		t.Errorf("Unexpected images: %v and %v", product.ProductImages, product.CompressedImages)
+	}
+
+	// Columns left empty by older rows get defaults
+	product, err = GetProduct(testDB, 2)
+	if err != nil {
+		t.Fatalf("Error getting product: %v", err)
+	}
+	if product.ProcessingStatus != StatusPending || len(product.CompressedImages) != 0 {
+		t.Errorf("Unexpected product: %+v", product)
+	}
+
+	if _, err := GetProduct(testDB, 3); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing product, but got %v", err)
+	}
+}
+
+func TestAddProductImages(t *testing.T) {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	defer testDB.Close()
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (
+			product_id INTEGER PRIMARY KEY,
+			product_images TEXT,
+			processing_status TEXT,
+			updated_at TEXT
+		);
+		INSERT INTO Products VALUES (1, 'http://a/1.jpg', 'done', NULL);
+		INSERT INTO Products VALUES (2, '', 'done', NULL);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating Products table: %v", err)
+	}
+
+	if err := AddProductImages(testDB, 1, []string{"local:uploads/a.png"}); err != nil {
+		t.Fatalf("Error adding images: %v", err)
+	}
+	if err := AddProductImages(testDB, 2, []string{"local:uploads/b.png", "local:uploads/c.png"}); err != nil {
+		t.Fatalf("Error adding images: %v", err)
+	}
+	for id, want := range map[int]string{1: `["http://a/1.jpg","local:uploads/a.png"]`, 2: `["local:uploads/b.png","local:uploads/c.png"]`} {
+		var images, status string
+		if err := testDB.QueryRow("SELECT product_images, processing_status FROM Products WHERE product_id = ?", id).Scan(&images, &status); err != nil {
+			t.Fatalf("Error querying product: %v", err)
+		}
+		if images != want || status != StatusPending {
+			t.Errorf("Product %d: expected images %q and status pending, but got %q and %q", id, want, images, status)
+		}
+	}
+
+	if err := AddProductImages(testDB, 3, []string{"local:uploads/d.png"}); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing product, but got %v", err)
+	}
 }
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IdempotencyRecord is the stored outcome of a request made with an Idempotency-Key
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	Completed   bool // false while the first request is still being handled
+	StatusCode  int
+	ContentType string
+	Location    string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// GetIdempotencyRecord returns the record stored for key, or sql.ErrNoRows
+func GetIdempotencyRecord(db *sql.DB, key string) (*IdempotencyRecord, error) {
+	rec := &IdempotencyRecord{Key: key}
+	var createdAt string
+	var body sql.NullString
+	err := db.QueryRow("SELECT request_hash, completed, status_code, content_type, location, response_body, created_at FROM IdempotencyKeys WHERE idem_key = ?", key).
+		Scan(&rec.RequestHash, &rec.Completed, &rec.StatusCode, &rec.ContentType, &rec.Location, &body, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	rec.Body = []byte(body.String)
+	rec.CreatedAt, err = parseTime(createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// parseTime reads a DATETIME column, which drivers return in different layouts
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// ReserveIdempotencyKey records that a request with key is being handled. It returns
+// false if a record for key already exists.
+func ReserveIdempotencyKey(db *sql.DB, key string, requestHash string) (bool, error) {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("INSERT INTO IdempotencyKeys (idem_key, request_hash, completed, status_code, content_type, location, response_body, created_at) VALUES (?, ?, ?, 0, '', '', '', ?)", key, requestHash, false, currentTime)
+	if err != nil {
+		// Most likely the primary key, i.e. a concurrent request with the same key
+		var count int
+		if qerr := db.QueryRow("SELECT COUNT(*) FROM IdempotencyKeys WHERE idem_key = ?", key).Scan(&count); qerr == nil && count > 0 {
+			return false, nil
+		}
+		logrus.Errorf("Error reserving idempotency key: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// ReclaimIdempotencyKey takes over a key whose request never completed, reserving it
+// for a request with requestHash. It returns false if the key was completed or
+// reclaimed by another request since it was read with createdAt.
+func ReclaimIdempotencyKey(db *sql.DB, key string, requestHash string, createdAt time.Time) (bool, error) {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE IdempotencyKeys SET request_hash = ?, created_at = ? WHERE idem_key = ? AND completed = ? AND created_at = ?", requestHash, currentTime, key, false, createdAt.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("Error reclaiming idempotency key: %v", err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request made with key
+func CompleteIdempotencyKey(db *sql.DB, key string, statusCode int, contentType string, location string, body []byte) error {
+	_, err := db.Exec("UPDATE IdempotencyKeys SET completed = ?, status_code = ?, content_type = ?, location = ?, response_body = ? WHERE idem_key = ?", true, statusCode, contentType, location, string(body), key)
+	if err != nil {
+		logrus.Errorf("Error storing idempotent response: %v", err)
+	}
+	return err
+}
+
+// DeleteIdempotencyKey forgets key, so that the request can be retried
+func DeleteIdempotencyKey(db *sql.DB, key string) error {
+	_, err := db.Exec("DELETE FROM IdempotencyKeys WHERE idem_key = ?", key)
+	return err
+}
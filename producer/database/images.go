@@ -0,0 +1,134 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	sources "github.com/golang_backend_assignment/consumer/database"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageID identifies an image of a product. It is derived from the image's source,
+// which is unique within a product, so it stays the same when images are reordered.
+func ImageID(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+// SetProductImages replaces the images of a product, e.g. to reorder or remove some
+func SetProductImages(db *sql.DB, productID int64, productImages []string) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE Products SET product_images = ?, updated_at = ? WHERE product_id = ?", sources.EncodeProductImages(productImages), currentTime, productID)
+	if err != nil {
+		logrus.Errorf("Error updating images of product %d: %v", productID, err)
+	}
+	return err
+}
+
+// ErrImagesChanged is returned when the images of a product kept changing while
+// they were being updated
+var ErrImagesChanged = errors.New("images of the product changed concurrently")
+
+// imagesUpdateAttempts is how often the images of a product are read again when
+// another update changed them before they could be written
+const imagesUpdateAttempts = 5
+
+// UpdateProductImages replaces the images of a product with those update returns for
+// its current ones, and returns them. Errors of update are returned as they are, and
+// sql.ErrNoRows if the product does not exist.
+func UpdateProductImages(db *sql.DB, productID int64, update func(images []string) ([]string, error)) ([]string, error) {
+	return updateProductImages(db, productID, "", update)
+}
+
+// updateProductImages is UpdateProductImages that also sets the processing status,
+// unless it is empty. Rather than locking the row with SELECT … FOR UPDATE, which
+// SQLite does not support, the images are only written if they are still the ones
+// that were read, and read again otherwise. Concurrent updates never undo each other.
+func updateProductImages(db *sql.DB, productID int64, status string, update func(images []string) ([]string, error)) ([]string, error) {
+	for attempt := 0; attempt < imagesUpdateAttempts; attempt++ {
+		var current sql.NullString
+		if err := db.QueryRow("SELECT product_images FROM Products WHERE product_id = ?", productID).Scan(&current); err != nil {
+			if err != sql.ErrNoRows {
+				logrus.Errorf("Error getting images of product %d: %v", productID, err)
+			}
+			return nil, err
+		}
+		images, err := update(sources.DecodeProductImages(current.String))
+		if err != nil {
+			return nil, err
+		}
+		encoded := sources.EncodeProductImages(images)
+		// MySQL counts unchanged rows as unaffected, so an update that changes
+		// nothing is not written
+		if encoded == current.String && status == "" {
+			return images, nil
+		}
+
+		currentTime := time.Now().Format("2006-01-02 15:04:05")
+		query, args := "UPDATE Products SET product_images = ?, updated_at = ?", []interface{}{encoded, currentTime}
+		if status != "" {
+			query, args = query+", processing_status = ?", append(args, status)
+		}
+		res, err := db.Exec(query+" WHERE product_id = ? AND COALESCE(product_images, '') = ?", append(args, productID, current.String)...)
+		if err != nil {
+			logrus.Errorf("Error updating images of product %d: %v", productID, err)
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			return images, nil
+		}
+	}
+	logrus.Warnf("Images of product %d changed on every one of %d attempts to update them", productID, imagesUpdateAttempts)
+	return nil, ErrImagesChanged
+}
+
+// CompressedImage is an output recorded by the consumer for an image of a product
+type CompressedImage struct {
+	SourceURL   string
+	Rendition   string
+	Backend     string
+	Key         string
+	OriginalKey string
+}
+
+// GetCompressedImages returns the outputs recorded for a product, oldest first
+func GetCompressedImages(db *sql.DB, productID int64) ([]CompressedImage, error) {
+	rows, err := db.Query("SELECT source_url, rendition, storage_backend, storage_key, original_key FROM CompressedImages WHERE product_id = ? ORDER BY id", productID)
+	if err != nil {
+		logrus.Errorf("Error querying compressed images of product %d: %v", productID, err)
+		return nil, err
+	}
+	defer rows.Close()
+	images := []CompressedImage{}
+	for rows.Next() {
+		var img CompressedImage
+		if err := rows.Scan(&img.SourceURL, &img.Rendition, &img.Backend, &img.Key, &img.OriginalKey); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// DeleteCompressedImages forgets the outputs recorded for an image of a product
+func DeleteCompressedImages(db *sql.DB, productID int64, source string) error {
+	_, err := db.Exec("DELETE FROM CompressedImages WHERE product_id = ? AND source_url = ?", productID, source)
+	if err != nil {
+		logrus.Errorf("Error deleting compressed images of product %d: %v", productID, err)
+	}
+	return err
+}
+
+// RebuildCompressedProductImages rewrites the compressed_product_images of a product
+// from its recorded outputs, as the consumer does after processing, e.g. after its
+// images were reordered or removed
+func RebuildCompressedProductImages(db *sql.DB, productID int64) error {
+	return sources.RebuildCompressedProductImages(db, int(productID))
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newImagesDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (
+			product_id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			product_name TEXT,
+			product_description TEXT,
+			product_images TEXT,
+			product_price REAL,
+			compressed_product_images TEXT,
+			processing_status TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		);
+		CREATE TABLE CompressedImages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			product_id INTEGER,
+			source_url TEXT,
+			rendition TEXT,
+			storage_backend TEXT,
+			storage_key TEXT,
+			original_key TEXT DEFAULT ''
+		);
+		INSERT INTO Products (product_id, product_images) VALUES (1, 'http://a/1.jpg,http://a/2.jpg,local:uploads/3.png');
+		INSERT INTO CompressedImages (product_id, source_url, rendition, storage_backend, storage_key, original_key) VALUES
+			(1, 'http://a/1.jpg', 'w1024', 'local', '1/one_w1024.jpg', '1/originals/one.jpg'),
+			(1, 'http://a/1.jpg', 'w256', 'local', '1/one_w256.jpg', '1/originals/one.jpg'),
+			(1, 'local:uploads/3.png', 'w1024', 'local', '1/three_w1024.png', 'uploads/3.png'),
+			(1, 'http://a/1.jpg', 'w1024', 'local', '1/one_v2_w1024.jpg', '1/originals/one.jpg'),
+			(2, 'http://a/1.jpg', 'w1024', 'local', '2/other_w1024.jpg', '');
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func compressedProductImages(t *testing.T, db *sql.DB) string {
+	var compressed sql.NullString
+	if err := db.QueryRow("SELECT compressed_product_images FROM Products WHERE product_id = 1").Scan(&compressed); err != nil {
+		t.Fatalf("Error querying product: %v", err)
+	}
+	return compressed.String
+}
+
+func TestImageID(t *testing.T) {
+	if ImageID("http://a/1.jpg") != ImageID("http://a/1.jpg") || ImageID("http://a/1.jpg") == ImageID("http://a/2.jpg") {
+		t.Errorf("Expected image IDs to be stable and distinct per source")
+	}
+	if len(ImageID("http://a/1.jpg")) != 16 {
+		t.Errorf("Expected a 16 character image ID, but got %q", ImageID("http://a/1.jpg"))
+	}
+}
+
+func TestRebuildCompressedProductImages(t *testing.T) {
+	testDB := newImagesDB(t)
+
+	// Outputs follow the image order and use the latest output of each rendition
+	if err := RebuildCompressedProductImages(testDB, 1); err != nil {
+		t.Fatalf("Error rebuilding compressed images: %v", err)
+	}
+	expected := "local:1/one_v2_w1024.jpg,local:1/one_w256.jpg,local:1/three_w1024.png"
+	if got := compressedProductImages(t, testDB); got != expected {
+		t.Errorf("Expected compressed_product_images %q, but got %q", expected, got)
+	}
+
+	// Reordering the images reorders their outputs
+	if err := SetProductImages(testDB, 1, []string{"local:uploads/3.png", "http://a/2.jpg", "http://a/1.jpg"}); err != nil {
+		t.Fatalf("Error setting images: %v", err)
+	}
+	if err := RebuildCompressedProductImages(testDB, 1); err != nil {
+		t.Fatalf("Error rebuilding compressed images: %v", err)
+	}
+	expected = "local:1/three_w1024.png,local:1/one_v2_w1024.jpg,local:1/one_w256.jpg"
+	if got := compressedProductImages(t, testDB); got != expected {
+		t.Errorf("Expected compressed_product_images %q, but got %q", expected, got)
+	}
+}
+
+func TestDeleteCompressedImages(t *testing.T) {
+	testDB := newImagesDB(t)
+
+	if err := DeleteCompressedImages(testDB, 1, "http://a/1.jpg"); err != nil {
+		t.Fatalf("Error deleting compressed images: %v", err)
+	}
+	images, err := GetCompressedImages(testDB, 1)
+	if err != nil {
+		t.Fatalf("Error getting compressed images: %v", err)
+	}
+	expected := []CompressedImage{{SourceURL: "local:uploads/3.png", Rendition: "w1024", Backend: "local", Key: "1/three_w1024.png", OriginalKey: "uploads/3.png"}}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, images)
+	}
+
+	// Outputs of other products are kept
+	others, err := GetCompressedImages(testDB, 2)
+	if err != nil || len(others) != 1 {
+		t.Errorf("Expected the other product's output to be kept, but got %v, %v", others, err)
+	}
+}
+
+func TestUpdateProductImages(t *testing.T) {
+	testDB := newImagesDB(t)
+	images := func() []string {
+		product, err := GetProduct(testDB, 1)
+		if err != nil {
+			t.Fatalf("Error getting product: %v", err)
+		}
+		return product.ProductImages
+	}
+
+	// An update that raced another one is applied to the images the other one wrote
+	calls := 0
+	got, err := UpdateProductImages(testDB, 1, func(current []string) ([]string, error) {
+		calls++
+		if calls == 1 {
+			if err := AddProductImages(testDB, 1, []string{"http://a/4.jpg"}); err != nil {
+				t.Fatalf("Error adding images: %v", err)
+			}
+		}
+		return current[1:], nil
+	})
+	if err != nil {
+		t.Fatalf("Error updating images: %v", err)
+	}
+	expected := []string{"http://a/2.jpg", "local:uploads/3.png", "http://a/4.jpg"}
+	if calls != 2 || !reflect.DeepEqual(got, expected) || !reflect.DeepEqual(images(), expected) {
+		t.Errorf("Expected %v after 2 attempts, but got %v and %v after %d", expected, got, images(), calls)
+	}
+
+	// Images that never stop changing are left alone
+	_, err = UpdateProductImages(testDB, 1, func(current []string) ([]string, error) {
+		if err := SetProductImages(testDB, 1, append(current, "http://a/5.jpg")); err != nil {
+			t.Fatalf("Error setting images: %v", err)
+		}
+		return nil, nil
+	})
+	if err != ErrImagesChanged {
+		t.Errorf("Expected ErrImagesChanged, but got %v", err)
+	}
+
+	// Errors of the update are returned as they are
+	stop := errors.New("stop")
+	if _, err := UpdateProductImages(testDB, 1, func([]string) ([]string, error) { return nil, stop }); err != stop {
+		t.Errorf("Expected the update's error, but got %v", err)
+	}
+	if _, err := UpdateProductImages(testDB, 9, func(current []string) ([]string, error) { return current, nil }); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing product, but got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProductFilter selects the products a reprocessing job covers. Zero fields match every product.
+type ProductFilter struct {
+	MinProductID  int64      `json:"min_product_id,omitempty"`
+	MaxProductID  int64      `json:"max_product_id,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	UserID        int        `json:"user_id,omitempty"`
+}
+
+// FindProductIDs returns the IDs of the products matching filter in ascending order
+func FindProductIDs(db *sql.DB, filter ProductFilter) ([]int64, error) {
+	conds := []string{}
+	args := []interface{}{}
+	if filter.MinProductID > 0 {
+		conds = append(conds, "product_id >= ?")
+		args = append(args, filter.MinProductID)
+	}
+	if filter.MaxProductID > 0 {
+		conds = append(conds, "product_id <= ?")
+		args = append(args, filter.MaxProductID)
+	}
+	if filter.CreatedAfter != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, filter.CreatedAfter.Format("2006-01-02 15:04:05"))
+	}
+	if filter.CreatedBefore != nil {
+		conds = append(conds, "created_at < ?")
+		args = append(args, filter.CreatedBefore.Format("2006-01-02 15:04:05"))
+	}
+	if filter.Status != "" {
+		conds = append(conds, "processing_status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.UserID > 0 {
+		conds = append(conds, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	query := "SELECT product_id FROM Products"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY product_id"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logrus.Errorf("Error querying products: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ReprocessProgress summarises a reprocessing job
+type ReprocessProgress struct {
+	JobID     string `json:"job_id"`
+	Total     int    `json:"total"`
+	Enqueued  int    `json:"enqueued"`
+	Completed int    `json:"completed"`
+	Failed    int    `json:"failed"`
+}
+
+// CreateReprocessJob records a job unless one with the same ID exists, and returns
+// whether it was created
+func CreateReprocessJob(db *sql.DB, jobID string, filter string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM ReprocessJobs WHERE id = ?", jobID).Scan(&count)
+	if err != nil {
+		logrus.Errorf("Error checking reprocess job %s: %v", jobID, err)
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err = db.Exec("INSERT INTO ReprocessJobs (id, filter, total, created_at, updated_at) VALUES (?, ?, 0, ?, ?)", jobID, filter, currentTime, currentTime)
+	if err != nil {
+		logrus.Errorf("Error creating reprocess job %s: %v", jobID, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// SetReprocessJobTotal records how many products a job matched
+func SetReprocessJobTotal(db *sql.DB, jobID string, total int) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE ReprocessJobs SET total = ?, updated_at = ? WHERE id = ?", total, currentTime, jobID)
+	return err
+}
+
+// AddReprocessItem records that a product is enqueued for a job. It returns false
+// when the product was already enqueued by an earlier run of the same job.
+func AddReprocessItem(db *sql.DB, jobID string, productID int64) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM ReprocessItems WHERE job_id = ? AND product_id = ?", jobID, productID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err = db.Exec("INSERT INTO ReprocessItems (job_id, product_id, enqueued_at) VALUES (?, ?, ?)", jobID, productID, currentTime)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ResetReprocessItem marks an item as enqueued again, for jobs that are forced to re-run
+func ResetReprocessItem(db *sql.DB, jobID string, productID int64) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE ReprocessItems SET enqueued_at = ?, completed_at = NULL, error = NULL WHERE job_id = ? AND product_id = ?", currentTime, jobID, productID)
+	return err
+}
+
+// RemoveReprocessItem forgets an item whose message could not be published, so that
+// the next run of the job enqueues it again
+func RemoveReprocessItem(db *sql.DB, jobID string, productID int64) error {
+	_, err := db.Exec("DELETE FROM ReprocessItems WHERE job_id = ? AND product_id = ?", jobID, productID)
+	return err
+}
+
+// GetReprocessProgress returns the progress of a job, or sql.ErrNoRows if it does not exist
+func GetReprocessProgress(db *sql.DB, jobID string) (ReprocessProgress, error) {
+	progress := ReprocessProgress{JobID: jobID}
+	err := db.QueryRow("SELECT total FROM ReprocessJobs WHERE id = ?", jobID).Scan(&progress.Total)
+	if err != nil {
+		return progress, err
+	}
+	var completed, failed sql.NullInt64
+	err = db.QueryRow(`SELECT COUNT(*),
+		SUM(CASE WHEN completed_at IS NOT NULL AND (error IS NULL OR error = '') THEN 1 ELSE 0 END),
+		SUM(CASE WHEN error IS NOT NULL AND error <> '' THEN 1 ELSE 0 END)
+		FROM ReprocessItems WHERE job_id = ?`, jobID).Scan(&progress.Enqueued, &completed, &failed)
+	if err != nil {
+		logrus.Errorf("Error getting progress of reprocess job %s: %v", jobID, err)
+		return progress, err
+	}
+	progress.Completed = int(completed.Int64)
+	progress.Failed = int(failed.Int64)
+	return progress, nil
+}
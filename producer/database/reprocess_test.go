@@ -0,0 +1,121 @@
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newReprocessDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (
+			product_id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			processing_status TEXT,
+			created_at TIMESTAMP
+		);
+		CREATE TABLE ReprocessJobs (
+			id TEXT PRIMARY KEY,
+			filter TEXT,
+			total INTEGER,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		);
+		CREATE TABLE ReprocessItems (
+			job_id TEXT,
+			product_id INTEGER,
+			enqueued_at TIMESTAMP,
+			completed_at TIMESTAMP NULL,
+			error TEXT,
+			PRIMARY KEY (job_id, product_id)
+		);
+		INSERT INTO Products VALUES
+			(1, 1, 'done', '2023-01-10 10:00:00'),
+			(2, 2, 'failed', '2023-02-10 10:00:00'),
+			(3, 1, 'done', '2023-03-10 10:00:00'),
+			(4, 1, 'pending', '2023-04-10 10:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func TestFindProductIDs(t *testing.T) {
+	testDB := newReprocessDB(t)
+	date := func(s string) *time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return &d
+	}
+
+	tests := []struct {
+		name   string
+		filter ProductFilter
+		want   []int64
+	}{
+		{"all", ProductFilter{}, []int64{1, 2, 3, 4}},
+		{"id range", ProductFilter{MinProductID: 2, MaxProductID: 3}, []int64{2, 3}},
+		{"created", ProductFilter{CreatedAfter: date("2023-02-01"), CreatedBefore: date("2023-04-01")}, []int64{2, 3}},
+		{"status", ProductFilter{Status: StatusDone}, []int64{1, 3}},
+		{"user", ProductFilter{UserID: 1, MinProductID: 2}, []int64{3, 4}},
+		{"none", ProductFilter{UserID: 9}, []int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := FindProductIDs(testDB, tt.filter)
+			if err != nil {
+				t.Fatalf("Error finding products: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("Expected %v, but got %v", tt.want, ids)
+			}
+		})
+	}
+}
+
+func TestReprocessProgress(t *testing.T) {
+	testDB := newReprocessDB(t)
+
+	created, err := CreateReprocessJob(testDB, "job", "{}")
+	if err != nil || !created {
+		t.Fatalf("Expected the job to be created, got %v, %v", created, err)
+	}
+	created, err = CreateReprocessJob(testDB, "job", "{}")
+	if err != nil || created {
+		t.Fatalf("Expected the existing job to be kept, got %v, %v", created, err)
+	}
+	if err := SetReprocessJobTotal(testDB, "job", 3); err != nil {
+		t.Fatalf("Error setting total: %v", err)
+	}
+	for _, id := range []int64{1, 2, 3} {
+		if added, err := AddReprocessItem(testDB, "job", id); err != nil || !added {
+			t.Fatalf("Expected product %d to be added, got %v, %v", id, added, err)
+		}
+	}
+	if added, _ := AddReprocessItem(testDB, "job", 1); added {
+		t.Error("Expected product 1 not to be added twice")
+	}
+	testDB.Exec("UPDATE ReprocessItems SET completed_at = '2023-05-01 10:00:00' WHERE product_id IN (1, 2)")
+	testDB.Exec("UPDATE ReprocessItems SET error = 'boom' WHERE product_id = 2")
+
+	progress, err := GetReprocessProgress(testDB, "job")
+	if err != nil {
+		t.Fatalf("Error getting progress: %v", err)
+	}
+	want := ReprocessProgress{JobID: "job", Total: 3, Enqueued: 3, Completed: 1, Failed: 1}
+	if progress != want {
+		t.Errorf("Expected %+v, but got %+v", want, progress)
+	}
+
+	if _, err := GetReprocessProgress(testDB, "missing"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing job, but got %v", err)
+	}
+}
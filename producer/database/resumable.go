@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ResumableUpload is an image being uploaded in chunks for a product
+type ResumableUpload struct {
+	UploadID  string
+	ProductID int64
+	Filename  string
+	Length    int64 // total size announced by the client
+	Offset    int64 // bytes received so far
+	ImageRef  string
+	ExpiresAt time.Time
+}
+
+// Completed reports whether every byte was received and the image stored
+func (u *ResumableUpload) Completed() bool {
+	return u.ImageRef != ""
+}
+
+// CreateResumableUpload records a new upload
+func CreateResumableUpload(db *sql.DB, upload ResumableUpload) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("INSERT INTO ResumableUploads (upload_id, product_id, filename, upload_length, upload_offset, image_ref, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, 0, '', ?, ?, ?)",
+		upload.UploadID, upload.ProductID, upload.Filename, upload.Length, upload.ExpiresAt.Format("2006-01-02 15:04:05"), currentTime, currentTime)
+	if err != nil {
+		logrus.Errorf("Error creating resumable upload: %v", err)
+	}
+	return err
+}
+
+// GetResumableUpload returns the upload with the given ID, or sql.ErrNoRows
+func GetResumableUpload(db *sql.DB, uploadID string) (*ResumableUpload, error) {
+	upload := &ResumableUpload{UploadID: uploadID}
+	var ref sql.NullString
+	var expiresAt string
+	err := db.QueryRow("SELECT product_id, filename, upload_length, upload_offset, image_ref, expires_at FROM ResumableUploads WHERE upload_id = ?", uploadID).
+		Scan(&upload.ProductID, &upload.Filename, &upload.Length, &upload.Offset, &ref, &expiresAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("Error getting resumable upload %s: %v", uploadID, err)
+		}
+		return nil, err
+	}
+	upload.ImageRef = ref.String
+	upload.ExpiresAt, err = parseTime(expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AdvanceResumableUpload moves the offset of an upload from one value to another. It
+// returns false if the offset is no longer from, i.e. a concurrent request stored
+// the same chunk first.
+func AdvanceResumableUpload(db *sql.DB, uploadID string, from int64, to int64) (bool, error) {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE ResumableUploads SET upload_offset = ?, updated_at = ? WHERE upload_id = ? AND upload_offset = ?", to, currentTime, uploadID, from)
+	if err != nil {
+		logrus.Errorf("Error advancing resumable upload %s: %v", uploadID, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ClaimResumableUpload reserves a fully received upload for assembling until the
+// given time, so that of several requests finishing it only one assembles and queues
+// the image. It returns false if the upload was completed, or claimed by another
+// request whose claim has not run out, e.g. because that request crashed.
+func ClaimResumableUpload(db *sql.DB, uploadID string, now time.Time, until time.Time) (bool, error) {
+	res, err := db.Exec("UPDATE ResumableUploads SET assembling_until = ?, updated_at = ? WHERE upload_id = ? AND image_ref = '' AND (assembling_until IS NULL OR assembling_until < ?)",
+		until.Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"), uploadID, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("Error claiming resumable upload %s: %v", uploadID, err)
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseResumableUpload gives up the claim on an upload, so that it can be
+// assembled again
+func ReleaseResumableUpload(db *sql.DB, uploadID string) error {
+	_, err := db.Exec("UPDATE ResumableUploads SET assembling_until = NULL WHERE upload_id = ?", uploadID)
+	if err != nil {
+		logrus.Errorf("Error releasing resumable upload %s: %v", uploadID, err)
+	}
+	return err
+}
+
+// CompleteResumableUpload records where the assembled image of an upload was stored
+func CompleteResumableUpload(db *sql.DB, uploadID string, imageRef string) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	_, err := db.Exec("UPDATE ResumableUploads SET image_ref = ?, updated_at = ? WHERE upload_id = ?", imageRef, currentTime, uploadID)
+	if err != nil {
+		logrus.Errorf("Error completing resumable upload %s: %v", uploadID, err)
+	}
+	return err
+}
+
+// DeleteResumableUpload forgets an upload
+func DeleteResumableUpload(db *sql.DB, uploadID string) error {
+	_, err := db.Exec("DELETE FROM ResumableUploads WHERE upload_id = ?", uploadID)
+	if err != nil {
+		logrus.Errorf("Error deleting resumable upload %s: %v", uploadID, err)
+	}
+	return err
+}
+
+// ExpiredResumableUploads returns the IDs of uploads that expired before now
+func ExpiredResumableUploads(db *sql.DB, now time.Time) ([]string, error) {
+	rows, err := db.Query("SELECT upload_id FROM ResumableUploads WHERE expires_at < ?", now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("Error querying expired resumable uploads: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
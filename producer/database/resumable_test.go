@@ -0,0 +1,95 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestResumableUpload(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE ResumableUploads (
+			upload_id TEXT PRIMARY KEY,
+			product_id INTEGER,
+			filename TEXT,
+			upload_length INTEGER,
+			upload_offset INTEGER DEFAULT 0,
+			image_ref TEXT DEFAULT '',
+			assembling_until TEXT,
+			expires_at TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Error creating ResumableUploads table: %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	err = CreateResumableUpload(db, ResumableUpload{UploadID: "u1", ProductID: 3, Filename: "a.jpg", Length: 100, ExpiresAt: expires})
+	if err != nil {
+		t.Fatalf("Error creating upload: %v", err)
+	}
+	upload, err := GetResumableUpload(db, "u1")
+	if err != nil {
+		t.Fatalf("Error getting upload: %v", err)
+	}
+	if upload.ProductID != 3 || upload.Filename != "a.jpg" || upload.Length != 100 || upload.Offset != 0 || upload.Completed() || !upload.ExpiresAt.Equal(expires) {
+		t.Errorf("Unexpected upload: %+v", upload)
+	}
+
+	// Only the first of two requests sending the same chunk advances the offset
+	if ok, err := AdvanceResumableUpload(db, "u1", 0, 60); err != nil || !ok {
+		t.Fatalf("AdvanceResumableUpload() = %v, %v, want true", ok, err)
+	}
+	if ok, err := AdvanceResumableUpload(db, "u1", 0, 60); err != nil || ok {
+		t.Errorf("AdvanceResumableUpload() = %v, %v, want false for a stale offset", ok, err)
+	}
+
+	// Only one request assembles the upload, until its claim runs out or is released
+	now := time.Now()
+	if ok, err := ClaimResumableUpload(db, "u1", now, now.Add(time.Minute)); err != nil || !ok {
+		t.Fatalf("ClaimResumableUpload() = %v, %v, want true", ok, err)
+	}
+	if ok, err := ClaimResumableUpload(db, "u1", now, now.Add(time.Minute)); err != nil || ok {
+		t.Errorf("ClaimResumableUpload() = %v, %v, want false for a claimed upload", ok, err)
+	}
+	if ok, err := ClaimResumableUpload(db, "u1", now.Add(2*time.Minute), now.Add(3*time.Minute)); err != nil || !ok {
+		t.Errorf("ClaimResumableUpload() = %v, %v, want true once the claim ran out", ok, err)
+	}
+	if err := ReleaseResumableUpload(db, "u1"); err != nil {
+		t.Fatalf("Error releasing upload: %v", err)
+	}
+	if ok, err := ClaimResumableUpload(db, "u1", now, now.Add(time.Minute)); err != nil || !ok {
+		t.Errorf("ClaimResumableUpload() = %v, %v, want true for a released upload", ok, err)
+	}
+
+	if err := CompleteResumableUpload(db, "u1", "local:uploads/a.jpg"); err != nil {
+		t.Fatalf("Error completing upload: %v", err)
+	}
+	upload, _ = GetResumableUpload(db, "u1")
+	if upload.Offset != 60 || !upload.Completed() {
+		t.Errorf("Unexpected upload: %+v", upload)
+	}
+	if ok, err := ClaimResumableUpload(db, "u1", now.Add(time.Hour), now.Add(2*time.Hour)); err != nil || ok {
+		t.Errorf("ClaimResumableUpload() = %v, %v, want false for a completed upload", ok, err)
+	}
+
+	ids, err := ExpiredResumableUploads(db, time.Now().Add(2*time.Hour))
+	if err != nil || len(ids) != 1 || ids[0] != "u1" {
+		t.Errorf("ExpiredResumableUploads() = %v, %v", ids, err)
+	}
+	if err := DeleteResumableUpload(db, "u1"); err != nil {
+		t.Fatalf("Error deleting upload: %v", err)
+	}
+	if _, err := GetResumableUpload(db, "u1"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a deleted upload, but got %v", err)
+	}
+}
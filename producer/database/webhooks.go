@@ -0,0 +1,229 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookSubscription is an endpoint notified of product events. Without a user ID
+// it covers the products of every user.
+type WebhookSubscription struct {
+	ID        int64     `json:"id"`
+	UserID    *int      `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is an event sent, or being sent, to a subscription
+type WebhookDelivery struct {
+	ID             int64            `json:"id"`
+	SubscriptionID int64            `json:"subscription_id"`
+	Event          string           `json:"event"`
+	ProductID      int64            `json:"product_id"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	ResponseStatus int              `json:"response_status"`
+	LastError      string           `json:"last_error"`
+	NextAttemptAt  time.Time        `json:"next_attempt_at"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	AttemptLog     []WebhookAttempt `json:"attempt_log"`
+}
+
+// WebhookAttempt is one try at sending a delivery
+type WebhookAttempt struct {
+	ResponseStatus int       `json:"response_status"` // 0 when no response was received
+	Error          string    `json:"error"`
+	DurationMs     int64     `json:"duration_ms"`
+	AttemptedAt    time.Time `json:"attempted_at"`
+}
+
+// CreateWebhookSubscription records an active subscription and sets its ID and
+// creation time
+func CreateWebhookSubscription(db *sql.DB, sub *WebhookSubscription) error {
+	now := time.Now().Truncate(time.Second)
+	res, err := db.Exec("INSERT INTO WebhookSubscriptions (user_id, url, secret, events, active, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		sub.UserID, sub.URL, sub.Secret, strings.Join(sub.Events, ","), true, now.Format("2006-01-02 15:04:05"))
+	if err != nil {
+		logrus.Errorf("Error creating webhook subscription: %v", err)
+		return err
+	}
+	if sub.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	sub.Active, sub.CreatedAt = true, now
+	return nil
+}
+
+// ListWebhookSubscriptions returns every subscription, without their secrets
+func ListWebhookSubscriptions(db *sql.DB) ([]WebhookSubscription, error) {
+	rows, err := db.Query("SELECT id, user_id, url, events, active, created_at FROM WebhookSubscriptions ORDER BY id")
+	if err != nil {
+		logrus.Errorf("Error querying webhook subscriptions: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []WebhookSubscription{}
+	for rows.Next() {
+		var sub WebhookSubscription
+		var userID sql.NullInt64
+		var events, createdAt string
+		if err := rows.Scan(&sub.ID, &userID, &sub.URL, &events, &sub.Active, &createdAt); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			sub.UserID = &id
+		}
+		sub.Events = strings.Split(events, ",")
+		if sub.CreatedAt, err = parseTime(createdAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// WebhookSubscriptionExists returns sql.ErrNoRows if there is no subscription with id
+func WebhookSubscriptionExists(db *sql.DB, id int64) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM WebhookSubscriptions WHERE id = ?", id).Scan(&count); err != nil {
+		logrus.Errorf("Error checking webhook subscription %d: %v", id, err)
+		return err
+	}
+	if count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteWebhookSubscription removes a subscription with its deliveries and their
+// attempts. It returns sql.ErrNoRows if there is no subscription with id.
+func DeleteWebhookSubscription(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM WebhookSubscriptions WHERE id = ?", id)
+	if err != nil {
+		logrus.Errorf("Error deleting webhook subscription %d: %v", id, err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM WebhookAttempts WHERE delivery_id IN (SELECT id FROM WebhookDeliveries WHERE subscription_id = ?)", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM WebhookDeliveries WHERE subscription_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a subscription, newest
+// first, with their attempts
+func ListWebhookDeliveries(db *sql.DB, subscriptionID int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`SELECT id, subscription_id, event, product_id, status, attempts, response_status, last_error, next_attempt_at, created_at, updated_at
+		FROM WebhookDeliveries WHERE subscription_id = ? ORDER BY id DESC LIMIT ?`, subscriptionID, limit)
+	if err != nil {
+		logrus.Errorf("Error querying webhook deliveries: %v", err)
+		return nil, err
+	}
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		var lastError sql.NullString
+		var nextAttempt, createdAt, updatedAt string
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.Event, &d.ProductID, &d.Status, &d.Attempts, &d.ResponseStatus, &lastError, &nextAttempt, &createdAt, &updatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.LastError = lastError.String
+		for _, t := range []struct {
+			dst *time.Time
+			src string
+		}{{&d.NextAttemptAt, nextAttempt}, {&d.CreatedAt, createdAt}, {&d.UpdatedAt, updatedAt}} {
+			if *t.dst, err = parseTime(t.src); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The attempts are read once the deliveries are, as a single connection cannot
+	// run two queries at once
+	for i := range deliveries {
+		if deliveries[i].AttemptLog, err = webhookAttempts(db, deliveries[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
+
+// webhookAttempts returns the attempts of a delivery in order
+func webhookAttempts(db *sql.DB, deliveryID int64) ([]WebhookAttempt, error) {
+	rows, err := db.Query("SELECT response_status, error, duration_ms, attempted_at FROM WebhookAttempts WHERE delivery_id = ? ORDER BY id", deliveryID)
+	if err != nil {
+		logrus.Errorf("Error querying attempts of webhook delivery %d: %v", deliveryID, err)
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []WebhookAttempt{}
+	for rows.Next() {
+		var a WebhookAttempt
+		var errMsg sql.NullString
+		var attemptedAt string
+		if err := rows.Scan(&a.ResponseStatus, &errMsg, &a.DurationMs, &attemptedAt); err != nil {
+			return nil, err
+		}
+		a.Error = errMsg.String
+		if a.AttemptedAt, err = parseTime(attemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// RedeliverWebhook queues a delivery to be sent again right away with a fresh set of
+// attempts, whatever its status. Earlier attempts stay in its log. It returns
+// sql.ErrNoRows if there is no delivery with id.
+func RedeliverWebhook(db *sql.DB, id int64) error {
+	currentTime := time.Now().Format("2006-01-02 15:04:05")
+	res, err := db.Exec("UPDATE WebhookDeliveries SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		DeliveryPending, currentTime, currentTime, id)
+	if err != nil {
+		logrus.Errorf("Error queueing webhook delivery %d again: %v", id, err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func newWebhooksDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE WebhookSubscriptions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NULL, url TEXT, secret TEXT, events TEXT, active BOOLEAN DEFAULT TRUE, created_at DATETIME);
+		CREATE TABLE WebhookDeliveries (id INTEGER PRIMARY KEY AUTOINCREMENT, subscription_id INTEGER, event TEXT, product_id INTEGER, payload TEXT, status TEXT, attempts INTEGER DEFAULT 0, response_status INTEGER DEFAULT 0, last_error TEXT, next_attempt_at DATETIME, created_at DATETIME, updated_at DATETIME);
+		CREATE TABLE WebhookAttempts (id INTEGER PRIMARY KEY AUTOINCREMENT, delivery_id INTEGER, response_status INTEGER, error TEXT, duration_ms INTEGER, attempted_at DATETIME);
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	testDB := newWebhooksDB(t)
+
+	userID := 7
+	events := []string{"product.images.completed", "product.images.failed"}
+	sub := WebhookSubscription{UserID: &userID, URL: "https://example.com/hook", Secret: "s", Events: events}
+	if err := CreateWebhookSubscription(testDB, &sub); err != nil {
+		t.Fatalf("Error creating subscription: %v", err)
+	}
+	id := sub.ID
+	if id == 0 || !sub.Active || sub.CreatedAt.IsZero() {
+		t.Errorf("Expected the created subscription to be filled in, got %+v", sub)
+	}
+	if err := CreateWebhookSubscription(testDB, &WebhookSubscription{URL: "https://example.com/all", Secret: "s", Events: events[:1]}); err != nil {
+		t.Fatalf("Error creating subscription: %v", err)
+	}
+
+	subs, err := ListWebhookSubscriptions(testDB)
+	if err != nil || len(subs) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %v, %v", subs, err)
+	}
+	if subs[0].ID != id || subs[0].UserID == nil || *subs[0].UserID != 7 || !subs[0].Active || !reflect.DeepEqual(subs[0].Events, events) {
+		t.Errorf("Unexpected subscription: %+v", subs[0])
+	}
+	if subs[0].Secret != "" {
+		t.Error("Expected listed subscriptions not to include their secret")
+	}
+	if subs[1].UserID != nil {
+		t.Errorf("Expected a subscription to every user's products, got user %d", *subs[1].UserID)
+	}
+
+	if err := WebhookSubscriptionExists(testDB, id); err != nil {
+		t.Errorf("Expected the subscription to exist, got %v", err)
+	}
+	testDB.Exec("INSERT INTO WebhookDeliveries (subscription_id, event, product_id, payload, status, next_attempt_at, created_at, updated_at) VALUES (?, 'e', 1, '{}', 'pending', '2024-01-01 00:00:00', '2024-01-01 00:00:00', '2024-01-01 00:00:00')", id)
+	testDB.Exec("INSERT INTO WebhookAttempts (delivery_id, response_status, error, duration_ms, attempted_at) VALUES (1, 500, '', 3, '2024-01-01 00:00:00')")
+	if err := DeleteWebhookSubscription(testDB, id); err != nil {
+		t.Fatalf("Error deleting subscription: %v", err)
+	}
+	if err := WebhookSubscriptionExists(testDB, id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a deleted subscription, got %v", err)
+	}
+	var deliveries, attempts int
+	testDB.QueryRow("SELECT COUNT(*) FROM WebhookDeliveries").Scan(&deliveries)
+	testDB.QueryRow("SELECT COUNT(*) FROM WebhookAttempts").Scan(&attempts)
+	if deliveries != 0 || attempts != 0 {
+		t.Errorf("Expected the deliveries of a deleted subscription to be removed, got %d deliveries and %d attempts", deliveries, attempts)
+	}
+	if err := DeleteWebhookSubscription(testDB, id); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows deleting a missing subscription, got %v", err)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	testDB := newWebhooksDB(t)
+
+	_, err := testDB.Exec(`
+		INSERT INTO WebhookDeliveries (subscription_id, event, product_id, payload, status, attempts, response_status, last_error, next_attempt_at, created_at, updated_at) VALUES
+			(1, 'product.images.completed', 1, '{}', 'failed', 2, 500, 'status 500', '2024-01-01 00:10:00', '2024-01-01 00:00:00', '2024-01-01 00:10:00'),
+			(1, 'product.images.completed', 2, '{}', 'delivered', 1, 200, '', '2024-01-02 00:00:00', '2024-01-02 00:00:00', '2024-01-02 00:00:00'),
+			(2, 'product.images.failed', 3, '{}', 'pending', 0, 0, '', '2024-01-03 00:00:00', '2024-01-03 00:00:00', '2024-01-03 00:00:00');
+		INSERT INTO WebhookAttempts (delivery_id, response_status, error, duration_ms, attempted_at) VALUES
+			(1, 500, 'status 500', 12, '2024-01-01 00:00:00'),
+			(1, 500, 'status 500', 15, '2024-01-01 00:10:00'),
+			(2, 200, '', 9, '2024-01-02 00:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Error inserting deliveries: %v", err)
+	}
+
+	deliveries, err := ListWebhookDeliveries(testDB, 1, 10)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %v, %v", deliveries, err)
+	}
+	if deliveries[0].ID != 2 || deliveries[1].ID != 1 {
+		t.Errorf("Expected the newest delivery first, got %d, %d", deliveries[0].ID, deliveries[1].ID)
+	}
+	failed := deliveries[1]
+	if failed.Status != DeliveryFailed || failed.Attempts != 2 || failed.LastError != "status 500" || len(failed.AttemptLog) != 2 || failed.AttemptLog[1].DurationMs != 15 {
+		t.Errorf("Unexpected delivery: %+v", failed)
+	}
+	if limited, _ := ListWebhookDeliveries(testDB, 1, 1); len(limited) != 1 {
+		t.Errorf("Expected the limit to apply, got %d deliveries", len(limited))
+	}
+
+	if err := RedeliverWebhook(testDB, 1); err != nil {
+		t.Fatalf("Error redelivering: %v", err)
+	}
+	deliveries, _ = ListWebhookDeliveries(testDB, 1, 10)
+	if d := deliveries[1]; d.Status != DeliveryPending || d.Attempts != 0 || len(d.AttemptLog) != 2 {
+		t.Errorf("Expected a pending delivery keeping its attempt log, got %+v", d)
+	}
+	if err := RedeliverWebhook(testDB, 99); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows redelivering a missing delivery, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"sync"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/reprocess"
+	"github.com/sirupsen/logrus"
+)
+
+// maxReprocessRate caps the publish rate an API caller can ask for
+const maxReprocessRate = 500
+
+// ReprocessRequest selects the products to reprocess. Empty fields match every product.
+type ReprocessRequest struct {
+	MinProductID  int64   `json:"min_product_id"`
+	MaxProductID  int64   `json:"max_product_id"`
+	CreatedAfter  string  `json:"created_after"`  // YYYY-MM-DD
+	CreatedBefore string  `json:"created_before"` // YYYY-MM-DD
+	Status        string  `json:"status"`
+	UserID        int     `json:"user_id"`
+	JobID         string  `json:"job_id"`
+	Rate          float64 `json:"rate"`
+	Force         bool    `json:"force"`
+	// Hold the products back until a time or for a number of seconds, e.g. until an
+	// embargo lifts or a supplier's CDN is back. At most one of them may be given.
+	NotBefore    string `json:"not_before"` // RFC 3339
+	DelaySeconds int    `json:"delay_seconds"`
+}
+
+// ReprocessStarted is returned when a reprocessing job starts publishing
+type ReprocessStarted struct {
+	JobID string `json:"job_id"`
+	Total int    `json:"total"`
+}
+
+// AdminAuth only lets requests carrying the admin token through. Admin routes are
+// disabled when no token is configured.
+func AdminAuth(token string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if token == "" {
+			return fiber.NewError(fiber.StatusNotFound, "Not found")
+		}
+		given := c.Get(fiber.HeaderAuthorization)
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			return fiber.NewError(fiber.StatusUnauthorized, "Unauthorized")
+		}
+		return c.Next()
+	}
+}
+
+// @Summary Reprocess products
+// @Description Enqueue matching products so that their images are regenerated. Running the same job again only enqueues products it has not enqueued yet. With not_before or delay_seconds the products are enqueued right away but only processed from then on.
+// @Tags Admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body ReprocessRequest true "Products to reprocess"
+// @Success 202 {object} ReprocessStarted
+// @Failure 400 {object} ErrorResponse "Invalid request payload"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 409 {object} ErrorResponse "Job is already running"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/reprocess [post]
+func StartReprocess(db *sql.DB, publish reprocess.Publisher) fiber.Handler {
+	var mu sync.Mutex
+	running := map[string]bool{}
+	return func(c *fiber.Ctx) error {
+		var req ReprocessRequest
+		if err := c.BodyParser(&req); err != nil {
+			logrus.Errorf("Error in parsing the request body: %v", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+		filter := database.ProductFilter{MinProductID: req.MinProductID, MaxProductID: req.MaxProductID, Status: req.Status, UserID: req.UserID}
+		var err error
+		if filter.CreatedAfter, err = reprocess.ParseDate(req.CreatedAfter); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid created_after, expected YYYY-MM-DD")
+		}
+		if filter.CreatedBefore, err = reprocess.ParseDate(req.CreatedBefore); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid created_before, expected YYYY-MM-DD")
+		}
+		if req.Rate < 0 || req.Rate > maxReprocessRate {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid rate")
+		}
+		notBefore, err := reprocess.NotBefore(req.NotBefore, time.Duration(req.DelaySeconds)*time.Second, time.Now())
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid not_before or delay_seconds, expected an RFC 3339 time or a positive delay but not both")
+		}
+
+		opts := reprocess.Options{Filter: filter, JobID: req.JobID, Rate: req.Rate, Force: req.Force, NotBefore: notBefore}
+		if opts.JobID == "" {
+			opts.JobID = reprocess.JobID(filter)
+		}
+		mu.Lock()
+		if running[opts.JobID] {
+			mu.Unlock()
+			return fiber.NewError(fiber.StatusConflict, "Job is already running")
+		}
+		running[opts.JobID] = true
+		mu.Unlock()
+
+		ids, err := reprocess.Start(db, &opts)
+		if err != nil {
+			mu.Lock()
+			delete(running, opts.JobID)
+			mu.Unlock()
+			logrus.Errorf("Error in starting reprocess job: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(running, opts.JobID)
+				mu.Unlock()
+			}()
+			if _, err := reprocess.Publish(context.Background(), db, publish, opts, ids, nil); err != nil {
+				logrus.Errorf("Reprocess job %s stopped: %v", opts.JobID, err)
+			}
+		}()
+		c.Location("/admin/reprocess/" + opts.JobID)
+		return c.Status(fiber.StatusAccepted).JSON(ReprocessStarted{JobID: opts.JobID, Total: len(ids)})
+	}
+}
+
+// @Summary Get reprocessing progress
+// @Description Report how many products of a reprocessing job were enqueued, completed and failed
+// @Tags Admin
+// @Security BearerAuth
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} database.ReprocessProgress
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Job not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/reprocess/{id} [get]
+func GetReprocess(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		progress, err := database.GetReprocessProgress(db, c.Params("id"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Job not found")
+			}
+			logrus.Errorf("Error in getting reprocess progress: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.JSON(progress)
+	}
+}
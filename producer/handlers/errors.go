@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorBody describes a failed request
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the JSON envelope of every error returned by the API
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorHandler renders errors returned by handlers as an ErrorResponse. Errors that
+// are not a *fiber.Error are reported as internal server errors without their details.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	message := "Internal server error"
+	var ferr *fiber.Error
+	if errors.As(err, &ferr) {
+		status = ferr.Code
+		message = ferr.Message
+	} else {
+		logrus.Errorf("Unhandled error on %s %s: %v", c.Method(), c.Path(), err)
+	}
+	return c.Status(status).JSON(ErrorResponse{Error: ErrorBody{Status: status, Message: message}})
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/progress"
+	"github.com/sirupsen/logrus"
+)
+
+// sseHeartbeat is how often an idle event stream sends a comment, so that proxies
+// keep it open and closed clients are noticed
+const sseHeartbeat = 15 * time.Second
+
+// progressSnapshot describes the state of a product that no job is processing
+func progressSnapshot(product *database.Product) msgqueue.ProgressEvent {
+	event := msgqueue.ProgressEvent{
+		ProductID: int(product.ProductID),
+		Status:    product.ProcessingStatus,
+		Total:     len(product.ProductImages),
+		Time:      time.Now().UTC(),
+	}
+	if event.Status == database.StatusDone {
+		event.Completed = event.Total
+	}
+	return event
+}
+
+// writeEvent sends a progress event to an event stream
+func writeEvent(w *bufio.Writer, event msgqueue.ProgressEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// @Summary Stream processing progress
+// @Description Server-Sent Events stream of the processing progress of a product. The current state is sent on connect, followed by a "progress" event when a job starts, after each image and when the job ends. Each event carries the running completed, failed and total counts.
+// @Tags Products
+// @Produce text/event-stream
+// @Param id path int true "Product ID"
+// @Success 200 {object} msgqueue.ProgressEvent "Stream of progress events"
+// @Failure 400 {object} ErrorResponse "Invalid product ID"
+// @Failure 404 {object} ErrorResponse "Product not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /products/{id}/events [get]
+func ProductEvents(db *sql.DB, hub *progress.Hub) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		product, err := productParam(c, db)
+		if err != nil {
+			return err
+		}
+		// Subscribe before reading the current state, so no event falls in between
+		events, stop := hub.Subscribe(product.ProductID)
+		current, ok := hub.Latest(product.ProductID)
+		if !ok {
+			current = progressSnapshot(product)
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer stop()
+			heartbeat := time.NewTicker(sseHeartbeat)
+			defer heartbeat.Stop()
+			if err := writeEvent(w, current); err != nil {
+				return
+			}
+			for {
+				select {
+				case event := <-events:
+					if err := writeEvent(w, event); err != nil {
+						logrus.Debugf("Progress stream of product_id %d closed: %v", product.ProductID, err)
+						return
+					}
+				case <-heartbeat.C:
+					fmt.Fprint(w, ": ping\n\n")
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		})
+		return nil
+	}
+}
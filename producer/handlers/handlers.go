@@ -2,34 +2,82 @@ package handlers
 
 import (
 	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
 
 	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
 	"github.com/golang_backend_assignment/producer/database"
 	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/uploads"
 	"github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
 )
 
 type Product struct {
-	UserID             int      `json:"user_id"`
-	ProductName        string   `json:"product_name"`
-	ProductDescription string   `json:"product_description"`
-	ProductImages      []string `json:"product_images"`
-	ProductPrice       float64  `json:"product_price"`
+	UserID             int      `json:"user_id" form:"user_id"`
+	ProductName        string   `json:"product_name" form:"product_name"`
+	ProductDescription string   `json:"product_description" form:"product_description"`
+	ProductImages      []string `json:"product_images" form:"product_images"`
+	ProductPrice       float64  `json:"product_price" form:"product_price"`
+}
+
+// ProductResponse is a stored product with the state of its image processing
+type ProductResponse struct {
+	ProductID               int64          `json:"product_id"`
+	UserID                  int            `json:"user_id"`
+	ProductName             string         `json:"product_name"`
+	ProductDescription      string         `json:"product_description"`
+	ProductImages           []string       `json:"product_images"`
+	Images                  []ProductImage `json:"images"`
+	ProductPrice            float64        `json:"product_price"`
+	CompressedProductImages []string       `json:"compressed_product_images"`
+	ProcessingStatus        string         `json:"processing_status"`
+	StatusURL               string         `json:"status_url"`
+}
+
+// productURL is where the state of a product can be polled
+func productURL(productID int64) string {
+	return fmt.Sprintf("/products/%d", productID)
+}
+
+// productResponse describes a stored product
+func productResponse(product *database.Product) ProductResponse {
+	return ProductResponse{
+		ProductID:               product.ProductID,
+		UserID:                  product.UserID,
+		ProductName:             product.ProductName,
+		ProductDescription:      product.ProductDescription,
+		ProductImages:           product.ProductImages,
+		Images:                  productImages(product.ProductImages),
+		ProductPrice:            product.ProductPrice,
+		CompressedProductImages: product.CompressedImages,
+		ProcessingStatus:        product.ProcessingStatus,
+		StatusURL:               productURL(product.ProductID),
+	}
 }
 
 // @Summary Save a product
-// @Description Save a product to the database
+// @Description Save a product to the database and queue its images for processing. The response links to the product, whose processing_status changes from pending to done or failed.
+// @Description Images are given as URLs in product_images, or sent as multipart/form-data with the fields of the product and the image files in images. Uploaded files are stored as the originals of the product's images.
 // @Tags Products
 // @Accept json
+// @Accept mpfd
 // @Produce json
 // @Param product body Product true "Product data"
-// @Success 200 {string} string "Product saved successfully"
-// @Failure 400 {string} string "Invalid request payload"
-// @Failure 404 {string} string "User not found"
-// @Failure 500 {string} string "Internal server error"
+// @Param images formData file false "Image files (JPEG, PNG or GIF) when sending multipart/form-data, repeat the field for several"
+// @Param Idempotency-Key header string false "Key that makes retries of the request return the first response instead of creating another product"
+// @Success 202 {object} ProductResponse
+// @Header 202 {string} Location "URL of the product"
+// @Failure 400 {object} ErrorResponse "Invalid request payload, product image URL or image"
+// @Failure 404 {object} ErrorResponse "User not found"
+// @Failure 409 {object} ErrorResponse "Idempotency-Key reused with a different request or still in progress"
+// @Failure 413 {object} ErrorResponse "Image too large"
+// @Failure 415 {object} ErrorResponse "Unsupported image type"
+// @Failure 500 {object} ErrorResponse "Internal server error"
 // @Router /products [post]
-func SaveProduct(db *sql.DB, ch *amqp.Channel, queue string) fiber.Handler {
+func SaveProduct(db *sql.DB, ch msgqueue.Publisher, lanes msgqueue.Lanes, publishEvent msgqueue.EventPublisher, policy *urlpolicy.Policy, store storage.Storage, limits uploads.Limits) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Parse the request body into a Product struct
 		var product Product
@@ -38,6 +86,12 @@ func SaveProduct(db *sql.DB, ch *amqp.Channel, queue string) fiber.Handler {
 			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
 		}
 
+		for _, imageURL := range product.ProductImages {
+			if err := checkImageURL(c, policy, imageURL); err != nil {
+				return err
+			}
+		}
+
 		err := database.UserExists(db, product.UserID)
 		if err != nil {
 			if err == sql.ErrNoRows {
@@ -49,17 +103,100 @@ func SaveProduct(db *sql.DB, ch *amqp.Channel, queue string) fiber.Handler {
 			}
 		}
 
-		productID, err := database.InsertProduct(db, product.ProductName, product.ProductDescription, product.ProductPrice, product.ProductImages)
+		// Users creating products faster than a seller would are importing them, and
+		// their jobs go to the bulk lane so that they do not delay sellers waiting for
+		// their images
+		recent, err := database.CountProductsSince(db, product.UserID, lanes.RecentSince(time.Now()))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		queue := lanes.ForNewProduct(recent)
+
+		images := product.ProductImages
+		if images == nil {
+			images = []string{}
+		}
+		productID, err := database.InsertProduct(db, product.UserID, product.ProductName, product.ProductDescription, product.ProductPrice, images)
 		if err != nil {
 			logrus.Errorf("Error in inserting product: %v", err)
 			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
 		}
+
+		// Uploaded files are stored among the product's uploads and referenced by their
+		// storage key. A product that cannot be completed is removed with its uploads,
+		// so that a retry starts over.
+		var refs []storage.Ref
+		discard := func() {
+			uploads.Delete(c.Context(), store, refs)
+			database.DeleteProduct(db, productID)
+		}
+		if isMultipart(c) {
+			refs, err = saveUploads(c, store, productID, limits)
+			if err != nil {
+				discard()
+				return err
+			}
+			images = append(append([]string{}, images...), refStrings(refs)...)
+			if err := database.SetProductImages(db, productID, images); err != nil {
+				discard()
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+		}
 		err = msgqueue.Producer(productID, ch, queue)
 		if err != nil {
 			logrus.Errorf("Error in sending message to queue: %v", err)
+			discard()
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		// Other services learn about the product from the event, which does not hold up the request if it fails
+		publishEvent(msgqueue.NewEvent(msgqueue.EventProductCreated, 1, msgqueue.ProductCreatedV1{
+			ProductID:          productID,
+			UserID:             product.UserID,
+			ProductName:        product.ProductName,
+			ProductDescription: product.ProductDescription,
+			ProductImages:      images,
+			ProductPrice:       product.ProductPrice,
+		}))
+		// The images are processed asynchronously, so the product is accepted rather than complete
+		c.Location(productURL(productID))
+		return c.Status(fiber.StatusAccepted).JSON(ProductResponse{
+			ProductID:               productID,
+			UserID:                  product.UserID,
+			ProductName:             product.ProductName,
+			ProductDescription:      product.ProductDescription,
+			ProductImages:           images,
+			Images:                  productImages(images),
+			ProductPrice:            product.ProductPrice,
+			CompressedProductImages: []string{},
+			ProcessingStatus:        database.StatusPending,
+			StatusURL:               productURL(productID),
+		})
+	}
+}
+
+// @Summary Get a product
+// @Description Get a product with the state of its image processing
+// @Tags Products
+// @Produce json
+// @Param id path int true "Product ID"
+// @Success 200 {object} ProductResponse
+// @Failure 400 {object} ErrorResponse "Invalid product ID"
+// @Failure 404 {object} ErrorResponse "Product not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /products/{id} [get]
+func GetProduct(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		productID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+		if err != nil || productID <= 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid product ID")
+		}
+		product, err := database.GetProduct(db, productID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Product not found")
+			}
 			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
 		}
-		// Return a success message
-		return c.SendString("Product saved successfully")
+		return c.JSON(productResponse(product))
 	}
 }
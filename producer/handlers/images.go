@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/reprocess"
+	"github.com/golang_backend_assignment/producer/uploads"
+	"github.com/sirupsen/logrus"
+)
+
+// ProductImage is an image of a product with the ID used to manage it
+type ProductImage struct {
+	ImageID string `json:"image_id"`
+	Source  string `json:"source"`
+}
+
+// AddImagesRequest lists image URLs to add to a product
+type AddImagesRequest struct {
+	ProductImages []string `json:"product_images" form:"product_images"`
+}
+
+// ImageOrder is the new order of a product's images
+type ImageOrder struct {
+	ImageIDs []string `json:"image_ids"`
+}
+
+// productImages describes the images of a product in order
+func productImages(sources []string) []ProductImage {
+	images := make([]ProductImage, len(sources))
+	for i, source := range sources {
+		images[i] = ProductImage{ImageID: database.ImageID(source), Source: source}
+	}
+	return images
+}
+
+// productParam parses the product ID in the path and loads the product
+func productParam(c *fiber.Ctx, db *sql.DB) (*database.Product, error) {
+	productID, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil || productID <= 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid product ID")
+	}
+	product, err := database.GetProduct(db, productID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Product not found")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	return product, nil
+}
+
+// checkImageURL rejects image URLs that point at internal services, before they
+// reach the consumer, and URLs with a comma, which older products used to separate
+// their images
+func checkImageURL(c *fiber.Ctx, policy *urlpolicy.Policy, imageURL string) error {
+	err := policy.Resolve(c.Context(), imageURL)
+	if err == nil && strings.Contains(imageURL, ",") {
+		err = errors.New("URL contains a comma")
+	}
+	if err != nil {
+		logrus.Errorf("Rejected product image URL %q: %v", imageURL, err)
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Invalid product image URL: %s", imageURL))
+	}
+	return nil
+}
+
+// queueImages adds images to an existing product and queues just those for
+// processing. If they cannot be queued they are taken off the product again, and
+// uploads among them are deleted whenever they do not end up queued.
+func queueImages(c *fiber.Ctx, db *sql.DB, publish reprocess.Publisher, store storage.Storage, productID int64, sources []string, refs []storage.Ref) error {
+	if err := database.AddProductImages(db, productID, sources); err != nil {
+		uploads.Delete(c.Context(), store, refs)
+		return imagesUpdateError(err)
+	}
+	// The product was already processed once, so the job needs its own key
+	job := msgqueue.Job{ProductID: productID, Key: fmt.Sprintf("product:%d:images:%s", productID, randomID()), Images: sources}
+	if err := publish(job); err != nil {
+		logrus.Errorf("Error in sending message to queue: %v", err)
+		if err := database.RemoveProductImages(db, productID, sources); err != nil {
+			logrus.Errorf("Error in removing the images that were not queued from product %d: %v", productID, err)
+		}
+		uploads.Delete(c.Context(), store, refs)
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	return nil
+}
+
+// @Summary Add product images
+// @Description Add images to an existing product, as image URLs in JSON or as image files in multipart/form-data, and queue just the new images for processing
+// @Tags Products
+// @Accept json
+// @Accept mpfd
+// @Produce json
+// @Param id path int true "Product ID"
+// @Param request body AddImagesRequest false "Image URLs"
+// @Param images formData file false "Image files (JPEG, PNG or GIF) when sending multipart/form-data, repeat the field for several"
+// @Success 202 {object} ProductResponse
+// @Header 202 {string} Location "URL of the product"
+// @Failure 400 {object} ErrorResponse "Invalid product ID, request payload, image URL or image"
+// @Failure 404 {object} ErrorResponse "Product not found"
+// @Failure 409 {object} ErrorResponse "Image already on the product"
+// @Failure 413 {object} ErrorResponse "Image too large"
+// @Failure 415 {object} ErrorResponse "Unsupported image type"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /products/{id}/images [post]
+func AddProductImages(db *sql.DB, publish reprocess.Publisher, policy *urlpolicy.Policy, store storage.Storage, limits uploads.Limits) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		product, err := productParam(c, db)
+		if err != nil {
+			return err
+		}
+		var req AddImagesRequest
+		if err := c.BodyParser(&req); err != nil {
+			logrus.Errorf("Error in parsing the request body: %v", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+
+		existing := map[string]bool{}
+		for _, source := range product.ProductImages {
+			existing[source] = true
+		}
+		for _, imageURL := range req.ProductImages {
+			if err := checkImageURL(c, policy, imageURL); err != nil {
+				return err
+			}
+			if existing[imageURL] {
+				return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("Image %s is already on the product", imageURL))
+			}
+			existing[imageURL] = true
+		}
+
+		var refs []storage.Ref
+		if isMultipart(c) {
+			refs, err = saveUploads(c, store, product.ProductID, limits)
+			if err != nil {
+				return err
+			}
+		}
+		sources := append(append([]string{}, req.ProductImages...), refStrings(refs)...)
+		if len(sources) == 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "No images given")
+		}
+		if err := queueImages(c, db, publish, store, product.ProductID, sources, refs); err != nil {
+			return err
+		}
+
+		product, err = database.GetProduct(db, product.ProductID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		c.Location(productURL(product.ProductID))
+		return c.Status(fiber.StatusAccepted).JSON(productResponse(product))
+	}
+}
+
+// @Summary Remove a product image
+// @Description Remove an image from a product, together with its stored compressed images and original
+// @Tags Products
+// @Produce json
+// @Param id path int true "Product ID"
+// @Param imageId path string true "Image ID"
+// @Success 200 {object} ProductResponse
+// @Failure 400 {object} ErrorResponse "Invalid product ID"
+// @Failure 404 {object} ErrorResponse "Product or image not found"
+// @Failure 409 {object} ErrorResponse "Images of the product changed concurrently"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /products/{id}/images/{imageId} [delete]
+func DeleteProductImage(db *sql.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		product, err := productParam(c, db)
+		if err != nil {
+			return err
+		}
+		outputs, err := database.GetCompressedImages(db, product.ProductID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		imageID := c.Params("imageId")
+		removed := ""
+		_, err = database.UpdateProductImages(db, product.ProductID, func(images []string) ([]string, error) {
+			removed = ""
+			for _, source := range images {
+				if database.ImageID(source) == imageID {
+					removed = source
+				}
+			}
+			if removed == "" {
+				return nil, fiber.NewError(fiber.StatusNotFound, "Image not found")
+			}
+			// Older products can list the same source twice, both copies are removed
+			remaining := []string{}
+			for _, source := range images {
+				if source != removed {
+					remaining = append(remaining, source)
+				}
+			}
+			return remaining, nil
+		})
+		if err != nil {
+			return imagesUpdateError(err)
+		}
+		if err := database.DeleteCompressedImages(db, product.ProductID, removed); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		if err := database.RebuildCompressedProductImages(db, product.ProductID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		deleteImageFiles(c, store, product.ProductID, removed, outputs)
+
+		product, err = database.GetProduct(db, product.ProductID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.JSON(productResponse(product))
+	}
+}
+
+// imagesUpdateError is the response to a failed update of a product's images: the
+// error of the update itself, or one for the database's
+func imagesUpdateError(err error) error {
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &fe):
+		return fe
+	case err == sql.ErrNoRows:
+		return fiber.NewError(fiber.StatusNotFound, "Product not found")
+	case err == database.ErrImagesChanged:
+		return fiber.NewError(fiber.StatusConflict, "The images of the product are being changed, try again")
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+}
+
+// ownedKey reports whether a storage key belongs to a product: one of its outputs or
+// archived originals, or one of its uploads
+func ownedKey(productID int64, key string) bool {
+	id := strconv.FormatInt(productID, 10)
+	if clean, err := storage.CleanKey(key); err != nil || clean != key {
+		return false
+	}
+	return strings.HasPrefix(key, id+"/") || strings.HasPrefix(key, storage.UploadsPrefix(id))
+}
+
+// deleteImageFiles removes the stored files of a removed image: its outputs, its
+// archived original and the upload it came from. Files that another image of the
+// product shares, because it has the same content, are kept, and so is any file
+// outside the product's own keys.
+func deleteImageFiles(c *fiber.Ctx, store storage.Storage, productID int64, removed string, outputs []database.CompressedImage) {
+	kept := map[string]bool{}
+	candidates := []string{}
+	for _, img := range outputs {
+		if img.Backend != store.Name() {
+			continue
+		}
+		keys := []string{img.Key}
+		if img.OriginalKey != "" {
+			keys = append(keys, img.OriginalKey)
+		}
+		for _, key := range keys {
+			if img.SourceURL == removed {
+				candidates = append(candidates, key)
+			} else {
+				kept[key] = true
+			}
+		}
+	}
+	if ref, err := storage.ParseRef(removed); err == nil && ref.Backend == store.Name() {
+		candidates = append(candidates, ref.Key)
+	}
+
+	deleted := map[string]bool{}
+	for _, key := range candidates {
+		if kept[key] || deleted[key] {
+			continue
+		}
+		if !ownedKey(productID, key) {
+			logrus.Warnf("Not deleting %s of removed image %s: not a file of product %d", key, removed, productID)
+			continue
+		}
+		deleted[key] = true
+		if err := store.Delete(c.Context(), key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logrus.Warnf("Failed to delete stored image %s: %v", key, err)
+		}
+	}
+	logrus.Infof("Deleted %d stored files of removed image %s", len(deleted), removed)
+}
+
+// @Summary Reorder product images
+// @Description Set the order of a product's images, which is also the order of its compressed images. Every image ID of the product must be given once.
+// @Tags Products
+// @Accept json
+// @Produce json
+// @Param id path int true "Product ID"
+// @Param order body ImageOrder true "Image IDs in the new order"
+// @Success 200 {object} ProductResponse
+// @Failure 400 {object} ErrorResponse "Invalid product ID, request payload or image IDs"
+// @Failure 404 {object} ErrorResponse "Product not found"
+// @Failure 409 {object} ErrorResponse "Images of the product changed concurrently"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /products/{id}/images/order [put]
+func ReorderProductImages(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		product, err := productParam(c, db)
+		if err != nil {
+			return err
+		}
+		var order ImageOrder
+		if err := c.BodyParser(&order); err != nil {
+			logrus.Errorf("Error in parsing the request body: %v", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+
+		_, err = database.UpdateProductImages(db, product.ProductID, func(images []string) ([]string, error) {
+			byID := map[string]string{}
+			for _, source := range images {
+				byID[database.ImageID(source)] = source
+			}
+			if len(order.ImageIDs) != len(byID) {
+				return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Expected all %d image IDs of the product", len(byID)))
+			}
+			sources := []string{}
+			for _, id := range order.ImageIDs {
+				source, ok := byID[id]
+				if !ok {
+					return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown or repeated image ID: %s", id))
+				}
+				delete(byID, id)
+				sources = append(sources, source)
+			}
+			return sources, nil
+		})
+		if err != nil {
+			return imagesUpdateError(err)
+		}
+		if err := database.RebuildCompressedProductImages(db, product.ProductID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		product, err = database.GetProduct(db, product.ProductID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.JSON(productResponse(product))
+	}
+}
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/reprocess"
+	"github.com/golang_backend_assignment/producer/uploads"
+	"github.com/sirupsen/logrus"
+)
+
+// TusVersion is the version of the tus resumable upload protocol that is implemented
+const TusVersion = "1.0.0"
+
+// tusExtensions are the tus extensions that are supported
+const tusExtensions = "creation,expiration,termination"
+
+// offsetContentType is the content type of PATCH requests carrying a chunk
+const offsetContentType = "application/offset+octet-stream"
+
+// assembleClaim is how long a request may take to assemble a fully received upload
+// before another request can take over, e.g. because the first one crashed
+const assembleClaim = 5 * time.Minute
+
+// uploadURL is where a resumable upload is continued
+func uploadURL(uploadID string) string {
+	return "/uploads/" + uploadID
+}
+
+// TusResumable sets the Tus-Resumable header on every response and rejects
+// requests made with another protocol version
+func TusResumable() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", TusVersion)
+		if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != TusVersion {
+			c.Set("Tus-Version", TusVersion)
+			return fiber.NewError(fiber.StatusPreconditionFailed, "Unsupported Tus-Resumable version")
+		}
+		return c.Next()
+	}
+}
+
+// @Summary Resumable upload capabilities
+// @Description Describe the supported tus protocol version, extensions and maximum upload size
+// @Tags Uploads
+// @Success 204
+// @Header 204 {string} Tus-Version "Supported protocol versions"
+// @Header 204 {string} Tus-Extension "Supported extensions"
+// @Header 204 {integer} Tus-Max-Size "Largest accepted upload in bytes"
+// @Router /uploads [options]
+func TusOptions(maxSize int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Version", TusVersion)
+		c.Set("Tus-Extension", tusExtensions)
+		c.Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// @Summary Create a resumable upload
+// @Description Start a tus upload of an image for a product. Upload-Metadata must contain the product_id and may contain the filename, base64 encoded. The image is added to the product and queued for processing once every byte was received.
+// @Tags Uploads
+// @Param Tus-Resumable header string true "Protocol version, 1.0.0"
+// @Param Upload-Length header int true "Size of the image in bytes"
+// @Param Upload-Metadata header string true "Comma-separated keys with base64 values, e.g. product_id NA=="
+// @Success 201
+// @Header 201 {string} Location "URL of the upload"
+// @Header 201 {string} Upload-Expires "When an unfinished upload is discarded"
+// @Failure 400 {object} ErrorResponse "Invalid Upload-Length or Upload-Metadata"
+// @Failure 404 {object} ErrorResponse "Product not found"
+// @Failure 412 {object} ErrorResponse "Unsupported Tus-Resumable version"
+// @Failure 413 {object} ErrorResponse "Upload too large"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /uploads [post]
+func CreateUpload(db *sql.DB, maxSize int64, expiry time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Length")
+		}
+		if length > maxSize {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Uploads are limited to %d bytes", maxSize))
+		}
+		metadata, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Metadata")
+		}
+		productID, err := strconv.ParseInt(metadata["product_id"], 10, 64)
+		if err != nil || productID <= 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Upload-Metadata must contain a valid product_id")
+		}
+		if _, err := database.GetProduct(db, productID); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Product not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+
+		upload := database.ResumableUpload{
+			UploadID:  randomID(),
+			ProductID: productID,
+			Filename:  metadata["filename"],
+			Length:    length,
+			ExpiresAt: time.Now().Add(expiry),
+		}
+		if err := database.CreateResumableUpload(db, upload); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		logrus.Infof("Created resumable upload %s of %d bytes for product %d", upload.UploadID, length, productID)
+		c.Location(uploadURL(upload.UploadID))
+		c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		return c.SendStatus(fiber.StatusCreated)
+	}
+}
+
+// getUpload looks up the upload named in the path. Unfinished uploads past their
+// expiry are reported as gone even before they are swept.
+func getUpload(c *fiber.Ctx, db *sql.DB) (*database.ResumableUpload, error) {
+	upload, err := database.GetResumableUpload(db, c.Params("id"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fiber.NewError(fiber.StatusNotFound, "Upload not found")
+		}
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	if !upload.Completed() && time.Now().After(upload.ExpiresAt) {
+		return nil, fiber.NewError(fiber.StatusGone, "Upload expired")
+	}
+	return upload, nil
+}
+
+// setUploadHeaders describes the state of an upload
+func setUploadHeaders(c *fiber.Ctx, upload *database.ResumableUpload) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if !upload.Completed() {
+		c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// @Summary Get the offset of a resumable upload
+// @Description Report how many bytes of the upload were received, so that the client can resume from there
+// @Tags Uploads
+// @Param Tus-Resumable header string true "Protocol version, 1.0.0"
+// @Param id path string true "Upload ID"
+// @Success 200
+// @Header 200 {integer} Upload-Offset "Bytes received"
+// @Header 200 {integer} Upload-Length "Size of the image in bytes"
+// @Failure 404 {object} ErrorResponse "Upload not found"
+// @Failure 410 {object} ErrorResponse "Upload expired"
+// @Router /uploads/{id} [head]
+func GetUploadOffset(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		upload, err := getUpload(c, db)
+		if err != nil {
+			return err
+		}
+		setUploadHeaders(c, upload)
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+// @Summary Upload a chunk
+// @Description Append a chunk to a resumable upload at Upload-Offset, which must equal the offset reported by HEAD. Sending the last chunk assembles the image, adds it to the product and queues the product for processing.
+// @Tags Uploads
+// @Accept application/offset+octet-stream
+// @Param Tus-Resumable header string true "Protocol version, 1.0.0"
+// @Param Upload-Offset header int true "Offset of the chunk"
+// @Param id path string true "Upload ID"
+// @Param chunk body string true "Chunk bytes"
+// @Success 204
+// @Header 204 {integer} Upload-Offset "Bytes received"
+// @Failure 400 {object} ErrorResponse "Invalid Upload-Offset or image"
+// @Failure 404 {object} ErrorResponse "Upload or product not found"
+// @Failure 409 {object} ErrorResponse "Upload-Offset does not match the upload, or the upload is being completed by another request"
+// @Failure 410 {object} ErrorResponse "Upload expired"
+// @Failure 413 {object} ErrorResponse "Chunk exceeds Upload-Length or image too large"
+// @Failure 415 {object} ErrorResponse "Invalid Content-Type or unsupported image type"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /uploads/{id} [patch]
+func PatchUpload(db *sql.DB, publish reprocess.Publisher, store storage.Storage, maxSize int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if string(c.Request().Header.ContentType()) != offsetContentType {
+			return fiber.NewError(fiber.StatusUnsupportedMediaType, "Content-Type must be "+offsetContentType)
+		}
+		offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid Upload-Offset")
+		}
+		upload, err := getUpload(c, db)
+		if err != nil {
+			return err
+		}
+		if upload.Completed() || offset != upload.Offset {
+			setUploadHeaders(c, upload)
+			return fiber.NewError(fiber.StatusConflict, "Upload-Offset does not match the upload")
+		}
+		// The chunk is streamed to storage, so its size is checked before it is read
+		var chunk io.Reader
+		size := int64(c.Request().Header.ContentLength())
+		if stream := c.Context().RequestBodyStream(); stream != nil && size >= 0 {
+			chunk = stream
+		} else {
+			body := c.Body()
+			chunk, size = bytes.NewReader(body), int64(len(body))
+		}
+		if offset+size > upload.Length {
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+		}
+
+		if size > 0 {
+			key, err := uploads.WritePart(c.Context(), store, upload.UploadID, offset, chunk, size)
+			if err != nil {
+				logrus.Errorf("Error in storing chunk of upload %s: %v", upload.UploadID, err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+			advanced, err := database.AdvanceResumableUpload(db, upload.UploadID, offset, offset+size)
+			if err != nil || !advanced {
+				store.Delete(c.Context(), key)
+				if err != nil {
+					return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+				}
+				return fiber.NewError(fiber.StatusConflict, "Upload-Offset does not match the upload")
+			}
+			upload.Offset += size
+		}
+
+		// An empty chunk at the end retries assembling an upload whose last chunk was
+		// stored but not assembled
+		if upload.Offset == upload.Length {
+			if err := finishUpload(c, db, publish, store, upload, maxSize); err != nil {
+				return err
+			}
+		}
+		c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// finishUpload assembles a fully received upload and hands the image to the pipeline.
+// The upload is claimed first, so that of several requests finishing it only one
+// adds the image, and the others get 409. Uploads whose content is rejected are
+// discarded.
+func finishUpload(c *fiber.Ctx, db *sql.DB, publish reprocess.Publisher, store storage.Storage, upload *database.ResumableUpload, maxSize int64) error {
+	now := time.Now()
+	claimed, err := database.ClaimResumableUpload(db, upload.UploadID, now, now.Add(assembleClaim))
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	if !claimed {
+		return fiber.NewError(fiber.StatusConflict, "Upload is already being completed")
+	}
+	ref, err := uploads.Assemble(c.Context(), store, upload.ProductID, upload.UploadID, upload.Length, maxSize)
+	if err != nil {
+		ferr := uploadError(upload.Filename, err)
+		if ferr.Code != fiber.StatusInternalServerError {
+			uploads.DeleteParts(c.Context(), store, upload.UploadID)
+			database.DeleteResumableUpload(db, upload.UploadID)
+		} else {
+			// The chunks are kept, so that an empty chunk retries assembling them
+			database.ReleaseResumableUpload(db, upload.UploadID)
+		}
+		return ferr
+	}
+	if err := queueImages(c, db, publish, store, upload.ProductID, []string{ref.String()}, []storage.Ref{ref}); err != nil {
+		// The assembled image is gone and its chunks too, so the client starts over
+		database.DeleteResumableUpload(db, upload.UploadID)
+		return err
+	}
+	if err := database.CompleteResumableUpload(db, upload.UploadID, ref.String()); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+	upload.ImageRef = ref.String()
+	logrus.Infof("Completed resumable upload %s as %s", upload.UploadID, ref)
+	return nil
+}
+
+// @Summary Cancel a resumable upload
+// @Description Discard an upload and its received chunks. An image that was already completed stays on its product.
+// @Tags Uploads
+// @Param Tus-Resumable header string true "Protocol version, 1.0.0"
+// @Param id path string true "Upload ID"
+// @Success 204
+// @Failure 404 {object} ErrorResponse "Upload not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /uploads/{id} [delete]
+func DeleteUpload(db *sql.DB, store storage.Storage) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		upload, err := database.GetResumableUpload(db, c.Params("id"))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Upload not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		uploads.DeleteParts(c.Context(), store, upload.UploadID)
+		if err := database.DeleteResumableUpload(db, upload.UploadID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated pairs of
+// a key and an optional base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %s: %w", fields[0], err)
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata, nil
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/producer/uploads"
+	"github.com/sirupsen/logrus"
+)
+
+// imagesField is the multipart field holding uploaded image files
+const imagesField = "images"
+
+// isMultipart reports whether the request body is a multipart form
+func isMultipart(c *fiber.Ctx) bool {
+	return strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEMultipartForm)
+}
+
+// chunkedBodyLimit is the largest body accepted without a Content-Length. Such
+// bodies are read into memory to be measured, so larger ones must announce their size.
+const chunkedBodyLimit = fiber.DefaultBodyLimit
+
+// BodyLimit rejects request bodies over max bytes before they are read. The app
+// streams request bodies instead of buffering them, so every route that reads a
+// body needs a limit.
+func BodyLimit(max int64) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		length := int64(c.Request().Header.ContentLength())
+		if length > max {
+			// The unread body cannot be told apart from a next request on the connection
+			c.Context().SetConnectionClose()
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Request body too large")
+		}
+		stream := c.Context().RequestBodyStream()
+		if length >= 0 || stream == nil {
+			return c.Next()
+		}
+		limit := max
+		if limit > chunkedBodyLimit {
+			limit = chunkedBodyLimit
+		}
+		data, err := io.ReadAll(io.LimitReader(stream, limit+1))
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request body")
+		}
+		if int64(len(data)) > limit {
+			c.Context().SetConnectionClose()
+			if limit < max {
+				return fiber.NewError(fiber.StatusLengthRequired, fmt.Sprintf("Content-Length is required for bodies over %d bytes", limit))
+			}
+			return fiber.NewError(fiber.StatusRequestEntityTooLarge, "Request body too large")
+		}
+		c.Request().SetBodyRaw(data)
+		return c.Next()
+	}
+}
+
+// UploadBodyLimit limits multipart bodies, which carry uploads, to max bytes and
+// other bodies to the default limit
+func UploadBodyLimit(max int64) fiber.Handler {
+	upload, other := BodyLimit(max), BodyLimit(fiber.DefaultBodyLimit)
+	return func(c *fiber.Ctx) error {
+		if isMultipart(c) {
+			return upload(c)
+		}
+		return other(c)
+	}
+}
+
+// saveUploads streams the image files of a multipart request to the uploads of the
+// product in store. Files already stored are deleted again if one of them is rejected.
+func saveUploads(c *fiber.Ctx, store storage.Storage, productID int64, limits uploads.Limits) ([]storage.Ref, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		logrus.Errorf("Error in parsing the multipart form: %v", err)
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid multipart form")
+	}
+	files := form.File[imagesField]
+	if limits.MaxFiles > 0 && len(files) > limits.MaxFiles {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Too many images, at most %d can be uploaded at once", limits.MaxFiles))
+	}
+	refs := []storage.Ref{}
+	for _, file := range files {
+		ref, err := uploads.Save(c.Context(), store, productID, file, limits)
+		if err != nil {
+			uploads.Delete(c.Context(), store, refs)
+			return nil, uploadError(file.Filename, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// uploadError maps a failed upload to the response for the client
+func uploadError(filename string, err error) *fiber.Error {
+	switch {
+	case errors.Is(err, uploads.ErrTooLarge):
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Image %s is too large", filename))
+	case errors.Is(err, uploads.ErrUnsupportedType):
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, fmt.Sprintf("Image %s is not a JPEG, PNG or GIF file", filename))
+	case errors.Is(err, uploads.ErrEmpty):
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Image %s is empty", filename))
+	default:
+		logrus.Errorf("Error in storing upload %s: %v", filename, err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+	}
+}
+
+// refStrings returns refs in the form stored as product images
+func refStrings(refs []storage.Ref) []string {
+	images := make([]string, len(refs))
+	for i, ref := range refs {
+		images[i] = ref.String()
+	}
+	return images
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
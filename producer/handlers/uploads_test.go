@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fiber "github.com/gofiber/fiber/v2"
+)
+
+// newLimitedApp serves the size of the request body it read, with bodies streamed
+// like in the producer app
+func newLimitedApp(limit fiber.Handler) *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler, StreamRequestBody: true, DisablePreParseMultipartForm: true})
+	app.Post("/", limit, func(c *fiber.Ctx) error {
+		if isMultipart(c) {
+			form, err := c.MultipartForm()
+			if err != nil {
+				return err
+			}
+			return c.JSON(len(form.File[imagesField]))
+		}
+		return c.JSON(len(c.Body()))
+	})
+	return app
+}
+
+// chunked returns a request whose body is sent without a Content-Length
+func chunked(body io.Reader) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return req
+}
+
+func TestBodyLimit(t *testing.T) {
+	app := newLimitedApp(BodyLimit(1000))
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"within the limit", httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 1000))), fiber.StatusOK},
+		{"over the limit", httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", 1001))), fiber.StatusRequestEntityTooLarge},
+		{"chunked within the limit", chunked(strings.NewReader(strings.Repeat("x", 1000))), fiber.StatusOK},
+		{"chunked over the limit", chunked(strings.NewReader(strings.Repeat("x", 1001))), fiber.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(tt.req, -1)
+			if err != nil {
+				t.Fatalf("Error sending request: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, but got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	// Large bodies sent without a Content-Length are not buffered
+	app = newLimitedApp(BodyLimit(2 * chunkedBodyLimit))
+	resp, err := app.Test(chunked(bytes.NewReader(make([]byte, chunkedBodyLimit+1))), -1)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusLengthRequired {
+		t.Errorf("Expected status %d, but got %d", fiber.StatusLengthRequired, resp.StatusCode)
+	}
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	app := newLimitedApp(UploadBodyLimit(2 * fiber.DefaultBodyLimit))
+
+	// Uploads may exceed the default limit
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	part, _ := w.CreateFormFile(imagesField, "a.jpg")
+	part.Write(make([]byte, fiber.DefaultBodyLimit+1))
+	w.Close()
+	req := httptest.NewRequest(http.MethodPost, "/", &form)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Errorf("Expected an upload over the default limit to be accepted, but got status %d", resp.StatusCode)
+	}
+
+	// Other bodies may not
+	req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, fiber.DefaultBodyLimit+1)))
+	req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	resp, err = app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for a JSON body over the default limit, but got %d", fiber.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/consumer/webhooks"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookEvents are the events a subscription can receive
+var WebhookEvents = []string{webhooks.EventCompleted, webhooks.EventFailed}
+
+// maxWebhookDeliveries caps the deliveries listed for a subscription
+const maxWebhookDeliveries = 100
+
+// WebhookRequest creates a webhook subscription
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	UserID int      `json:"user_id"` // 0 subscribes to the products of every user
+	Events []string `json:"events"`  // default every event
+	Secret string   `json:"secret"`  // generated when empty
+}
+
+// @Summary Create a webhook subscription
+// @Description Subscribe an endpoint to product events, for one user's products or every product. Deliveries are signed with the returned secret: the X-Webhook-Signature header is "sha256=" followed by the hex HMAC-SHA256 of the X-Webhook-Timestamp header, a dot and the body. The secret is only returned here.
+// @Tags Admin
+// @Security BearerAuth
+// @Accept json
+// @Produce json
+// @Param request body WebhookRequest true "Subscription"
+// @Success 201 {object} database.WebhookSubscription
+// @Failure 400 {object} ErrorResponse "Invalid request payload, URL, user ID or event"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/webhooks [post]
+func CreateWebhook(db *sql.DB, policy *urlpolicy.Policy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req WebhookRequest
+		if err := c.BodyParser(&req); err != nil {
+			logrus.Errorf("Error in parsing the request body: %v", err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+		if err := policy.Resolve(c.Context(), req.URL); err != nil {
+			logrus.Errorf("Rejected webhook URL %q: %v", req.URL, err)
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid webhook URL")
+		}
+		if len(req.Events) == 0 {
+			req.Events = WebhookEvents
+		}
+		for _, event := range req.Events {
+			if !knownWebhookEvent(event) {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("Unknown event: %s", event))
+			}
+		}
+
+		sub := database.WebhookSubscription{URL: req.URL, Secret: req.Secret, Events: req.Events}
+		if req.UserID != 0 {
+			if err := database.UserExists(db, req.UserID); err != nil {
+				if err == sql.ErrNoRows {
+					return fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+				}
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+			sub.UserID = &req.UserID
+		}
+		if sub.Secret == "" {
+			b := make([]byte, 32)
+			rand.Read(b)
+			sub.Secret = hex.EncodeToString(b)
+		}
+
+		if err := database.CreateWebhookSubscription(db, &sub); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		c.Location(fmt.Sprintf("/admin/webhooks/%d", sub.ID))
+		return c.Status(fiber.StatusCreated).JSON(sub)
+	}
+}
+
+func knownWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookParam parses the ID in the path
+func webhookParam(c *fiber.Ctx, message string) (int64, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fiber.NewError(fiber.StatusBadRequest, message)
+	}
+	return id, nil
+}
+
+// @Summary List webhook subscriptions
+// @Description List every webhook subscription, without their secrets
+// @Tags Admin
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} database.WebhookSubscription
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/webhooks [get]
+func ListWebhooks(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		subs, err := database.ListWebhookSubscriptions(db)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.JSON(subs)
+	}
+}
+
+// @Summary Delete a webhook subscription
+// @Description Remove a webhook subscription together with its delivery log
+// @Tags Admin
+// @Security BearerAuth
+// @Param id path int true "Subscription ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse "Invalid subscription ID"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Subscription not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/webhooks/{id} [delete]
+func DeleteWebhook(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := webhookParam(c, "Invalid subscription ID")
+		if err != nil {
+			return err
+		}
+		if err := database.DeleteWebhookSubscription(db, id); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Subscription not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// @Summary List webhook deliveries
+// @Description List the latest deliveries of a webhook subscription, newest first, with every attempt made to send them
+// @Tags Admin
+// @Security BearerAuth
+// @Produce json
+// @Param id path int true "Subscription ID"
+// @Param limit query int false "Deliveries to return, at most 100" default(20)
+// @Success 200 {array} database.WebhookDelivery
+// @Failure 400 {object} ErrorResponse "Invalid subscription ID"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Subscription not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/webhooks/{id}/deliveries [get]
+func ListWebhookDeliveries(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := webhookParam(c, "Invalid subscription ID")
+		if err != nil {
+			return err
+		}
+		limit := c.QueryInt("limit", 20)
+		if limit <= 0 || limit > maxWebhookDeliveries {
+			limit = maxWebhookDeliveries
+		}
+		if err := database.WebhookSubscriptionExists(db, id); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Subscription not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		deliveries, err := database.ListWebhookDeliveries(db, id, limit)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		return c.JSON(deliveries)
+	}
+}
+
+// @Summary Redeliver a webhook
+// @Description Send a delivery again, whatever its status, with a fresh set of retries. The consumer picks it up on its next poll.
+// @Tags Admin
+// @Security BearerAuth
+// @Param id path int true "Delivery ID"
+// @Success 202
+// @Failure 400 {object} ErrorResponse "Invalid delivery ID"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Delivery not found"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /admin/webhooks/deliveries/{id}/redeliver [post]
+func RedeliverWebhook(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id, err := webhookParam(c, "Invalid delivery ID")
+		if err != nil {
+			return err
+		}
+		if err := database.RedeliverWebhook(db, id); err != nil {
+			if err == sql.ErrNoRows {
+				return fiber.NewError(fiber.StatusNotFound, "Delivery not found")
+			}
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		logrus.Infof("Queued webhook delivery %d again", id)
+		return c.SendStatus(fiber.StatusAccepted)
+	}
+}
@@ -0,0 +1,238 @@
+// Package idempotency lets clients retry requests safely with an Idempotency-Key
+// header. The first response for a key is stored and replayed for repeats.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/sirupsen/logrus"
+)
+
+// Header is the request header carrying the idempotency key
+const Header = "Idempotency-Key"
+
+// ReplayedHeader is set on responses replayed from a stored key
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultTTL is how long keys are remembered when New is given a zero TTL
+const DefaultTTL = 24 * time.Hour
+
+// DefaultLeaseTTL is how long a request may run before its key is reclaimed when
+// Options.LeaseTTL is zero
+const DefaultLeaseTTL = 5 * time.Minute
+
+// maxKeyLength bounds the size of a key
+const maxKeyLength = 255
+
+// Options configures the middleware returned by New
+type Options struct {
+	TTL time.Duration // how long responses are replayed, DefaultTTL when zero
+	// LeaseTTL is how long a key stays reserved by a request that has not completed,
+	// so that a key left behind by a crashed server can be used again.
+	// DefaultLeaseTTL when zero.
+	LeaseTTL time.Duration
+	// Scope names the client a key belongs to, so that clients cannot see or block
+	// each other's keys. Defaults to the Authorization header, and to no scope for
+	// anonymous requests.
+	Scope func(c *fiber.Ctx) string
+}
+
+// New returns a middleware that stores the response of requests made with an
+// Idempotency-Key and replays it for repeats within opts.TTL. A repeat with a
+// different method, path or content, or one made while the first request is still
+// running, is rejected with 409. Server errors are not stored, so those requests
+// can be retried.
+func New(db *sql.DB, opts Options) fiber.Handler {
+	ttl, leaseTTL, scope := opts.TTL, opts.LeaseTTL, opts.Scope
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if leaseTTL <= 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+	if scope == nil {
+		scope = clientScope
+	}
+	return func(c *fiber.Ctx) error {
+		key := c.Get(Header)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > maxKeyLength {
+			return fiber.NewError(fiber.StatusBadRequest, "Idempotency-Key is too long")
+		}
+		key = storageKey(scope(c), key)
+		hash, err := requestHash(c)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+
+		rec, err := database.GetIdempotencyRecord(db, key)
+		if err != nil && err != sql.ErrNoRows {
+			logrus.Errorf("Error looking up idempotency key: %v", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		if rec != nil && time.Since(rec.CreatedAt) > ttl {
+			if err := database.DeleteIdempotencyKey(db, key); err != nil {
+				logrus.Errorf("Error deleting expired idempotency key: %v", err)
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+			rec = nil
+		}
+		reserved := false
+		if rec != nil && !rec.Completed && time.Since(rec.CreatedAt) > leaseTTL {
+			// The request holding the key never completed, e.g. because the server crashed
+			reserved, err = database.ReclaimIdempotencyKey(db, key, hash, rec.CreatedAt)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+			if reserved {
+				logrus.Warnf("Reclaimed idempotency key %s left in progress since %s", key, rec.CreatedAt)
+			}
+		}
+		if !reserved {
+			if rec != nil {
+				return replay(c, rec, hash)
+			}
+			reserved, err = database.ReserveIdempotencyKey(db, key, hash)
+			if err != nil {
+				return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+			}
+			if !reserved {
+				return fiber.NewError(fiber.StatusConflict, "A request with this Idempotency-Key is already in progress")
+			}
+		}
+
+		// Render errors here so that the response can be stored like any other
+		if err := c.Next(); err != nil {
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				database.DeleteIdempotencyKey(db, key)
+				return herr
+			}
+		}
+		resp := c.Response()
+		status := resp.StatusCode()
+		if status >= fiber.StatusInternalServerError {
+			database.DeleteIdempotencyKey(db, key)
+			return nil
+		}
+		database.CompleteIdempotencyKey(db, key, status, string(resp.Header.ContentType()), string(resp.Header.Peek(fiber.HeaderLocation)), resp.Body())
+		return nil
+	}
+}
+
+func replay(c *fiber.Ctx, rec *database.IdempotencyRecord, hash string) error {
+	if rec.RequestHash != hash {
+		return fiber.NewError(fiber.StatusConflict, "Idempotency-Key was already used with a different request")
+	}
+	if !rec.Completed {
+		return fiber.NewError(fiber.StatusConflict, "A request with this Idempotency-Key is already in progress")
+	}
+	logrus.Infof("Replaying stored response for idempotency key %s", rec.Key)
+	c.Set(ReplayedHeader, "true")
+	if rec.ContentType != "" {
+		c.Set(fiber.HeaderContentType, rec.ContentType)
+	}
+	if rec.Location != "" {
+		c.Location(rec.Location)
+	}
+	return c.Status(rec.StatusCode).Send(rec.Body)
+}
+
+// clientScope identifies the client by its credentials. Anonymous clients share the
+// bare keys, as their IP address can change between a request and its retry.
+func clientScope(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+		return "auth:" + auth
+	}
+	return ""
+}
+
+// storageKey is the key stored for a client's Idempotency-Key. It is hashed so
+// that credentials are not stored and the length stays bounded.
+func storageKey(scope, key string) string {
+	sum := sha256.Sum256([]byte(scope + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestHash identifies a request by method, path and content. JSON bodies are
+// compared by value and multipart forms by their fields and file contents, so that
+// a retry encoding the same request differently, e.g. with a new multipart
+// boundary, is recognised.
+func requestHash(c *fiber.Ctx) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(c.Method()))
+	h.Write([]byte{0})
+	h.Write([]byte(c.Path()))
+	h.Write([]byte{0})
+	contentType := strings.ToLower(c.Get(fiber.HeaderContentType))
+	switch {
+	case strings.HasPrefix(contentType, fiber.MIMEMultipartForm):
+		if err := hashMultipart(c, h); err != nil {
+			return "", err
+		}
+	case strings.HasPrefix(contentType, fiber.MIMEApplicationJSON):
+		var value interface{}
+		if err := json.Unmarshal(c.Body(), &value); err != nil {
+			// Invalid JSON is left for the handler to reject
+			h.Write(c.Body())
+			break
+		}
+		// Marshalling sorts object keys and drops insignificant whitespace
+		canonical, _ := json.Marshal(value)
+		h.Write(canonical)
+	default:
+		h.Write(c.Body())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashMultipart writes the fields of a multipart form and the digests of its files
+// to h, in a fixed order
+func hashMultipart(c *fiber.Ctx, h io.Writer) error {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(form.Value))
+	for name := range form.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range form.Value[name] {
+			h.Write([]byte("field\x00" + name + "\x00" + v + "\x00"))
+		}
+	}
+	names = names[:0]
+	for name := range form.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, file := range form.File[name] {
+			f, err := file.Open()
+			if err != nil {
+				return err
+			}
+			sum := sha256.New()
+			_, err = io.Copy(sum, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			h.Write([]byte("file\x00" + name + "\x00" + file.Filename + "\x00"))
+			h.Write(sum.Sum(nil))
+		}
+	}
+	return nil
+}
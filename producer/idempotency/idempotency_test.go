@@ -0,0 +1,239 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestApp(t *testing.T, ttl time.Duration) (*fiber.App, *sql.DB, *int) {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+	_, err = testDB.Exec(`
+		CREATE TABLE IdempotencyKeys (
+			idem_key TEXT PRIMARY KEY,
+			request_hash TEXT,
+			completed BOOLEAN,
+			status_code INTEGER,
+			content_type TEXT,
+			location TEXT,
+			response_body TEXT,
+			created_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Error creating IdempotencyKeys table: %v", err)
+	}
+
+	calls := 0
+	app := fiber.New(fiber.Config{ProxyHeader: fiber.HeaderXForwardedFor})
+	app.Post("/products", New(testDB, Options{TTL: ttl, LeaseTTL: time.Minute}), func(c *fiber.Ctx) error {
+		calls++
+		if strings.Contains(string(c.Body()), "fail") {
+			return fiber.NewError(fiber.StatusInternalServerError, "Internal server error")
+		}
+		if strings.Contains(string(c.Body()), "invalid") {
+			return fiber.NewError(fiber.StatusBadRequest, "Invalid request payload")
+		}
+		c.Location("/products/1")
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"call": calls})
+	})
+	return app, testDB, &calls
+}
+
+// testAuth is the credential the test client sends
+const testAuth = "Bearer test"
+
+func post(t *testing.T, app *fiber.App, key, body string) (*http.Response, string) {
+	return send(t, app, key, "application/json", testAuth, strings.NewReader(body))
+}
+
+func send(t *testing.T, app *fiber.App, key, contentType, auth string, body io.Reader) (*http.Response, string) {
+	req := httptest.NewRequest(http.MethodPost, "/products", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", auth)
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestIdempotency(t *testing.T) {
+	app, _, calls := newTestApp(t, time.Hour)
+
+	resp, body := post(t, app, "key-1", `{"product_name":"a"}`)
+	if resp.StatusCode != fiber.StatusCreated || body != `{"call":1}` {
+		t.Fatalf("Unexpected first response: %d %s", resp.StatusCode, body)
+	}
+
+	// A retry gets the stored response without running the handler again
+	resp, body = post(t, app, "key-1", `{"product_name":"a"}`)
+	if resp.StatusCode != fiber.StatusCreated || body != `{"call":1}` {
+		t.Errorf("Unexpected replayed response: %d %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get(ReplayedHeader) != "true" || resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Location") != "/products/1" {
+		t.Errorf("Unexpected replayed headers: %v", resp.Header)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected the handler to run once, but it ran %d times", *calls)
+	}
+
+	// The same key with a different body is a conflict
+	resp, _ = post(t, app, "key-1", `{"product_name":"b"}`)
+	if resp.StatusCode != fiber.StatusConflict {
+		t.Errorf("Expected 409 for a reused key, but got %d", resp.StatusCode)
+	}
+
+	// Requests without a key are not deduplicated
+	post(t, app, "", `{"product_name":"a"}`)
+	post(t, app, "", `{"product_name":"a"}`)
+	if *calls != 3 {
+		t.Errorf("Expected the handler to run 3 times, but it ran %d times", *calls)
+	}
+}
+
+func TestIdempotencyErrors(t *testing.T) {
+	app, testDB, calls := newTestApp(t, time.Hour)
+
+	// Client errors are stored and replayed
+	resp, _ := post(t, app, "key-400", `invalid`)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("Expected 400, but got %d", resp.StatusCode)
+	}
+	resp, body := post(t, app, "key-400", `invalid`)
+	if resp.StatusCode != fiber.StatusBadRequest || body != "Invalid request payload" || *calls != 1 {
+		t.Errorf("Expected the 400 to be replayed, got %d %q after %d calls", resp.StatusCode, body, *calls)
+	}
+
+	// Server errors are not stored so that the request can be retried
+	post(t, app, "key-500", `fail`)
+	resp, _ = post(t, app, "key-500", `fail`)
+	if resp.StatusCode != fiber.StatusInternalServerError || *calls != 3 {
+		t.Errorf("Expected the 500 to be retried, got %d after %d calls", resp.StatusCode, *calls)
+	}
+
+	// A key whose first request is still running is a conflict
+	sum := sha256.Sum256([]byte("POST\x00/products\x00{}"))
+	testDB.Exec("INSERT INTO IdempotencyKeys VALUES (?, ?, 0, 0, '', '', '', ?)", storageKey("auth:"+testAuth, "busy"), hex.EncodeToString(sum[:]), time.Now().Format("2006-01-02 15:04:05"))
+	resp, body = post(t, app, "busy", `{}`)
+	if resp.StatusCode != fiber.StatusConflict || !strings.Contains(body, "in progress") {
+		t.Errorf("Expected 409 for a key in progress, but got %d", resp.StatusCode)
+	}
+
+	resp, _ = post(t, app, strings.Repeat("k", 300), `{}`)
+	if resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("Expected 400 for a long key, but got %d", resp.StatusCode)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	app, testDB, calls := newTestApp(t, time.Hour)
+
+	post(t, app, "old", `{}`)
+	testDB.Exec("UPDATE IdempotencyKeys SET created_at = ? WHERE idem_key = ?", time.Now().Add(-2*time.Hour).Format("2006-01-02 15:04:05"), storageKey("auth:"+testAuth, "old"))
+
+	// An expired key is treated as new, even with a different body
+	resp, body := post(t, app, "old", `{"product_name":"new"}`)
+	if resp.StatusCode != fiber.StatusCreated || body != `{"call":2}` || *calls != 2 {
+		t.Errorf("Expected the expired key to run again, got %d %s after %d calls", resp.StatusCode, body, *calls)
+	}
+}
+
+func TestIdempotencyAbandonedKey(t *testing.T) {
+	app, testDB, calls := newTestApp(t, time.Hour)
+
+	// A key reserved by a request that never completed is reclaimed after the lease
+	sum := sha256.Sum256([]byte("POST\x00/products\x00{}"))
+	key := storageKey("auth:"+testAuth, "crashed")
+	testDB.Exec("INSERT INTO IdempotencyKeys VALUES (?, ?, 0, 0, '', '', '', ?)", key, hex.EncodeToString(sum[:]), time.Now().Add(-2*time.Minute).Format("2006-01-02 15:04:05"))
+	resp, body := post(t, app, "crashed", `{}`)
+	if resp.StatusCode != fiber.StatusCreated || *calls != 1 {
+		t.Fatalf("Expected the abandoned key to run again, got %d %s after %d calls", resp.StatusCode, body, *calls)
+	}
+	resp, _ = post(t, app, "crashed", `{}`)
+	if resp.Header.Get(ReplayedHeader) != "true" || *calls != 1 {
+		t.Errorf("Expected the reclaimed key to be replayed, got %d after %d calls", resp.StatusCode, *calls)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	app, _, calls := newTestApp(t, time.Hour)
+
+	// Clients with different credentials do not share keys
+	send(t, app, "shared", "application/json", "Bearer alice", strings.NewReader(`{"product_name":"a"}`))
+	resp, _ := send(t, app, "shared", "application/json", "Bearer bob", strings.NewReader(`{"product_name":"b"}`))
+	if resp.StatusCode != fiber.StatusCreated || resp.Header.Get(ReplayedHeader) != "" || *calls != 2 {
+		t.Errorf("Expected another client's key to run, got %d after %d calls", resp.StatusCode, *calls)
+	}
+
+	// Anonymous clients are not told apart by their IP address, which can change
+	// before they retry
+	for _, ip := range []string{"192.0.2.1", "198.51.100.7"} {
+		req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(`{"product_name":"c"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(fiber.HeaderXForwardedFor, ip)
+		req.Header.Set(Header, "anonymous")
+		var err error
+		if resp, err = app.Test(req); err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+	}
+	if resp.StatusCode != fiber.StatusCreated || resp.Header.Get(ReplayedHeader) != "true" || *calls != 3 {
+		t.Errorf("Expected the retry from another IP address to be replayed, got %d after %d calls", resp.StatusCode, *calls)
+	}
+}
+
+func TestIdempotencyEquivalentBodies(t *testing.T) {
+	app, _, calls := newTestApp(t, time.Hour)
+
+	// JSON is compared by value
+	post(t, app, "json", `{"product_name":"a","product_price":1}`)
+	resp, _ := post(t, app, "json", `{ "product_price": 1, "product_name": "a" }`)
+	if resp.Header.Get(ReplayedHeader) != "true" || *calls != 1 {
+		t.Errorf("Expected reformatted JSON to be replayed, got %d after %d calls", resp.StatusCode, *calls)
+	}
+
+	// Multipart forms are compared by fields and file contents, not by boundary
+	form := func(boundary, image string) (string, io.Reader) {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		w.SetBoundary(boundary)
+		w.WriteField("product_name", "a")
+		part, _ := w.CreateFormFile("images", "a.jpg")
+		part.Write([]byte(image))
+		w.Close()
+		return w.FormDataContentType(), &buf
+	}
+	contentType, body := form("first-boundary", "image-1")
+	send(t, app, "multipart", contentType, testAuth, body)
+	contentType, body = form("second-boundary", "image-1")
+	resp, _ = send(t, app, "multipart", contentType, testAuth, body)
+	if resp.Header.Get(ReplayedHeader) != "true" || *calls != 2 {
+		t.Errorf("Expected a retry with a new boundary to be replayed, got %d after %d calls", resp.StatusCode, *calls)
+	}
+	contentType, body = form("third-boundary", "image-2")
+	resp, _ = send(t, app, "multipart", contentType, testAuth, body)
+	if resp.StatusCode != fiber.StatusConflict {
+		t.Errorf("Expected 409 for a different file, but got %d", resp.StatusCode)
+	}
+}
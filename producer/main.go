@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"os"
+	"strconv"
+	"time"
 
-	fiber "github.com/gofiber/fiber/v2"
-
-	"github.com/gofiber/swagger"
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/consumer/urlpolicy"
+	"github.com/golang_backend_assignment/producer/app"
 	"github.com/golang_backend_assignment/producer/database"
 	_ "github.com/golang_backend_assignment/producer/docs"
-	"github.com/golang_backend_assignment/producer/handlers"
+	"github.com/golang_backend_assignment/producer/idempotency"
 	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/golang_backend_assignment/producer/progress"
+	"github.com/golang_backend_assignment/producer/uploads"
 	"github.com/joho/godotenv"
 	"github.com/sirupsen/logrus"
 )
 
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -28,7 +37,7 @@ func main() {
 	}
 	defer db.Close()
 
-	queue := os.Getenv("RM_QUEUENAME")
+	lanes := msgqueue.LanesFromEnv()
 	conn, err := msgqueue.NewRMQ()
 	if err != nil {
 		logrus.Errorf("Failed to connect to RabbitMQ: %v", err)
@@ -42,14 +51,80 @@ func main() {
 	}
 	defer ch.Close()
 
-	// Create the Fiber app
-	app := fiber.New()
+	// Uploaded images are stored where the consumer reads them from
+	store, err := storage.FromEnv()
+	if err != nil {
+		logrus.Errorf("Failed to set up image storage: %v", err)
+		return
+	}
+	// Direct and resumable uploads share the limit the consumer reads uploads with
+	limits := uploads.Limits{MaxBytes: imageutils.MaxUploadBytesFromEnv(), MaxFiles: 10}
+	if n, err := strconv.Atoi(os.Getenv("UPLOAD_MAX_FILES")); err == nil && n > 0 {
+		limits.MaxFiles = n
+	}
+
+	resumableExpiry := 24 * time.Hour
+	if hours, err := strconv.Atoi(os.Getenv("UPLOAD_RESUMABLE_EXPIRY_HOURS")); err == nil && hours > 0 {
+		resumableExpiry = time.Duration(hours) * time.Hour
+	}
+
+	idempotencyTTL := idempotency.DefaultTTL
+	if hours, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL_HOURS")); err == nil && hours > 0 {
+		idempotencyTTL = time.Duration(hours) * time.Hour
+	}
+	for _, queue := range []string{lanes.Interactive, lanes.Bulk} {
+		if err := msgqueue.DeclareQueue(ch, queue); err != nil {
+			logrus.Errorf("Failed to declare queue: %v", err)
+			return
+		}
+	}
+	// Relay the progress events of the consumer to clients streaming them, on a
+	// channel of its own as it consumes
+	progressHub := progress.NewHub()
+	progressCh, err := msgqueue.NewChannel(conn)
+	if err != nil {
+		logrus.Errorf("Failed to open a rmq channel: %v", err)
+		return
+	}
+	defer progressCh.Close()
+	progressExchange := os.Getenv("RMQ_PROGRESS_EXCHANGE")
+	if progressExchange == "" {
+		progressExchange = "product_progress"
+	}
+	if err := msgqueue.SubscribeProgress(progressCh, progressExchange, progressHub.Publish); err != nil {
+		logrus.Errorf("Failed to subscribe to progress events: %v", err)
+		return
+	}
+	eventsExchange := os.Getenv("RMQ_EVENTS_EXCHANGE")
+	if eventsExchange == "" {
+		eventsExchange = "product_events"
+	}
+	publishEvent, err := msgqueue.NewEventPublisher(ch, eventsExchange)
+	if err != nil {
+		logrus.Errorf("Failed to set up domain events: %v", err)
+		return
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			uploads.SweepExpired(context.Background(), db, store, time.Now())
+		}
+	}()
 
-	// Define the route to receive the product data
-	app.Post("/products", handlers.SaveProduct(db, ch, queue))
-	app.Get("/swagger/*", swagger.HandlerDefault)
+	server := app.New(app.Config{
+		DB:              db,
+		Broker:          ch,
+		Lanes:           lanes,
+		PublishEvent:    publishEvent,
+		Progress:        progressHub,
+		Policy:          urlpolicy.FromEnv(),
+		Storage:         store,
+		Limits:          limits,
+		ResumableExpiry: resumableExpiry,
+		IdempotencyTTL:  idempotencyTTL,
+		AdminToken:      os.Getenv("ADMIN_TOKEN"),
+	})
 	// Start the server
-	if err := app.Listen(":3000"); err != nil {
+	if err := server.Listen(":3000"); err != nil {
 		logrus.Fatalf("Error in starting the server...: %v", err)
 	}
 }
@@ -0,0 +1,22 @@
+package msgqueue
+
+import (
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/streadway/amqp"
+)
+
+// The producer talks to RabbitMQ through the interfaces of the consumer, so that both
+// run on *amqp.Channel in production and on the consumer's MemoryBroker in tests.
+type (
+	// Publisher declares exchanges and queues and publishes messages to them
+	Publisher = consumerqueue.Publisher
+	// Subscriber declares queues, binds them to exchanges and consumes them
+	Subscriber = consumerqueue.Subscriber
+	// Broker both publishes and subscribes
+	Broker = consumerqueue.Broker
+)
+
+var (
+	_ Broker = (*amqp.Channel)(nil)
+	_ Broker = (*consumerqueue.MemoryBroker)(nil)
+)
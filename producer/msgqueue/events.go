@@ -0,0 +1,46 @@
+package msgqueue
+
+import (
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+)
+
+// EventSource names the producer in the events it publishes
+const EventSource = "image-crunch-producer"
+
+// Domain events published by the producer
+const (
+	EventProductCreated = "product.created"
+)
+
+// The producer publishes its events in the envelope of the consumer's, so that
+// subscribers read the events of both services alike.
+type (
+	// DomainEvent is the envelope of every event published to the events exchange
+	DomainEvent = consumerqueue.DomainEvent
+	// EventPublisher publishes domain events
+	EventPublisher = consumerqueue.EventPublisher
+)
+
+// ProductCreatedV1 is the data of product.created version 1
+type ProductCreatedV1 struct {
+	ProductID          int64    `json:"product_id"`
+	UserID             int      `json:"user_id"`
+	ProductName        string   `json:"product_name"`
+	ProductDescription string   `json:"product_description"`
+	ProductImages      []string `json:"product_images"`
+	ProductPrice       float64  `json:"product_price"`
+}
+
+// NewEvent returns an event of the given type and version that occurred now in the
+// producer
+func NewEvent(eventType string, version int, data interface{}) DomainEvent {
+	event := consumerqueue.NewEvent(eventType, version, data)
+	event.Source = EventSource
+	return event
+}
+
+// NewEventPublisher declares the durable topic exchange domain events are published
+// to and returns an EventPublisher for it
+func NewEventPublisher(ch Publisher, exchange string) (EventPublisher, error) {
+	return consumerqueue.NewEventPublisher(ch, exchange)
+}
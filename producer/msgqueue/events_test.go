@@ -0,0 +1,61 @@
+package msgqueue
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/streadway/amqp"
+)
+
+func TestProductCreatedEvent(t *testing.T) {
+	b := consumerqueue.NewMemoryBroker()
+	defer b.Close()
+	publish, err := NewEventPublisher(b, "product_events")
+	if err != nil {
+		t.Fatalf("Error declaring the exchange: %v", err)
+	}
+	q, err := b.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatalf("Error declaring queue: %v", err)
+	}
+	if err := b.QueueBind(q.Name, "product.created.v1", "product_events", false, nil); err != nil {
+		t.Fatalf("Error binding queue: %v", err)
+	}
+	msgs, err := b.Consume(q.Name, "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("Error consuming: %v", err)
+	}
+
+	event := NewEvent(EventProductCreated, 1, ProductCreatedV1{ProductID: 5, UserID: 2, ProductName: "Mug", ProductImages: []string{"http://127.0.0.1/a.jpg"}, ProductPrice: 9.5})
+	if err := publish(event); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	d := receive(t, msgs, time.Second)
+	if d.RoutingKey != "product.created.v1" || d.Type != EventProductCreated || d.AppId != EventSource || d.MessageId != event.ID || d.DeliveryMode != amqp.Persistent {
+		t.Errorf("Unexpected delivery %q of type %q from %q with ID %q", d.RoutingKey, d.Type, d.AppId, d.MessageId)
+	}
+
+	var envelope struct {
+		ID         string           `json:"id"`
+		Type       string           `json:"type"`
+		Version    int              `json:"version"`
+		Source     string           `json:"source"`
+		OccurredAt time.Time        `json:"occurred_at"`
+		Data       ProductCreatedV1 `json:"data"`
+	}
+	if err := json.Unmarshal(d.Body, &envelope); err != nil {
+		t.Fatalf("Error decoding the event: %v", err)
+	}
+	if envelope.ID != event.ID || len(envelope.ID) != 32 || envelope.Type != "product.created" || envelope.Version != 1 || envelope.OccurredAt.IsZero() {
+		t.Errorf("Unexpected envelope %+v", envelope)
+	}
+	if envelope.Source != "image-crunch-producer" {
+		t.Errorf("Expected the producer as the source, got %q", envelope.Source)
+	}
+	if want := event.Data.(ProductCreatedV1); !reflect.DeepEqual(envelope.Data, want) {
+		t.Errorf("Expected data %+v, got %+v", want, envelope.Data)
+	}
+}
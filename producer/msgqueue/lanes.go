@@ -0,0 +1,66 @@
+package msgqueue
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default thresholds of Lanes
+const (
+	DefaultBulkAfter  = 20
+	DefaultBulkWindow = time.Minute
+)
+
+// Lanes are the queues of the two lanes. The consumer keeps part of its capacity for
+// the interactive queue, so bulk jobs never hold up interactive ones. The lane of a
+// new product is chosen from how many products its user just created: a user who
+// created BulkAfter products within BulkWindow is importing rather than waiting for
+// each product, and their further products go to the bulk lane.
+type Lanes struct {
+	Interactive string
+	Bulk        string
+	BulkAfter   int           // default DefaultBulkAfter
+	BulkWindow  time.Duration // default DefaultBulkWindow
+}
+
+// LanesFromEnv reads the queues of the lanes from RM_QUEUENAME and RM_BULK_QUEUENAME,
+// and the thresholds from LANE_BULK_AFTER_PRODUCTS and LANE_BULK_WINDOW_SECONDS. The
+// bulk queue defaults to "<RM_QUEUENAME>.bulk".
+func LanesFromEnv() Lanes {
+	lanes := Lanes{Interactive: os.Getenv("RM_QUEUENAME"), Bulk: os.Getenv("RM_BULK_QUEUENAME")}
+	if lanes.Bulk == "" {
+		lanes.Bulk = lanes.Interactive + ".bulk"
+	}
+	lanes.BulkAfter, _ = strconv.Atoi(os.Getenv("LANE_BULK_AFTER_PRODUCTS"))
+	if seconds, err := strconv.Atoi(os.Getenv("LANE_BULK_WINDOW_SECONDS")); err == nil {
+		lanes.BulkWindow = time.Duration(seconds) * time.Second
+	}
+	return lanes.withDefaults()
+}
+
+// withDefaults fills in unset thresholds
+func (l Lanes) withDefaults() Lanes {
+	if l.BulkAfter <= 0 {
+		l.BulkAfter = DefaultBulkAfter
+	}
+	if l.BulkWindow <= 0 {
+		l.BulkWindow = DefaultBulkWindow
+	}
+	return l
+}
+
+// RecentSince is the time from which the products of a user count towards the lane
+// of a product created at now
+func (l Lanes) RecentSince(now time.Time) time.Time {
+	return now.Add(-l.withDefaults().BulkWindow)
+}
+
+// ForNewProduct returns the queue of a new product whose user created recent other
+// products since RecentSince
+func (l Lanes) ForNewProduct(recent int) string {
+	if recent >= l.withDefaults().BulkAfter {
+		return l.Bulk
+	}
+	return l.Interactive
+}
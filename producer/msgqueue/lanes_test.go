@@ -0,0 +1,31 @@
+package msgqueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLanes(t *testing.T) {
+	t.Setenv("RM_QUEUENAME", "products")
+	t.Setenv("RM_BULK_QUEUENAME", "")
+	t.Setenv("LANE_BULK_AFTER_PRODUCTS", "")
+	t.Setenv("LANE_BULK_WINDOW_SECONDS", "")
+	lanes := LanesFromEnv()
+	if want := (Lanes{Interactive: "products", Bulk: "products.bulk", BulkAfter: DefaultBulkAfter, BulkWindow: DefaultBulkWindow}); lanes != want {
+		t.Errorf("Unexpected lanes: %+v", lanes)
+	}
+
+	t.Setenv("LANE_BULK_AFTER_PRODUCTS", "3")
+	t.Setenv("LANE_BULK_WINDOW_SECONDS", "10")
+	lanes = LanesFromEnv()
+	now := time.Now()
+	if since := lanes.RecentSince(now); !since.Equal(now.Add(-10 * time.Second)) {
+		t.Errorf("RecentSince() = %v, want 10s before %v", since, now)
+	}
+	tests := map[int]string{0: "products", 2: "products", 3: "products.bulk", 50: "products.bulk"}
+	for recent, want := range tests {
+		if got := lanes.ForNewProduct(recent); got != want {
+			t.Errorf("ForNewProduct(%d) = %q, want %q", recent, got, want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package msgqueue
+
+import (
+	"encoding/json"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/sirupsen/logrus"
+)
+
+// ProgressEvent reports how far the consumer got processing a product's images. It
+// is the consumer's event, so that both read the same fields; products that no job
+// is processing are reported pending, done or failed.
+type ProgressEvent = consumerqueue.ProgressEvent
+
+// SubscribeProgress binds a queue of its own to the fanout exchange the consumer
+// publishes progress events to, so that every producer replica sees every event, and
+// passes the events to handle until the channel closes
+func SubscribeProgress(ch Subscriber, exchange string, handle func(ProgressEvent)) error {
+	err := ch.ExchangeDeclare(
+		exchange, // name
+		"fanout", // type
+		true,     // durable
+		false,    // auto-deleted
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+	if err != nil {
+		logrus.Errorf("Failed to declare exchange %s: %v", exchange, err)
+		return err
+	}
+	q, err := ch.QueueDeclare(
+		"",    // name chosen by the server
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		logrus.Errorf("Failed to declare a progress queue: %v", err)
+		return err
+	}
+	if err := ch.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+		logrus.Errorf("Failed to bind the progress queue: %v", err)
+		return err
+	}
+	msgs, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		logrus.Errorf("Failed to consume progress events: %v", err)
+		return err
+	}
+	go func() {
+		for d := range msgs {
+			var event ProgressEvent
+			if err := json.Unmarshal(d.Body, &event); err != nil {
+				logrus.Warnf("Ignoring invalid progress event: %v", err)
+				continue
+			}
+			handle(event)
+		}
+		logrus.Warn("Stopped receiving progress events")
+	}()
+	return nil
+}
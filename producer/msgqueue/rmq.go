@@ -1,9 +1,12 @@
 package msgqueue
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
@@ -36,8 +39,8 @@ func NewChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	return ch, nil
 }
 
-// Take an integer productID and a string queue name and rmq channel as arguments and publish the productID to the queue
-func Producer(productID int64, ch *amqp.Channel, queue string) error {
+// DeclareQueue declares the durable queue the consumer reads from
+func DeclareQueue(ch Publisher, queue string) error {
 	_, err := ch.QueueDeclare(
 		queue, // queue name
 		true,  // durable
@@ -46,9 +49,16 @@ func Producer(productID int64, ch *amqp.Channel, queue string) error {
 		false, // no-wait
 		nil,   // arguments
 	)
-
 	if err != nil {
 		logrus.Errorf("Failed to declare a queue: %v", err)
+	}
+	return err
+}
+
+// Take an integer productID and a string queue name and rmq channel as arguments and publish the productID to the queue
+func Producer(productID int64, ch Publisher, queue string) error {
+	err := DeclareQueue(ch, queue)
+	if err != nil {
 		return err
 	}
 
@@ -70,3 +80,47 @@ func Producer(productID int64, ch *amqp.Channel, queue string) error {
 	logrus.Infof("Successfully published productID: %d to queue: %s", productID, queue)
 	return err
 }
+
+// Job asks the consumer to process the images of a product. Plain product IDs are
+// still accepted by the consumer for new products.
+type Job struct {
+	ProductID int64    `json:"product_id"`
+	Key       string   `json:"key,omitempty"`       // idempotency key, deliveries with the same key are processed once
+	Force     bool     `json:"force,omitempty"`     // process even if the key was already completed
+	Reprocess bool     `json:"reprocess,omitempty"` // reuse archived originals instead of downloading
+	JobID     string   `json:"job_id,omitempty"`    // reprocessing job the message belongs to
+	Images    []string `json:"images,omitempty"`    // product images to process, all of them when empty
+	// NotBefore holds the job back until then, e.g. until a product's embargo lifts
+	NotBefore *time.Time `json:"not_before,omitempty"`
+}
+
+// PublishJob publishes job as JSON to the queue. A job not due yet goes through the
+// delay queues of queue and reaches it at its not-before time.
+func PublishJob(job Job, ch Publisher, queue string) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	msg := amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}
+	if job.NotBefore != nil {
+		if wait := time.Until(*job.NotBefore); wait > 0 {
+			return consumerqueue.PublishDelayed(ch, queue, msg, wait)
+		}
+	}
+	err = ch.Publish(
+		"",
+		queue,
+		false,
+		false,
+		msg,
+	)
+	if err != nil {
+		logrus.Errorf("Failed to publish a message: %v", err)
+		return err
+	}
+	return nil
+}
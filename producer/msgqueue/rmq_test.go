@@ -0,0 +1,91 @@
+package msgqueue
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/streadway/amqp"
+)
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery, timeout time.Duration) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		return d
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for a delivery")
+		return amqp.Delivery{}
+	}
+}
+
+func TestProducer(t *testing.T) {
+	b := consumerqueue.NewMemoryBroker()
+	defer b.Close()
+	if err := DeclareQueue(b, "products"); err != nil {
+		t.Fatalf("Error declaring queue: %v", err)
+	}
+	msgs, err := b.Consume("products", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("Error consuming: %v", err)
+	}
+	if err := Producer(42, b, "products"); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if d := receive(t, msgs, time.Second); string(d.Body) != "42" {
+		t.Errorf("Expected a message for product 42, got %q", d.Body)
+	}
+}
+
+func TestPublishJobDelayed(t *testing.T) {
+	b := consumerqueue.NewMemoryBroker()
+	defer b.Close()
+	if err := DeclareQueue(b, "products"); err != nil {
+		t.Fatalf("Error declaring queue: %v", err)
+	}
+	msgs, err := b.Consume("products", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("Error consuming: %v", err)
+	}
+
+	notBefore := time.Now().Add(1500 * time.Millisecond)
+	start := time.Now()
+	if err := PublishJob(Job{ProductID: 7, NotBefore: &notBefore}, b, "products"); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	if q, err := b.QueueInspect(consumerqueue.DelayQueue("products", time.Second)); err != nil || q.Messages != 1 {
+		t.Fatalf("Expected the job in the 1s delay queue, got %+v, %v", q, err)
+	}
+
+	// The job comes back to the queue when the delay queue's TTL expires
+	d := receive(t, msgs, 3*time.Second)
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("Expected the job to wait at least a second, it waited %v", waited)
+	}
+	var job Job
+	if err := json.Unmarshal(d.Body, &job); err != nil || job.ProductID != 7 || job.NotBefore == nil {
+		t.Errorf("Unexpected job %s: %v", d.Body, err)
+	}
+}
+
+func TestSubscribeProgress(t *testing.T) {
+	b := consumerqueue.NewMemoryBroker()
+	defer b.Close()
+	events := make(chan ProgressEvent, 1)
+	if err := SubscribeProgress(b, "product_progress", func(e ProgressEvent) { events <- e }); err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	body, _ := json.Marshal(ProgressEvent{ProductID: 3, Status: consumerqueue.StatusProcessing, Completed: 1, Total: 2})
+	if err := b.Publish("product_progress", "", false, false, amqp.Publishing{Body: body}); err != nil {
+		t.Fatalf("Error publishing: %v", err)
+	}
+	select {
+	case e := <-events:
+		if e.ProductID != 3 || e.Completed != 1 || e.Total != 2 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the progress event")
+	}
+}
@@ -0,0 +1,94 @@
+// Package progress relays the progress events of product processing to the clients
+// watching each product.
+package progress
+
+import (
+	"sync"
+	"time"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+)
+
+// StaleAfter is how long the latest event of a product in progress is remembered
+// without news, after which its job is assumed to have died with its consumer
+const StaleAfter = 10 * time.Minute
+
+// watcherBuffer is the number of events kept for a client that reads slowly
+const watcherBuffer = 16
+
+// Hub fans progress events out to watchers and remembers the latest event of each
+// product being processed
+type Hub struct {
+	mu       sync.Mutex
+	watchers map[int64]map[chan msgqueue.ProgressEvent]bool
+	latest   map[int64]msgqueue.ProgressEvent
+	now      func() time.Time
+}
+
+// NewHub returns an empty Hub
+func NewHub() *Hub {
+	return &Hub{
+		watchers: map[int64]map[chan msgqueue.ProgressEvent]bool{},
+		latest:   map[int64]msgqueue.ProgressEvent{},
+		now:      time.Now,
+	}
+}
+
+// Publish sends an event to the watchers of its product. A watcher that fell behind
+// loses its oldest event rather than blocking the others; events carry running
+// totals, so the next one catches it up.
+func (h *Hub) Publish(event msgqueue.ProgressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	productID := int64(event.ProductID)
+	if event.Status == consumerqueue.StatusProcessing {
+		h.latest[productID] = event
+	} else {
+		// The product records the outcome of finished jobs
+		delete(h.latest, productID)
+	}
+	for ch := range h.watchers[productID] {
+		select {
+		case ch <- event:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- event
+		}
+	}
+}
+
+// Subscribe returns the events of a product published from now on and a function
+// that stops them
+func (h *Hub) Subscribe(productID int64) (<-chan msgqueue.ProgressEvent, func()) {
+	ch := make(chan msgqueue.ProgressEvent, watcherBuffer)
+	h.mu.Lock()
+	if h.watchers[productID] == nil {
+		h.watchers[productID] = map[chan msgqueue.ProgressEvent]bool{}
+	}
+	h.watchers[productID][ch] = true
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.watchers[productID], ch)
+		if len(h.watchers[productID]) == 0 {
+			delete(h.watchers, productID)
+		}
+	}
+}
+
+// Latest returns the latest event of a product whose job is in progress
+func (h *Hub) Latest(productID int64) (msgqueue.ProgressEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event, ok := h.latest[productID]
+	if ok && h.now().Sub(event.Time) > StaleAfter {
+		delete(h.latest, productID)
+		return msgqueue.ProgressEvent{}, false
+	}
+	return event, ok
+}
@@ -0,0 +1,83 @@
+package progress
+
+import (
+	"testing"
+	"time"
+
+	consumerqueue "github.com/golang_backend_assignment/consumer/msgqueue"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+)
+
+func TestHubRelaysEvents(t *testing.T) {
+	hub := NewHub()
+	events, stop := hub.Subscribe(1)
+	others, stopOthers := hub.Subscribe(2)
+	defer stopOthers()
+
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: consumerqueue.StatusProcessing, Completed: 1, Total: 3, Time: time.Now()})
+	select {
+	case e := <-events:
+		if e.Completed != 1 || e.Total != 3 {
+			t.Errorf("Unexpected event: %+v", e)
+		}
+	default:
+		t.Fatal("Expected the watcher to receive the event")
+	}
+	select {
+	case e := <-others:
+		t.Errorf("Expected watchers of another product not to receive the event, got %+v", e)
+	default:
+	}
+
+	stop()
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: consumerqueue.StatusProcessing, Completed: 2, Total: 3, Time: time.Now()})
+	if len(hub.watchers) != 1 {
+		t.Errorf("Expected the stopped watcher to be removed, got watchers for %d products", len(hub.watchers))
+	}
+}
+
+func TestHubSlowWatcher(t *testing.T) {
+	hub := NewHub()
+	events, stop := hub.Subscribe(1)
+	defer stop()
+	for i := 1; i <= watcherBuffer+5; i++ {
+		hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: consumerqueue.StatusProcessing, Completed: i, Time: time.Now()})
+	}
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: "done", Time: time.Now()})
+
+	// The oldest events are dropped, the last one always arrives
+	var last msgqueue.ProgressEvent
+	n := 0
+	for len(events) > 0 {
+		last = <-events
+		n++
+	}
+	if n != watcherBuffer || last.Status != "done" {
+		t.Errorf("Expected %d buffered events ending with done, got %d ending with %+v", watcherBuffer, n, last)
+	}
+}
+
+func TestHubLatest(t *testing.T) {
+	hub := NewHub()
+	now := time.Now()
+	hub.now = func() time.Time { return now }
+
+	if _, ok := hub.Latest(1); ok {
+		t.Error("Expected no latest event for an unknown product")
+	}
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: consumerqueue.StatusProcessing, Completed: 2, Time: now})
+	if e, ok := hub.Latest(1); !ok || e.Completed != 2 {
+		t.Errorf("Expected the latest event, got %+v, %v", e, ok)
+	}
+
+	now = now.Add(StaleAfter + time.Second)
+	if _, ok := hub.Latest(1); ok {
+		t.Error("Expected a stale event to be forgotten")
+	}
+
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: consumerqueue.StatusProcessing, Time: now})
+	hub.Publish(msgqueue.ProgressEvent{ProductID: 1, Status: "done", Time: now})
+	if _, ok := hub.Latest(1); ok {
+		t.Error("Expected a finished job to be forgotten")
+	}
+}
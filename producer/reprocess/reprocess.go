@@ -0,0 +1,182 @@
+// Package reprocess enqueues products again so that their images are regenerated,
+// e.g. after the compression settings or rendition profiles change.
+package reprocess
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRate is the number of messages published per second when Options.Rate is zero
+const DefaultRate = 50
+
+// Options describes a reprocessing run
+type Options struct {
+	Filter database.ProductFilter
+	// JobID names the job. Running a job again only enqueues products it has not
+	// enqueued yet. When empty it is derived from the filter.
+	JobID string
+	Rate  float64 // messages per second
+	// Force enqueues products the job already enqueued and makes the consumer
+	// process them even if it completed them before
+	Force bool
+	// NotBefore holds the products back until then, when they are enqueued at once
+	NotBefore *time.Time
+}
+
+// Progress is reported while a job is being published
+type Progress struct {
+	JobID    string `json:"job_id"`
+	Total    int    `json:"total"`
+	Enqueued int    `json:"enqueued"`
+	Skipped  int    `json:"skipped"` // already enqueued by an earlier run
+	Failed   int    `json:"failed"`
+}
+
+// Publisher sends a job message to the consumer
+type Publisher func(job msgqueue.Job) error
+
+// JobID derives a job ID from a filter, so that re-running the same filter resumes the same job
+func JobID(filter database.ProductFilter) string {
+	data, _ := json.Marshal(filter)
+	sum := sha256.Sum256(data)
+	return "reprocess-" + hex.EncodeToString(sum[:8])
+}
+
+// ItemKey is the idempotency key of the message reprocessing a product for a job
+func ItemKey(jobID string, productID int64) string {
+	return fmt.Sprintf("reprocess:%s:%d", jobID, productID)
+}
+
+// ParseDate parses a YYYY-MM-DD filter date, returning nil for an empty string
+func ParseDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// NotBefore returns when a job asked to start at an RFC 3339 time, or after a delay
+// from now, may be processed. It returns nil when neither is given and an error
+// when both are.
+func NotBefore(at string, delay time.Duration, now time.Time) (*time.Time, error) {
+	switch {
+	case at != "" && delay != 0:
+		return nil, errors.New("give either a time or a delay")
+	case delay < 0:
+		return nil, fmt.Errorf("negative delay %v", delay)
+	case delay > 0:
+		t := now.Add(delay)
+		return &t, nil
+	case at == "":
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Start records the job and returns the products it matches, with the job ID filled in
+func Start(db *sql.DB, opts *Options) ([]int64, error) {
+	if opts.JobID == "" {
+		opts.JobID = JobID(opts.Filter)
+	}
+	filter, err := json.Marshal(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := database.CreateReprocessJob(db, opts.JobID, string(filter)); err != nil {
+		return nil, err
+	}
+	ids, err := database.FindProductIDs(db, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.SetReprocessJobTotal(db, opts.JobID, len(ids)); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Publish enqueues the products of a started job at no more than opts.Rate messages
+// per second, skipping products already enqueued for the job. progress is called
+// after every product and may be nil.
+func Publish(ctx context.Context, db *sql.DB, publish Publisher, opts Options, ids []int64, progress func(Progress)) (Progress, error) {
+	p := Progress{JobID: opts.JobID, Total: len(ids)}
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = DefaultRate
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for _, id := range ids {
+		added, err := database.AddReprocessItem(db, opts.JobID, id)
+		if err != nil {
+			return p, err
+		}
+		if !added {
+			if !opts.Force {
+				p.Skipped++
+				report(progress, p)
+				continue
+			}
+			if err := database.ResetReprocessItem(db, opts.JobID, id); err != nil {
+				return p, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			database.RemoveReprocessItem(db, opts.JobID, id)
+			return p, ctx.Err()
+		case <-ticker.C:
+		}
+
+		job := msgqueue.Job{ProductID: id, Key: ItemKey(opts.JobID, id), Force: opts.Force, Reprocess: true, JobID: opts.JobID, NotBefore: opts.NotBefore}
+		if err := publish(job); err != nil {
+			logrus.Errorf("Failed to enqueue product %d for %s: %v", id, opts.JobID, err)
+			p.Failed++
+			// Forget the item so that the next run of the job retries it
+			if err := database.RemoveReprocessItem(db, opts.JobID, id); err != nil {
+				return p, err
+			}
+		} else {
+			p.Enqueued++
+		}
+		report(progress, p)
+	}
+	logrus.Infof("Reprocess job %s: enqueued %d, skipped %d, failed %d of %d products", p.JobID, p.Enqueued, p.Skipped, p.Failed, p.Total)
+	return p, nil
+}
+
+// Run starts a job and publishes all of its products
+func Run(ctx context.Context, db *sql.DB, publish Publisher, opts Options, progress func(Progress)) (Progress, error) {
+	ids, err := Start(db, &opts)
+	if err != nil {
+		return Progress{JobID: opts.JobID}, err
+	}
+	return Publish(ctx, db, publish, opts, ids, progress)
+}
+
+func report(progress func(Progress), p Progress) {
+	if progress != nil {
+		progress(p)
+	}
+}
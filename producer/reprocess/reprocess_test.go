@@ -0,0 +1,156 @@
+package reprocess
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/golang_backend_assignment/producer/msgqueue"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	testDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { testDB.Close() })
+
+	_, err = testDB.Exec(`
+		CREATE TABLE Products (product_id INTEGER PRIMARY KEY, user_id INTEGER, processing_status TEXT, created_at TIMESTAMP);
+		CREATE TABLE ReprocessJobs (id TEXT PRIMARY KEY, filter TEXT, total INTEGER, created_at TIMESTAMP, updated_at TIMESTAMP);
+		CREATE TABLE ReprocessItems (job_id TEXT, product_id INTEGER, enqueued_at TIMESTAMP, completed_at TIMESTAMP NULL, error TEXT, PRIMARY KEY (job_id, product_id));
+		INSERT INTO Products VALUES (1, 1, 'done', '2023-01-10 10:00:00'), (2, 1, 'done', '2023-01-11 10:00:00'), (3, 2, 'done', '2023-01-12 10:00:00');
+	`)
+	if err != nil {
+		t.Fatalf("Error creating tables: %v", err)
+	}
+	return testDB
+}
+
+func TestRun(t *testing.T) {
+	testDB := newTestDB(t)
+	published := []msgqueue.Job{}
+	failOn := int64(2)
+	publish := func(job msgqueue.Job) error {
+		if job.ProductID == failOn {
+			return errors.New("broker unavailable")
+		}
+		published = append(published, job)
+		return nil
+	}
+	opts := Options{Filter: database.ProductFilter{UserID: 1}, Rate: 1000}
+
+	reports := 0
+	p, err := Run(context.Background(), testDB, publish, opts, func(Progress) { reports++ })
+	if err != nil {
+		t.Fatalf("Error running job: %v", err)
+	}
+	want := Progress{JobID: JobID(opts.Filter), Total: 2, Enqueued: 1, Failed: 1}
+	if p != want {
+		t.Errorf("Expected %+v, but got %+v", want, p)
+	}
+	if reports != 2 {
+		t.Errorf("Expected 2 progress reports, but got %d", reports)
+	}
+	if len(published) != 1 || !reflect.DeepEqual(published[0], msgqueue.Job{ProductID: 1, Key: ItemKey(want.JobID, 1), Reprocess: true, JobID: want.JobID}) {
+		t.Errorf("Unexpected messages: %+v", published)
+	}
+
+	// Running the job again only enqueues the product that failed, held back until
+	// the new not-before time
+	failOn = 0
+	notBefore := time.Now().Add(time.Hour)
+	opts.NotBefore = &notBefore
+	p, err = Run(context.Background(), testDB, publish, opts, nil)
+	if err != nil {
+		t.Fatalf("Error running job again: %v", err)
+	}
+	want = Progress{JobID: want.JobID, Total: 2, Enqueued: 1, Skipped: 1}
+	if p != want {
+		t.Errorf("Expected %+v, but got %+v", want, p)
+	}
+	if len(published) != 2 || published[1].ProductID != 2 || published[1].NotBefore != &notBefore {
+		t.Errorf("Unexpected messages: %+v", published)
+	}
+
+	progress, err := database.GetReprocessProgress(testDB, want.JobID)
+	if err != nil {
+		t.Fatalf("Error getting progress: %v", err)
+	}
+	if progress.Total != 2 || progress.Enqueued != 2 {
+		t.Errorf("Unexpected progress: %+v", progress)
+	}
+
+	// Forcing the job enqueues everything again and tells the consumer to redo it
+	published = published[:0]
+	p, err = Run(context.Background(), testDB, publish, Options{Filter: opts.Filter, Rate: 1000, Force: true}, nil)
+	if err != nil || p.Enqueued != 2 || p.Skipped != 0 {
+		t.Errorf("Expected a forced run to enqueue 2 products, got %+v, %v", p, err)
+	}
+	if len(published) != 2 || !published[0].Force {
+		t.Errorf("Expected forced messages, but got %+v", published)
+	}
+
+	// A new job ID enqueues everything again
+	p, err = Run(context.Background(), testDB, publish, Options{Filter: opts.Filter, JobID: "quality-70", Rate: 1000}, nil)
+	if err != nil || p.Enqueued != 2 {
+		t.Errorf("Expected a new job to enqueue 2 products, got %+v, %v", p, err)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	testDB := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	publish := func(job msgqueue.Job) error { return nil }
+
+	p, err := Run(ctx, testDB, publish, Options{JobID: "cancelled"}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, but got %v", err)
+	}
+	if p.Enqueued != 0 {
+		t.Errorf("Expected nothing to be enqueued, but got %+v", p)
+	}
+	// The product that was about to be published is not recorded as enqueued
+	progress, _ := database.GetReprocessProgress(testDB, "cancelled")
+	if progress.Enqueued != 0 {
+		t.Errorf("Expected no items, but got %+v", progress)
+	}
+}
+
+func TestJobID(t *testing.T) {
+	a := JobID(database.ProductFilter{MinProductID: 1})
+	if a != JobID(database.ProductFilter{MinProductID: 1}) {
+		t.Error("Expected the same filter to give the same job ID")
+	}
+	if a == JobID(database.ProductFilter{MinProductID: 2}) {
+		t.Error("Expected different filters to give different job IDs")
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if got, err := NotBefore("", 0, now); got != nil || err != nil {
+		t.Errorf("Expected no time, got %v, %v", got, err)
+	}
+	if got, err := NotBefore("", 30*time.Minute, now); err != nil || !got.Equal(now.Add(30*time.Minute)) {
+		t.Errorf("Expected 30 minutes from now, got %v, %v", got, err)
+	}
+	if got, err := NotBefore("2024-03-02T09:00:00+01:00", 0, now); err != nil || !got.Equal(time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected time %v, %v", got, err)
+	}
+	for _, c := range []struct {
+		at    string
+		delay time.Duration
+	}{{"2024-03-02", 0}, {"", -time.Second}, {"2024-03-02T09:00:00Z", time.Minute}} {
+		if _, err := NotBefore(c.at, c.delay, now); err == nil {
+			t.Errorf("Expected an error for %q and %v", c.at, c.delay)
+		}
+	}
+}
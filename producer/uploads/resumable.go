@@ -0,0 +1,198 @@
+package uploads
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/producer/database"
+	"github.com/sirupsen/logrus"
+)
+
+// partsDir is the folder the chunks of resumable uploads are stored under until
+// the upload completes
+const partsDir = uploadsDir + "/partial"
+
+// partsPrefix is the prefix of the chunks of an upload
+func partsPrefix(uploadID string) string {
+	return partsDir + "/" + uploadID + "/"
+}
+
+// WritePart streams a chunk of size bytes of a resumable upload starting at offset
+// to store. A chunk that ends early, e.g. because the connection dropped, is not
+// kept. Chunk keys are unique, so a chunk sent twice concurrently never overwrites
+// the one that was kept.
+func WritePart(ctx context.Context, store storage.Storage, uploadID string, offset int64, r io.Reader, size int64) (string, error) {
+	key := fmt.Sprintf("%s%020d-%s", partsPrefix(uploadID), offset, randomID())
+	if err := store.Put(ctx, key, &exactReader{r: r, remaining: size}, size, "application/offset+octet-stream"); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// exactReader reads the first remaining bytes of r and fails if r ends before them
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// part is a stored chunk of a resumable upload
+type part struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+// parts returns the chunks that make up the first length bytes of an upload in
+// order. Leftovers of chunks that lost a race are skipped.
+func parts(ctx context.Context, store storage.Storage, uploadID string, length int64) ([]part, error) {
+	objects, err := store.List(ctx, partsPrefix(uploadID))
+	if err != nil {
+		return nil, err
+	}
+	all := []part{}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, partsPrefix(uploadID))
+		offset, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		all = append(all, part{key: obj.Key, offset: offset, size: obj.Size})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].offset < all[j].offset })
+
+	chain, ok := chainParts(all, 0, length)
+	if !ok {
+		return nil, fmt.Errorf("upload %s does not have all %d bytes stored", uploadID, length)
+	}
+	return chain, nil
+}
+
+// chainParts finds chunks that cover from offset to length without gaps. Leftover
+// chunks can start at the same offset as the kept one, so dead ends are backtracked.
+func chainParts(all []part, offset int64, length int64) ([]part, bool) {
+	if offset == length {
+		return []part{}, true
+	}
+	for _, p := range all {
+		if p.offset != offset || p.size <= 0 || p.offset+p.size > length {
+			continue
+		}
+		if rest, ok := chainParts(all, offset+p.size, length); ok {
+			return append([]part{p}, rest...), true
+		}
+	}
+	return nil, false
+}
+
+// Assemble joins the chunks of a completed upload into a single image, checked like
+// a direct upload, and removes the chunks
+func Assemble(ctx context.Context, store storage.Storage, productID int64, uploadID string, length int64, maxBytes int64) (storage.Ref, error) {
+	chain, err := parts(ctx, store, uploadID, length)
+	if err != nil {
+		return storage.Ref{}, err
+	}
+	r := &partsReader{ctx: ctx, store: store, parts: chain}
+	defer r.Close()
+	ref, err := Stream(ctx, store, productID, r, length, maxBytes)
+	if err != nil {
+		return storage.Ref{}, err
+	}
+	DeleteParts(ctx, store, uploadID)
+	return ref, nil
+}
+
+// partsReader reads the chunks of an upload one after another
+type partsReader struct {
+	ctx     context.Context
+	store   storage.Storage
+	parts   []part
+	current io.ReadCloser
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			rc, _, err := r.store.Get(r.ctx, r.parts[0].key)
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.parts = rc, r.parts[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// DeleteParts removes the stored chunks of an upload
+func DeleteParts(ctx context.Context, store storage.Storage, uploadID string) {
+	objects, err := store.List(ctx, partsPrefix(uploadID))
+	if err != nil {
+		logrus.Warnf("Failed to list chunks of upload %s: %v", uploadID, err)
+		return
+	}
+	for _, obj := range objects {
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			logrus.Warnf("Failed to delete chunk %s: %v", obj.Key, err)
+		}
+	}
+}
+
+// SweepExpired removes resumable uploads that expired before now, with their chunks
+func SweepExpired(ctx context.Context, db *sql.DB, store storage.Storage, now time.Time) (int, error) {
+	ids, err := database.ExpiredResumableUploads(db, now)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		DeleteParts(ctx, store, id)
+		if err := database.DeleteResumableUpload(db, id); err != nil {
+			return 0, err
+		}
+	}
+	if len(ids) > 0 {
+		logrus.Infof("Removed %d expired resumable uploads", len(ids))
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,114 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/golang_backend_assignment/producer/database"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestAssemble(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 40))); err != nil {
+		t.Fatalf("Error encoding image: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Chunks arrive out of order, and a chunk that lost a race is left behind
+	for _, chunk := range []struct{ from, to int }{{10, len(data)}, {0, 10}, {0, 5}} {
+		if _, err := WritePart(ctx, store, "u1", int64(chunk.from), bytes.NewReader(data[chunk.from:chunk.to]), int64(chunk.to-chunk.from)); err != nil {
+			t.Fatalf("Error writing chunk: %v", err)
+		}
+	}
+	// A chunk cut off before its announced size is not kept
+	if _, err := WritePart(ctx, store, "u1", int64(len(data)), bytes.NewReader([]byte{1, 2}), 3); err == nil {
+		t.Errorf("Expected an error writing a chunk shorter than announced")
+	}
+	if _, err := Assemble(ctx, store, 3, "u1", int64(len(data))+1, DefaultMaxBytes); err == nil {
+		t.Errorf("Expected an error assembling an incomplete upload")
+	}
+
+	ref, err := Assemble(ctx, store, 3, "u1", int64(len(data)), DefaultMaxBytes)
+	if err != nil {
+		t.Fatalf("Error assembling upload: %v", err)
+	}
+	r, _, err := store.Get(ctx, ref.Key)
+	if err != nil {
+		t.Fatalf("Error reading assembled upload: %v", err)
+	}
+	assembled, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(assembled, data) {
+		t.Errorf("Assembled upload differs from the sent chunks")
+	}
+	if parts, _ := store.List(ctx, partsPrefix("u1")); len(parts) != 0 {
+		t.Errorf("Expected the chunks to be deleted, but got %d", len(parts))
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Error opening test database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE ResumableUploads (
+			upload_id TEXT PRIMARY KEY,
+			product_id INTEGER,
+			filename TEXT,
+			upload_length INTEGER,
+			upload_offset INTEGER DEFAULT 0,
+			image_ref TEXT DEFAULT '',
+			assembling_until TEXT,
+			expires_at TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		)
+	`)
+	if err != nil {
+		t.Fatalf("Error creating ResumableUploads table: %v", err)
+	}
+	store, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	for id, expires := range map[string]time.Time{"old": now.Add(-time.Minute), "new": now.Add(time.Hour)} {
+		if err := database.CreateResumableUpload(db, database.ResumableUpload{UploadID: id, ProductID: 1, Length: 10, ExpiresAt: expires}); err != nil {
+			t.Fatalf("Error creating upload: %v", err)
+		}
+		if _, err := WritePart(ctx, store, id, 0, strings.NewReader("chunk"), 5); err != nil {
+			t.Fatalf("Error writing chunk: %v", err)
+		}
+	}
+
+	n, err := SweepExpired(ctx, db, store, now)
+	if err != nil || n != 1 {
+		t.Fatalf("SweepExpired() = %d, %v, want 1 upload removed", n, err)
+	}
+	if _, err := database.GetResumableUpload(db, "old"); err != sql.ErrNoRows {
+		t.Errorf("Expected the expired upload to be deleted, but got %v", err)
+	}
+	if parts, _ := store.List(ctx, partsPrefix("old")); len(parts) != 0 {
+		t.Errorf("Expected the chunks of the expired upload to be deleted")
+	}
+	if parts, _ := store.List(ctx, partsPrefix("new")); len(parts) != 1 {
+		t.Errorf("Expected the chunks of the active upload to be kept")
+	}
+}
@@ -0,0 +1,139 @@
+// Package uploads streams image files sent by clients to the storage backend, where
+// the consumer picks them up as the originals of a product's images.
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/golang_backend_assignment/consumer/imageutils"
+	"github.com/golang_backend_assignment/consumer/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTooLarge is returned for files over the size limit
+var ErrTooLarge = errors.New("file is too large")
+
+// ErrUnsupportedType is returned for files that are not an accepted image type
+var ErrUnsupportedType = errors.New("unsupported file type")
+
+// ErrEmpty is returned for empty files
+var ErrEmpty = errors.New("file is empty")
+
+// uploadsDir is the folder uploaded originals are stored under
+const uploadsDir = "uploads"
+
+// sniffLen is how much of a file is read to detect its type
+const sniffLen = 512
+
+// imageExtensions maps the accepted content types, those the consumer can decode,
+// to file extensions
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// DefaultMaxBytes is the size limit used when Limits.MaxBytes is zero. It is the
+// limit the consumer reads uploads with by default.
+const DefaultMaxBytes = imageutils.DefaultMaxUploadBytes
+
+// Limits bounds what clients can upload
+type Limits struct {
+	MaxBytes int64 // largest accepted file
+	MaxFiles int   // most files accepted in one request
+}
+
+// Save checks the type and size of an uploaded file and streams it to the uploads of
+// the product in store. The type is sniffed from the content rather than trusted
+// from the client.
+func Save(ctx context.Context, store storage.Storage, productID int64, file *multipart.FileHeader, limits Limits) (storage.Ref, error) {
+	maxBytes := limits.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if file.Size > maxBytes {
+		return storage.Ref{}, fmt.Errorf("%w: %s is over %d bytes", ErrTooLarge, file.Filename, maxBytes)
+	}
+	if file.Size == 0 {
+		return storage.Ref{}, fmt.Errorf("%w: %s", ErrEmpty, file.Filename)
+	}
+	f, err := file.Open()
+	if err != nil {
+		return storage.Ref{}, err
+	}
+	defer f.Close()
+	return Stream(ctx, store, productID, f, file.Size, maxBytes)
+}
+
+// Stream checks the type of r, which must hold size bytes, and writes it to a new
+// key among the uploads of the product in store. Reading more than maxBytes fails
+// the upload.
+func Stream(ctx context.Context, store storage.Storage, productID int64, r io.Reader, size int64, maxBytes int64) (storage.Ref, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return storage.Ref{}, err
+	}
+	head = head[:n]
+	if n == 0 {
+		return storage.Ref{}, ErrEmpty
+	}
+	contentType := http.DetectContentType(head)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return storage.Ref{}, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+
+	key := storage.UploadsPrefix(strconv.FormatInt(productID, 10)) + randomID() + ext
+	body := &limitedReader{r: io.MultiReader(bytes.NewReader(head), r), remaining: maxBytes}
+	if err := store.Put(ctx, key, body, size, contentType); err != nil {
+		if body.exceeded {
+			return storage.Ref{}, fmt.Errorf("%w: over %d bytes", ErrTooLarge, maxBytes)
+		}
+		return storage.Ref{}, err
+	}
+	logrus.Infof("Stored upload of %d bytes as %s:%s", size, store.Name(), key)
+	return storage.Ref{Backend: store.Name(), Key: key}, nil
+}
+
+// limitedReader fails once more than remaining bytes are read, so that a body
+// larger than announced aborts the write instead of being truncated
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		l.exceeded = true
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// Delete removes stored uploads, e.g. after the request they belong to failed
+func Delete(ctx context.Context, store storage.Storage, refs []storage.Ref) {
+	for _, ref := range refs {
+		if err := store.Delete(ctx, ref.Key); err != nil {
+			logrus.Warnf("Failed to delete upload %s: %v", ref, err)
+		}
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
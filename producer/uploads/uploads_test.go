@@ -0,0 +1,73 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang_backend_assignment/consumer/storage"
+)
+
+func TestStream(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("Error creating storage: %v", err)
+	}
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Error encoding image: %v", err)
+	}
+	data := buf.Bytes()
+
+	ref, err := Stream(ctx, store, 3, bytes.NewReader(data), int64(len(data)), DefaultMaxBytes)
+	if err != nil {
+		t.Fatalf("Error streaming upload: %v", err)
+	}
+	if ref.Backend != "local" || !strings.HasPrefix(ref.Key, "uploads/3/") || !strings.HasSuffix(ref.Key, ".png") {
+		t.Errorf("Unexpected ref %s", ref)
+	}
+	r, info, err := store.Get(ctx, ref.Key)
+	if err != nil {
+		t.Fatalf("Error reading upload: %v", err)
+	}
+	stored, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(stored, data) || info.Size != int64(len(data)) {
+		t.Errorf("Stored upload differs from the sent file")
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		maxBytes int64
+		wantErr  error
+	}{
+		{"unsupported type", []byte("<html><body>not an image</body></html>"), DefaultMaxBytes, ErrUnsupportedType},
+		{"webp, which the consumer cannot decode", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), DefaultMaxBytes, ErrUnsupportedType},
+		{"empty", []byte{}, DefaultMaxBytes, ErrEmpty},
+		{"too large", data, int64(len(data)) - 1, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Stream(ctx, store, 3, bytes.NewReader(tt.data), int64(len(tt.data)), tt.maxBytes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Stream() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Rejected uploads leave nothing behind
+	objects, err := store.List(ctx, "uploads/")
+	if err != nil {
+		t.Fatalf("Error listing uploads: %v", err)
+	}
+	if len(objects) != 1 {
+		t.Errorf("Expected 1 stored upload, but got %d", len(objects))
+	}
+}